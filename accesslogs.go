@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	athenatypes "github.com/aws/aws-sdk-go-v2/service/athena/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// elbLogAccounts are the accounts Elastic Load Balancing writes access logs
+// from in the regions that existed before August 2022. Newer regions deliver
+// them through the logdelivery.elasticloadbalancing.amazonaws.com service.
+var elbLogAccounts = map[string]string{
+	"us-east-1":      "127311923021",
+	"us-east-2":      "033677994240",
+	"us-west-1":      "027434742980",
+	"us-west-2":      "797873946194",
+	"af-south-1":     "098369216593",
+	"ap-east-1":      "754344448648",
+	"ap-south-1":     "718504428378",
+	"ap-northeast-1": "582318560864",
+	"ap-northeast-2": "600734575887",
+	"ap-northeast-3": "383597477331",
+	"ap-southeast-1": "114774131450",
+	"ap-southeast-2": "783225319266",
+	"ap-southeast-3": "589379963580",
+	"ca-central-1":   "985666609251",
+	"eu-central-1":   "054676820928",
+	"eu-west-1":      "156460612806",
+	"eu-west-2":      "652711504416",
+	"eu-west-3":      "009996457667",
+	"eu-south-1":     "635631232127",
+	"eu-north-1":     "897822967062",
+	"me-south-1":     "076674570225",
+	"sa-east-1":      "507241528517",
+}
+
+// accessLogBucketName adds a random suffix because bucket names are global.
+func accessLogBucketName(stack string) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "aws-wp-" + stack + "-logs-" + hex.EncodeToString(suffix)
+}
+
+// enableAccessLogs creates a private bucket for the load balancer's access
+// logs, expires everything in it after the given number of days and turns
+// the logs on. The bucket is recorded on the load balancer as soon as it is
+// set up so destroy can remove it.
+func enableAccessLogs(client *s3.Client, elbClient *elb.Client, state *stackState, days int32) bool {
+	lb := state.LoadBalancer
+	bucket := accessLogBucketName(state.Name)
+
+	if !createStackBucket(client, bucket, state.Region, state.Name, "expire-access-logs", days) {
+		return false
+	}
+	lb.AccessLogBucket = bucket
+	saveStackState(state)
+
+	_, err := client.PutBucketPolicy(context.TODO(), &s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucket),
+		Policy: aws.String(accessLogBucketPolicy(bucket, state.Region)),
+	})
+	if err != nil {
+		fmt.Println("Got an error setting the access log bucket policy:")
+		fmt.Println(err)
+		return false
+	}
+
+	// Turning the logs on makes the load balancer write a test file, which
+	// fails until the new bucket policy has taken effect.
+	for attempt := 0; ; attempt++ {
+		_, err = elbClient.ModifyLoadBalancerAttributes(context.TODO(), &elb.ModifyLoadBalancerAttributesInput{
+			LoadBalancerArn: aws.String(lb.Arn),
+			Attributes: []elbtypes.LoadBalancerAttribute{
+				{Key: aws.String("access_logs.s3.enabled"), Value: aws.String("true")},
+				{Key: aws.String("access_logs.s3.bucket"), Value: aws.String(bucket)},
+			},
+		})
+		if err == nil {
+			break
+		}
+		if !isErrorCode(err, "InvalidConfigurationRequest") || attempt == 10 {
+			fmt.Println("Got an error enabling the load balancer access logs:")
+			fmt.Println(err)
+			return false
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	emit(eventAccessLogsEnabled, "bucket", bucket, "expire_days", strconv.Itoa(int(days)))
+	return true
+}
+
+func accessLogBucketPolicy(bucket string, region string) string {
+	principal := map[string]string{"Service": "logdelivery.elasticloadbalancing.amazonaws.com"}
+	if account, ok := elbLogAccounts[region]; ok {
+		principal = map[string]string{"AWS": "arn:aws:iam::" + account + ":root"}
+	}
+
+	policy, _ := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":    "Allow",
+				"Principal": principal,
+				"Action":    "s3:PutObject",
+				"Resource":  "arn:aws:s3:::" + bucket + "/AWSLogs/*",
+			},
+		},
+	})
+	return string(policy)
+}
+
+// createStackBucket creates a private bucket tagged with the stack that
+// expires its objects, and aborts unfinished multipart uploads, after the
+// given number of days, or keeps them with 0. A bucket it cannot finish setting up is deleted again.
+func createStackBucket(client *s3.Client, bucket string, region string, stack string, rule string, days int32) bool {
+	bucketInput := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	if region != "us-east-1" {
+		bucketInput.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := client.CreateBucket(context.TODO(), bucketInput); err != nil {
+		fmt.Println("Got an error creating the bucket:")
+		fmt.Println(err)
+		return false
+	}
+
+	_, err := client.PutPublicAccessBlock(context.TODO(), &s3.PutPublicAccessBlockInput{
+		Bucket: aws.String(bucket),
+		PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       true,
+			BlockPublicPolicy:     true,
+			IgnorePublicAcls:      true,
+			RestrictPublicBuckets: true,
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error blocking public access to the bucket:")
+		fmt.Println(err)
+		deleteBucket(client, bucket)
+		return false
+	}
+
+	_, err = client.PutBucketTagging(context.TODO(), &s3.PutBucketTaggingInput{
+		Bucket:  aws.String(bucket),
+		Tagging: &types.Tagging{TagSet: []types.Tag{{Key: aws.String(stackTag), Value: aws.String(stack)}}},
+	})
+	if err != nil {
+		fmt.Println("Got an error tagging the bucket:")
+		fmt.Println(err)
+		deleteBucket(client, bucket)
+		return false
+	}
+
+	if days == 0 {
+		return true
+	}
+	_, err = client.PutBucketLifecycleConfiguration(context.TODO(), &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: []types.LifecycleRule{
+				{
+					ID:         aws.String(rule),
+					Status:     types.ExpirationStatusEnabled,
+					Filter:     &types.LifecycleRuleFilterMemberPrefix{Value: ""},
+					Expiration: &types.LifecycleExpiration{Days: days},
+					AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+						DaysAfterInitiation: days,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error setting the bucket lifecycle:")
+		fmt.Println(err)
+		deleteBucket(client, bucket)
+		return false
+	}
+	return true
+}
+
+// deleteBucket empties the bucket, aborting its unfinished multipart uploads,
+// and deletes it.
+func deleteBucket(client *s3.Client, bucket string) bool {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+
+	for {
+		result, err := client.ListObjectsV2(context.TODO(), input)
+		if isErrorCode(err, "NoSuchBucket") {
+			return true
+		}
+		if err != nil {
+			fmt.Println("Got an error listing the bucket:")
+			fmt.Println(err)
+			return false
+		}
+
+		if len(result.Contents) > 0 {
+			objects := make([]types.ObjectIdentifier, len(result.Contents))
+			for i, o := range result.Contents {
+				objects[i] = types.ObjectIdentifier{Key: o.Key}
+			}
+			_, err = client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &types.Delete{Objects: objects, Quiet: true},
+			})
+			if err != nil {
+				fmt.Println("Got an error emptying the bucket:")
+				fmt.Println(err)
+				return false
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		input.ContinuationToken = result.NextContinuationToken
+	}
+
+	uploads, err := client.ListMultipartUploads(context.TODO(), &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		fmt.Println("Got an error listing the multipart uploads:")
+		fmt.Println(err)
+		return false
+	}
+	for _, u := range uploads.Uploads {
+		_, err := client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		})
+		if err != nil && !isErrorCode(err, "NoSuchUpload") {
+			fmt.Println("Got an error aborting the multipart upload:")
+			fmt.Println(err)
+			return false
+		}
+	}
+
+	_, err = client.DeleteBucket(context.TODO(), &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	if err != nil && !isErrorCode(err, "NoSuchBucket") {
+		fmt.Println("Got an error deleting the bucket:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventBucketDeleted, "bucket", bucket)
+	return true
+}
+
+// athenaDatabase holds one access log table per stack.
+const athenaDatabase = "aws_wp"
+
+// albLogTable declares the access log format over the whole AWSLogs prefix,
+// which Athena reads recursively. Only the leading fields get columns.
+const albLogTable = `CREATE EXTERNAL TABLE %s (
+  type string, time string, elb string, client_ip string, client_port int,
+  target_ip string, target_port int, request_processing_time double,
+  target_processing_time double, response_processing_time double,
+  elb_status_code int, target_status_code string, received_bytes bigint,
+  sent_bytes bigint, request_verb string, request_url string,
+  request_proto string, user_agent string, rest string)
+ROW FORMAT SERDE 'org.apache.hadoop.hive.serde2.RegexSerDe'
+WITH SERDEPROPERTIES (
+  'serialization.format' = '1',
+  'input.regex' = '([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*):([0-9]*) ([^ ]*)[:-]([0-9]*) ([-.0-9]*) ([-.0-9]*) ([-.0-9]*) (|[-0-9]*) (-|[-0-9]*) ([-0-9]*) ([-0-9]*) \"([^ ]*) (.*) (- |[^ ]*)\" \"([^\"]*)\"(.*)')
+LOCATION 's3://%s/AWSLogs/'`
+
+func albLogTableName(stack string) string {
+	return athenaDatabase + ".alb_" + strings.ReplaceAll(stack, "-", "_")
+}
+
+// prepareAlbLogTable creates the Athena database when it does not exist yet
+// and creates the stack's table afresh. A stack created again under the same
+// name has a new bucket, so a table left from before would read the old one;
+// dropping the external table leaves the logs alone.
+func prepareAlbLogTable(client *athena.Client, stack string, bucket string) error {
+	statements := []string{
+		"CREATE DATABASE IF NOT EXISTS " + athenaDatabase,
+		"DROP TABLE IF EXISTS " + albLogTableName(stack),
+		fmt.Sprintf(albLogTable, albLogTableName(stack), bucket),
+	}
+	for _, statement := range statements {
+		if _, err := runAthenaQuery(client, bucket, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAthenaQuery runs a query with its results written next to the logs
+// and returns the rows keyed by column name.
+func runAthenaQuery(client *athena.Client, bucket string, query string) ([]map[string]string, error) {
+	started, err := client.StartQueryExecution(context.TODO(), &athena.StartQueryExecutionInput{
+		QueryString: aws.String(query),
+		ResultConfiguration: &athenatypes.ResultConfiguration{
+			OutputLocation: aws.String("s3://" + bucket + "/athena-results/"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		result, err := client.GetQueryExecution(context.TODO(), &athena.GetQueryExecutionInput{
+			QueryExecutionId: started.QueryExecutionId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		status := result.QueryExecution.Status
+		if status.State == athenatypes.QueryExecutionStateSucceeded {
+			break
+		}
+		if status.State == athenatypes.QueryExecutionStateFailed || status.State == athenatypes.QueryExecutionStateCancelled {
+			return nil, fmt.Errorf("query %s: %s", strings.ToLower(string(status.State)), aws.ToString(status.StateChangeReason))
+		}
+		log.Printf("Query still running...")
+		time.Sleep(time.Second)
+	}
+
+	var rows []map[string]string
+	input := &athena.GetQueryResultsInput{QueryExecutionId: started.QueryExecutionId}
+	header := true
+	for {
+		result, err := client.GetQueryResults(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+
+		columns := result.ResultSet.ResultSetMetadata.ColumnInfo
+		for _, r := range result.ResultSet.Rows {
+			// The first row of a SELECT repeats the column names.
+			if header {
+				header = false
+				continue
+			}
+			row := map[string]string{}
+			for i, d := range r.Data {
+				if i < len(columns) {
+					row[aws.ToString(columns[i].Name)] = aws.ToString(d.VarCharValue)
+				}
+			}
+			rows = append(rows, row)
+		}
+
+		if result.NextToken == nil {
+			return rows, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// agentNamespace is where the CloudWatch agent publishes its metrics by
+// default. The tool does not install the agent; images or hooks that do get
+// their disk, memory and inode usage shown by status.
+const agentNamespace = "CWAgent"
+
+func diskAlarmName(stack string) string {
+	return "aws-wp-" + stack + "-disk"
+}
+
+// agentMetrics lists the agent metrics reported for the instance. Which
+// dimensions come along with InstanceId depends on the agent config, so
+// queries and alarms use the metrics exactly as listed here.
+func agentMetrics(client *cloudwatch.Client, instanceId string) ([]types.Metric, error) {
+	input := &cloudwatch.ListMetricsInput{
+		Namespace: aws.String(agentNamespace),
+		Dimensions: []types.DimensionFilter{
+			{
+				Name:  aws.String("InstanceId"),
+				Value: aws.String(instanceId),
+			},
+		},
+	}
+
+	var metrics []types.Metric
+	for {
+		result, err := client.ListMetrics(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, result.Metrics...)
+		if result.NextToken == nil {
+			return metrics, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// rootMetric picks the named metric, for the root filesystem when it is a
+// disk metric.
+func rootMetric(metrics []types.Metric, name string) *types.Metric {
+	for i, m := range metrics {
+		if aws.ToString(m.MetricName) != name {
+			continue
+		}
+		path := ""
+		for _, d := range m.Dimensions {
+			if aws.ToString(d.Name) == "path" {
+				path = aws.ToString(d.Value)
+			}
+		}
+		if path == "" || path == "/" {
+			return &metrics[i]
+		}
+	}
+	return nil
+}
+
+// usageValue is a percentage the agent reported.
+type usageValue struct {
+	Percent float64
+}
+
+type inodeUsage struct {
+	Used    float64
+	Total   float64
+	Percent float64
+}
+
+// agentUsage is the latest usage of the root filesystem and memory. A value
+// the agent does not report is nil.
+type agentUsage struct {
+	Disk   *usageValue
+	Memory *usageValue
+	Inodes *inodeUsage
+}
+
+// latestAgentUsage gets the usage status shows. It is empty when the agent
+// does not report for the instance.
+func latestAgentUsage(client *cloudwatch.Client, instanceId string) agentUsage {
+	usage := agentUsage{}
+	metrics, err := agentMetrics(client, instanceId)
+	if err != nil {
+		fmt.Println("Got an error listing the CloudWatch agent metrics:")
+		fmt.Println(err)
+		return usage
+	}
+
+	names := map[string]string{
+		"disk":        "disk_used_percent",
+		"memory":      "mem_used_percent",
+		"inodesUsed":  "disk_inodes_used",
+		"inodesTotal": "disk_inodes_total",
+	}
+	var queries []types.MetricDataQuery
+	for id, name := range names {
+		m := rootMetric(metrics, name)
+		if m == nil {
+			continue
+		}
+		queries = append(queries, types.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &types.MetricStat{
+				Metric: m,
+				Period: aws.Int32(60),
+				Stat:   aws.String("Average"),
+			},
+		})
+	}
+	if len(queries) == 0 {
+		return usage
+	}
+
+	end := time.Now()
+	result, err := client.GetMetricData(context.TODO(), &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: queries,
+		StartTime:         aws.Time(end.Add(-15 * time.Minute)),
+		EndTime:           aws.Time(end),
+		ScanBy:            types.ScanByTimestampDescending,
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the CloudWatch agent metrics:")
+		fmt.Println(err)
+		return usage
+	}
+
+	latest := map[string]float64{}
+	for _, r := range result.MetricDataResults {
+		if len(r.Values) > 0 {
+			latest[aws.ToString(r.Id)] = r.Values[0]
+		}
+	}
+
+	if v, ok := latest["disk"]; ok {
+		usage.Disk = &usageValue{Percent: v}
+	}
+	if v, ok := latest["memory"]; ok {
+		usage.Memory = &usageValue{Percent: v}
+	}
+	used, hasUsed := latest["inodesUsed"]
+	total, hasTotal := latest["inodesTotal"]
+	if hasUsed && hasTotal && total > 0 {
+		usage.Inodes = &inodeUsage{Used: used, Total: total, Percent: 100 * used / total}
+	}
+	return usage
+}
+
+// createDiskAlarm alarms when the root filesystem is at least threshold
+// percent full for ten minutes. It needs the agent to have reported disk
+// usage already, since the alarm has to match the metric's dimensions. The
+// alarm notifies actions, the topics of the config's sns notify sinks.
+func createDiskAlarm(client *cloudwatch.Client, stack string, instanceId string, threshold int, actions []string) string {
+	metrics, err := agentMetrics(client, instanceId)
+	if err != nil {
+		fmt.Println("Got an error listing the CloudWatch agent metrics:")
+		fmt.Println(err)
+		return ""
+	}
+	metric := rootMetric(metrics, "disk_used_percent")
+	if metric == nil {
+		fmt.Printf("The CloudWatch agent does not report disk usage for %s yet, run aws-wp status -name %s -alarm-disk %d once it does\n",
+			instanceId, stack, threshold)
+		return ""
+	}
+
+	alarmName := diskAlarmName(stack)
+	_, err = client.PutMetricAlarm(context.TODO(), &cloudwatch.PutMetricAlarmInput{
+		AlarmName:          aws.String(alarmName),
+		AlarmDescription:   aws.String("Root filesystem of the WordPress instance of stack " + stack + " is filling up"),
+		Namespace:          metric.Namespace,
+		MetricName:         metric.MetricName,
+		Dimensions:         metric.Dimensions,
+		Statistic:          types.StatisticMaximum,
+		Period:             aws.Int32(300),
+		EvaluationPeriods:  aws.Int32(2),
+		Threshold:          aws.Float64(float64(threshold)),
+		ComparisonOperator: types.ComparisonOperatorGreaterThanOrEqualToThreshold,
+		AlarmActions:       actions,
+		OKActions:          actions,
+		Tags: []types.Tag{
+			{
+				Key:   aws.String(stackTag),
+				Value: aws.String(stack),
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the disk alarm:")
+		fmt.Println(err)
+		return ""
+	}
+
+	return alarmName
+}
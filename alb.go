@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+// loadBalancer is the stack's Application Load Balancer. The stack's
+// instance is the single target of its target group. While replace shifts
+// traffic, the new instance sits in a second, canary target group.
+type loadBalancer struct {
+	Arn                  string `json:"arn"`
+	DNSName              string `json:"dns_name"`
+	HostedZoneId         string `json:"hosted_zone_id,omitempty"`
+	TargetGroupArn       string `json:"target_group_arn"`
+	CanaryTargetGroupArn string `json:"canary_target_group_arn,omitempty"`
+	HTTPS                bool   `json:"https,omitempty"`
+	AccessLogBucket      string `json:"access_log_bucket,omitempty"`
+
+	// The web ACL of -login-rate-limit, in requests per client IP and five
+	// minutes.
+	WebACLArn      string `json:"web_acl_arn,omitempty"`
+	WebACLId       string `json:"web_acl_id,omitempty"`
+	LoginRateLimit int64  `json:"login_rate_limit,omitempty"`
+}
+
+func (lb *loadBalancer) url() string {
+	if lb.HTTPS {
+		return "https://" + lb.DNSName
+	}
+	return "http://" + lb.DNSName
+}
+
+// albOptions are the create flags that shape the load balancer.
+type albOptions struct {
+	certificateArn string
+	stickiness     time.Duration
+	healthCheck    healthCheck
+	port           int32
+}
+
+// healthCheckCodes are the responses the target group counts as healthy.
+// It cannot send credentials, so behind basic authentication the 401 is
+// as good as it gets.
+func healthCheckCodes(check healthCheck) string {
+	if check.hasAuth() {
+		return "200-399,401"
+	}
+	return "200-399"
+}
+
+func loadBalancerName(stack string) string {
+	return "aws-wp-" + stack
+}
+
+// createLoadBalancer creates an internet-facing ALB in the VPC (the default
+// VPC when vpcId is empty) and returns it along with the VPC it is in. On
+// failure the load balancer is still returned if it got created, so the
+// caller can record it for destroy.
+func createLoadBalancer(ec2Client *ec2.Client, client *elb.Client, stack string, vpcId string, securityGroupId string, options albOptions) (*loadBalancer, string, bool) {
+	vpcId, subnets := loadBalancerSubnets(ec2Client, vpcId)
+	if len(subnets) < 2 {
+		fmt.Println("A load balancer needs public subnets, with a route to an internet gateway, in at least two availability zones")
+		return nil, "", false
+	}
+
+	tags := []types.Tag{{Key: aws.String(stackTag), Value: aws.String(stack)}}
+
+	balancer, err := client.CreateLoadBalancer(context.TODO(), &elb.CreateLoadBalancerInput{
+		Name:           aws.String(loadBalancerName(stack)),
+		Type:           types.LoadBalancerTypeEnumApplication,
+		Scheme:         types.LoadBalancerSchemeEnumInternetFacing,
+		Subnets:        subnets,
+		SecurityGroups: []string{securityGroupId},
+		Tags:           tags,
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the load balancer:")
+		fmt.Println(err)
+		return nil, "", false
+	}
+
+	lb := &loadBalancer{
+		Arn:          aws.ToString(balancer.LoadBalancers[0].LoadBalancerArn),
+		DNSName:      aws.ToString(balancer.LoadBalancers[0].DNSName),
+		HostedZoneId: aws.ToString(balancer.LoadBalancers[0].CanonicalHostedZoneId),
+		HTTPS:        options.certificateArn != "",
+	}
+
+	targetGroup, err := client.CreateTargetGroup(context.TODO(), &elb.CreateTargetGroupInput{
+		Name:            aws.String(loadBalancerName(stack)),
+		Protocol:        types.ProtocolEnumHttp,
+		Port:            aws.Int32(options.port),
+		VpcId:           aws.String(vpcId),
+		TargetType:      types.TargetTypeEnumInstance,
+		HealthCheckPath: aws.String(options.healthCheck.path()),
+		Matcher:         &types.Matcher{HttpCode: aws.String(healthCheckCodes(options.healthCheck))},
+		Tags:            tags,
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the target group:")
+		fmt.Println(err)
+		return lb, vpcId, false
+	}
+	lb.TargetGroupArn = aws.ToString(targetGroup.TargetGroups[0].TargetGroupArn)
+
+	if options.stickiness > 0 && !setStickiness(client, lb.TargetGroupArn, options.stickiness) {
+		return lb, vpcId, false
+	}
+
+	if !createListeners(client, lb, options.certificateArn) {
+		return lb, vpcId, false
+	}
+
+	emit(eventLoadBalancerCreated, "arn", lb.Arn, "dns_name", lb.DNSName)
+	return lb, vpcId, true
+}
+
+// loadBalancerSubnets picks one public subnet per availability zone of the
+// VPC, as an internet-facing load balancer in a private one gets no traffic.
+func loadBalancerSubnets(client *ec2.Client, vpcId string) (string, []string) {
+	if vpcId == "" {
+		vpcs, err := client.DescribeVpcs(context.TODO(), &ec2.DescribeVpcsInput{
+			Filters: []ec2types.Filter{{Name: aws.String("isDefault"), Values: []string{"true"}}},
+		})
+		if err != nil || len(vpcs.Vpcs) == 0 {
+			fmt.Println("Got an error finding the default VPC:")
+			fmt.Println(err)
+			return "", nil
+		}
+		vpcId = aws.ToString(vpcs.Vpcs[0].VpcId)
+	}
+
+	result, err := client.DescribeSubnets(context.TODO(), &ec2.DescribeSubnetsInput{
+		Filters: []ec2types.Filter{{Name: aws.String("vpc-id"), Values: []string{vpcId}}},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the subnets of the VPC:")
+		fmt.Println(err)
+		return vpcId, nil
+	}
+
+	public, ok := publicSubnets(client, vpcId)
+	if !ok {
+		return vpcId, nil
+	}
+
+	seen := map[string]bool{}
+	var subnets []string
+	for _, subnet := range result.Subnets {
+		zone := aws.ToString(subnet.AvailabilityZone)
+		if !seen[zone] && public(aws.ToString(subnet.SubnetId)) {
+			seen[zone] = true
+			subnets = append(subnets, aws.ToString(subnet.SubnetId))
+		}
+	}
+	return vpcId, subnets
+}
+
+// publicSubnets tells the subnets of the VPC whose route table, or the main
+// one when they have none of their own, sends 0.0.0.0/0 to an internet
+// gateway.
+func publicSubnets(client *ec2.Client, vpcId string) (func(subnetId string) bool, bool) {
+	result, err := client.DescribeRouteTables(context.TODO(), &ec2.DescribeRouteTablesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("vpc-id"), Values: []string{vpcId}}},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the route tables of the VPC:")
+		fmt.Println(err)
+		return nil, false
+	}
+
+	mainPublic := false
+	associated := map[string]bool{}
+	for _, table := range result.RouteTables {
+		internet := false
+		for _, route := range table.Routes {
+			if aws.ToString(route.DestinationCidrBlock) == "0.0.0.0/0" && strings.HasPrefix(aws.ToString(route.GatewayId), "igw-") {
+				internet = true
+			}
+		}
+		for _, association := range table.Associations {
+			if aws.ToBool(association.Main) {
+				mainPublic = internet
+			} else if association.SubnetId != nil {
+				associated[aws.ToString(association.SubnetId)] = internet
+			}
+		}
+	}
+
+	return func(subnetId string) bool {
+		if internet, ok := associated[subnetId]; ok {
+			return internet
+		}
+		return mainPublic
+	}, true
+}
+
+// The lb_cookie durations the load balancer accepts.
+const (
+	minStickiness = time.Second
+	maxStickiness = 7 * 24 * time.Hour
+)
+
+// setStickiness pins each browser to one target with a load balancer cookie,
+// which keeps logins working once a stack has more than one instance.
+func setStickiness(client *elb.Client, targetGroupArn string, duration time.Duration) bool {
+	_, err := client.ModifyTargetGroupAttributes(context.TODO(), &elb.ModifyTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Attributes: []types.TargetGroupAttribute{
+			{Key: aws.String("stickiness.enabled"), Value: aws.String("true")},
+			{Key: aws.String("stickiness.type"), Value: aws.String("lb_cookie")},
+			{Key: aws.String("stickiness.lb_cookie.duration_seconds"), Value: aws.String(strconv.Itoa(int(duration.Seconds())))},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error enabling stickiness:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// createListeners forwards HTTP to the target group, or with a certificate
+// serves HTTPS and redirects HTTP to it.
+func createListeners(client *elb.Client, lb *loadBalancer, certificateArn string) bool {
+	forward := []types.Action{{Type: types.ActionTypeEnumForward, TargetGroupArn: aws.String(lb.TargetGroupArn)}}
+
+	httpListener := &elb.CreateListenerInput{
+		LoadBalancerArn: aws.String(lb.Arn),
+		Protocol:        types.ProtocolEnumHttp,
+		Port:            aws.Int32(80),
+		DefaultActions:  forward,
+	}
+
+	if certificateArn != "" {
+		_, err := client.CreateListener(context.TODO(), &elb.CreateListenerInput{
+			LoadBalancerArn: aws.String(lb.Arn),
+			Protocol:        types.ProtocolEnumHttps,
+			Port:            aws.Int32(443),
+			Certificates:    []types.Certificate{{CertificateArn: aws.String(certificateArn)}},
+			DefaultActions:  forward,
+		})
+		if err != nil {
+			fmt.Println("Got an error creating the HTTPS listener:")
+			fmt.Println(err)
+			return false
+		}
+
+		httpListener.DefaultActions = []types.Action{
+			{
+				Type: types.ActionTypeEnumRedirect,
+				RedirectConfig: &types.RedirectActionConfig{
+					Protocol:   aws.String("HTTPS"),
+					Port:       aws.String("443"),
+					StatusCode: types.RedirectActionStatusCodeEnumHttp301,
+				},
+			},
+		}
+	}
+
+	_, err := client.CreateListener(context.TODO(), httpListener)
+	if err != nil {
+		fmt.Println("Got an error creating the HTTP listener:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// registerTarget puts the instance behind the load balancer and waits for
+// the load balancer's health check to pass.
+// registerTarget adds the instance to the target group and waits for it to
+// pass the health check, which only runs while a listener uses the group.
+func registerTarget(client *elb.Client, targetGroupArn string, instanceId string) bool {
+	return addTarget(client, targetGroupArn, instanceId) && waitTargetHealthy(client, targetGroupArn, instanceId)
+}
+
+// addTarget adds the instance to the target group without waiting.
+func addTarget(client *elb.Client, targetGroupArn string, instanceId string) bool {
+	_, err := client.RegisterTargets(context.TODO(), &elb.RegisterTargetsInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []types.TargetDescription{{Id: aws.String(instanceId)}},
+	})
+	if err != nil {
+		fmt.Println("Got an error registering the instance with the load balancer:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventTargetRegistered, "instance_id", instanceId)
+	return true
+}
+
+func deregisterTarget(client *elb.Client, targetGroupArn string, instanceId string) bool {
+	_, err := client.DeregisterTargets(context.TODO(), &elb.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []types.TargetDescription{{Id: aws.String(instanceId)}},
+	})
+	if err != nil && !isErrorCode(err, "InvalidTarget") {
+		fmt.Println("Got an error deregistering the instance from the load balancer:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+func waitTargetHealthy(client *elb.Client, targetGroupArn string, instanceId string) bool {
+	deadline := time.Now().Add(healthTimeout)
+
+	for time.Now().Before(deadline) {
+		result, err := client.DescribeTargetHealth(context.TODO(), &elb.DescribeTargetHealthInput{
+			TargetGroupArn: aws.String(targetGroupArn),
+			Targets:        []types.TargetDescription{{Id: aws.String(instanceId)}},
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving target health:")
+			fmt.Println(err)
+			return false
+		}
+
+		for _, t := range result.TargetHealthDescriptions {
+			if t.TargetHealth.State == types.TargetHealthStateEnumHealthy {
+				return true
+			}
+			log.Printf("Waiting for the load balancer health check... (%s)", t.TargetHealth.State)
+		}
+		time.Sleep(10 * time.Second)
+	}
+
+	fmt.Println("Got an error waiting for the load balancer health check to pass")
+	return false
+}
+
+// deleteLoadBalancer deletes the load balancer with its listeners, then its
+// target groups once the load balancer no longer uses them.
+func deleteLoadBalancer(client *elb.Client, lb *loadBalancer) bool {
+	if lb.Arn != "" {
+		_, err := client.DeleteLoadBalancer(context.TODO(), &elb.DeleteLoadBalancerInput{
+			LoadBalancerArn: aws.String(lb.Arn),
+		})
+		if err != nil && !isErrorCode(err, "LoadBalancerNotFound") {
+			fmt.Println("Got an error deleting the load balancer:")
+			fmt.Println(err)
+			return false
+		}
+		emit(eventLoadBalancerDeleted, "arn", lb.Arn)
+	}
+
+	for _, arn := range []string{lb.TargetGroupArn, lb.CanaryTargetGroupArn} {
+		if arn != "" && !deleteTargetGroup(client, arn) {
+			return false
+		}
+	}
+	return true
+}
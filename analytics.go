@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// accessLogParse pulls the fields out of the combined log format Apache and
+// nginx write by default.
+const accessLogParse = `parse @message /^(?<client>\S+) \S+ \S+ \[[^\]]+\] "(?<method>\S+) (?<path>[^ "?]+)[^"]*" (?<status>\d{3}) \S+ "[^"]*" "(?<agent>[^"]*)"/`
+
+// botAgents matches the user agents of crawlers, monitors and scripts.
+const botAgents = `(?i)(bot|crawl|spider|slurp|curl|wget|python|monitor)`
+
+const botPattern = "/" + botAgents + "/"
+
+func accessLogGroup(stack string) string {
+	return "/aws-wp/" + stack + "/access"
+}
+
+// analyticsQuery is one report, as a Logs Insights query over the web
+// server's access log and as an Athena query over the load balancer's, and
+// the columns it is shown with. In the Athena queries {table} and {window}
+// stand for the stack's table and the time condition.
+type analyticsQuery struct {
+	title    string
+	insights string
+	athena   string
+	columns  []string
+}
+
+var analyticsQueries = []analyticsQuery{
+	{
+		title:    "Traffic",
+		insights: accessLogParse + " | stats count(*) as requests, count_distinct(client) as visitors",
+		athena:   "SELECT count(*) AS requests, count(DISTINCT client_ip) AS visitors FROM {table} WHERE {window}",
+		columns:  []string{"requests", "visitors"},
+	},
+	{
+		title:    "Top pages",
+		insights: accessLogParse + " | filter status < 400 and agent not like " + botPattern + " and path not like /^\\/wp-(content|includes|json)\\// | stats count(*) as hits by path | sort hits desc | limit 10",
+		athena: "SELECT count(*) AS hits, url_extract_path(request_url) AS path FROM {table} WHERE {window} AND elb_status_code < 400" +
+			" AND NOT regexp_like(user_agent, '" + botAgents + "') AND NOT regexp_like(url_extract_path(request_url), '^/wp-(content|includes|json)/')" +
+			" GROUP BY 2 ORDER BY 1 DESC LIMIT 10",
+		columns: []string{"hits", "path"},
+	},
+	{
+		title:    "Status codes",
+		insights: accessLogParse + " | stats count(*) as hits by status | sort hits desc",
+		athena:   "SELECT count(*) AS hits, elb_status_code AS status FROM {table} WHERE {window} GROUP BY 2 ORDER BY 1 DESC",
+		columns:  []string{"hits", "status"},
+	},
+	{
+		title:    "Bots",
+		insights: accessLogParse + " | filter agent like " + botPattern + " | stats count(*) as hits by agent | sort hits desc | limit 10",
+		athena:   "SELECT count(*) AS hits, user_agent AS agent FROM {table} WHERE {window} AND regexp_like(user_agent, '" + botAgents + "') GROUP BY 2 ORDER BY 1 DESC LIMIT 10",
+		columns:  []string{"hits", "agent"},
+	},
+}
+
+// analytics summarizes the site's traffic: totals, top pages, status codes
+// and the busiest bots. It reads the load balancer's access logs through
+// Athena when the stack has them, or the web server's access log in
+// CloudWatch Logs.
+func analytics(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("analytics", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	days := fs.Int("days", 7, "Number of days to look back")
+	source := fs.String("source", "", "Where to read the traffic from: alb (load balancer access logs) or logs (defaults to alb when the stack has them)")
+	logGroup := fs.String("log-group", "", "Log group with the access log (defaults to /aws-wp/<stack>/access)")
+	fs.Parse(args)
+
+	if *days < 1 {
+		fmt.Println("-days must be at least 1")
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+
+	bucket := ""
+	if state.LoadBalancer != nil {
+		bucket = state.LoadBalancer.AccessLogBucket
+	}
+	switch *source {
+	case "":
+		// Athena writes its results to the bucket, which -read-only
+		// refuses, so the logs are read from CloudWatch Logs instead.
+		*source = "logs"
+		if bucket != "" && !readOnly {
+			*source = "alb"
+		}
+	case "alb":
+		if bucket == "" {
+			fmt.Println("The stack's load balancer has no access logs, create it with -alb-access-logs")
+			return
+		}
+		if readOnly {
+			fmt.Println("-source alb runs Athena queries, which write their results to S3; use -source logs with -read-only")
+			return
+		}
+	case "logs":
+	default:
+		fmt.Printf("Unknown source %q, expected alb or logs\n", *source)
+		os.Exit(2)
+	}
+
+	var query func(q analyticsQuery) ([]map[string]string, error)
+	if *source == "alb" {
+		client := athena.NewFromConfig(env.aws)
+		if err := prepareAlbLogTable(client, state.Name, bucket); err != nil {
+			fmt.Println("Got an error preparing the access log table:")
+			fmt.Println(err)
+			return
+		}
+		window := fmt.Sprintf("from_iso8601_timestamp(time) > current_timestamp - interval '%d' day", *days)
+		replacer := strings.NewReplacer("{table}", albLogTableName(state.Name), "{window}", window)
+		query = func(q analyticsQuery) ([]map[string]string, error) {
+			return runAthenaQuery(client, bucket, replacer.Replace(q.athena))
+		}
+		fmt.Printf("Traffic of stack %s over the last %d days, from the load balancer access logs in %s\n", state.Name, *days, bucket)
+	} else {
+		client := cloudwatchlogs.NewFromConfig(env.aws)
+		if *logGroup == "" {
+			*logGroup = accessLogGroup(state.Name)
+		}
+		end := time.Now()
+		start := end.AddDate(0, 0, -*days)
+		query = func(q analyticsQuery) ([]map[string]string, error) {
+			return runInsightsQuery(client, *logGroup, q.insights, start, end)
+		}
+		fmt.Printf("Traffic of stack %s over the last %d days, from %s\n", state.Name, *days, *logGroup)
+	}
+
+	for _, q := range analyticsQueries {
+		rows, err := query(q)
+		if *source == "logs" && isErrorCode(err, "ResourceNotFoundException") {
+			fmt.Printf("Log group %s does not exist, ship the web server access log there to get analytics\n", *logGroup)
+			return
+		}
+		if err != nil {
+			fmt.Println("Got an error querying the access log:")
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Printf("\n%s\n", q.title)
+		if len(rows) == 0 {
+			fmt.Println("  no requests")
+		}
+		for _, row := range rows {
+			fmt.Print(" ")
+			for _, column := range q.columns {
+				fmt.Printf(" %-8s", row[column])
+			}
+			fmt.Println()
+		}
+	}
+}
+
+// runInsightsQuery runs a Logs Insights query and waits for its rows.
+func runInsightsQuery(client *cloudwatchlogs.Client, logGroup string, query string, start time.Time, end time.Time) ([]map[string]string, error) {
+	started, err := client.StartQuery(context.TODO(), &cloudwatchlogs.StartQueryInput{
+		LogGroupName: aws.String(logGroup),
+		QueryString:  aws.String(query),
+		StartTime:    aws.Int64(start.Unix()),
+		EndTime:      aws.Int64(end.Unix()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		result, err := client.GetQueryResults(context.TODO(), &cloudwatchlogs.GetQueryResultsInput{
+			QueryId: started.QueryId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch result.Status {
+		case types.QueryStatusComplete:
+			rows := make([]map[string]string, 0, len(result.Results))
+			for _, fields := range result.Results {
+				row := map[string]string{}
+				for _, f := range fields {
+					row[aws.ToString(f.Field)] = aws.ToString(f.Value)
+				}
+				rows = append(rows, row)
+			}
+			return rows, nil
+		case types.QueryStatusFailed, types.QueryStatusCancelled, types.QueryStatusTimeout:
+			return nil, fmt.Errorf("query %s", result.Status)
+		}
+		log.Printf("Query still running...")
+		time.Sleep(time.Second)
+	}
+}
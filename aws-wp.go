@@ -2,60 +2,674 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	"github.com/aws/smithy-go"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
 )
 
 func main() {
+	args := os.Args[1:]
+	command := "create"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "create":
+		create(args)
+	case "destroy":
+		destroy(args)
+	case "status":
+		status(args)
+	case "list":
+		list(args)
+	case "replace":
+		replace(args)
+	case "rollback":
+		rollback(args)
+	case "backup":
+		backup(args)
+	case "cost":
+		cost(args)
+	case "recommend":
+		recommend(args)
+	case "analytics":
+		analytics(args)
+	case "sync":
+		syncStacks(args)
+	case "tune":
+		tune(args)
+	case "volume":
+		volume(args)
+	case "loadtest":
+		loadtest(args)
+	case "bake":
+		bake(args)
+	case "sla":
+		sla(args)
+	case "logmetrics":
+		logmetrics(args)
+	case "statuspage":
+		statuspage(args)
+	case "serial-console":
+		serialConsole(args)
+	case "audit":
+		audit(args)
+	case "migrate":
+		migrate(args)
+	case "drill":
+		drill(args)
+	case "schedule":
+		schedule(args)
+	case "gc":
+		gc(args)
+	case "force-unlock":
+		forceUnlock(args)
+	case "self-update":
+		selfUpdate(args)
+	case "version":
+		printVersion(args)
+	case "init-account":
+		initAccount(args)
+	case "presets":
+		listPresets(args)
+	default:
+		fmt.Printf("Unknown command %q, expected create, list, status, replace, rollback, backup, sync, volume, tune, loadtest, bake, sla, statuspage, logmetrics, cost, recommend, analytics, serial-console, init-account, audit, migrate, drill, schedule, gc, force-unlock, self-update, version, destroy or presets\n", command)
+		os.Exit(2)
+	}
+}
+
+func create(args []string) {
 	defer duration(time.Now())
-	imageId := flag.String("ami", "", "The image id for the instance")
-	flag.Parse()
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	imageId := fs.String("ami", "", "The image id for the instance")
+	osName := fs.String("os", "", "Install WordPress on a stock al2023, ubuntu or debian image (the current or baked one unless -ami is given)")
+	stock := fs.Bool("stock", false, "With -os, install on the stock image even when aws-wp bake made one")
+	instanceProfile := fs.String("instance-profile", "", "IAM instance profile for the instance, needed by ssm hooks")
+	presetName := fs.String("preset", "", "Preset with defaults for the flags below, see aws-wp presets")
+	instanceType := fs.String("instance-type", string(types.InstanceTypeT2Micro), "The instance type")
+	volumeSize := fs.Int("volume-size", 0, "Root volume size in GiB (defaults to the image's)")
+	ingress := fs.String("ingress", defaultIngress, "Open ports as port or port=cidr, comma-separated (-port is added to the default)")
+	port := fs.Int("port", defaultPort, "Serve the site on this port, e.g. for a reverse proxy in front of it")
+	sitePath := fs.String("site-path", "", "Serve WordPress under this path, e.g. /blog on a shared domain")
+	sshCidr := fs.String("ssh-cidr", "", "Also allow SSH (port 22) from this CIDR")
+	autoRecovery := fs.Bool("auto-recovery", false, "Recover the instance onto new hardware when the system status check fails")
+	alarmDisk := fs.Int("alarm-disk", 0, "Alarm when the root filesystem is this percent full (needs the CloudWatch agent)")
+	plugins := fs.String("plugins", "", "Comma-separated WordPress plugins to install with wp-cli on first boot")
+	allocateEip := fs.Bool("eip", false, "Give the stack a new Elastic IP, released on destroy")
+	eipAllocationId := fs.String("eip-allocation-id", "", "Use this Elastic IP you own, kept on destroy")
+	subnetId := fs.String("subnet-id", "", "Launch into this subnet instead of a default one")
+	privateIp := fs.String("private-ip", "", "Static private IP of the instance within -subnet-id")
+	var secondaryInterfaces interfacesFlag
+	fs.Var(&secondaryInterfaces, "secondary-eni", "Add a network interface as subnet-id or subnet-id=private-ip (repeatable)")
+	useAlb := fs.Bool("alb", false, "Put an Application Load Balancer in front of the instance")
+	certificateArn := fs.String("certificate-arn", "", "ACM certificate for an HTTPS listener on the load balancer, or auto to request one for -domain")
+	domain := fs.String("domain", "", "Point this name at the stack, e.g. www.example.com")
+	dnsProvider := fs.String("dns", dnsRoute53, "Where the -domain zone is hosted: route53 or cloudflare (token in $CLOUDFLARE_API_TOKEN)")
+	stickiness := fs.Duration("alb-stickiness", 0, "Keep each browser on the same target for this long, e.g. 1h")
+	accessLogs := fs.Bool("alb-access-logs", false, "Write load balancer access logs to a new S3 bucket, see aws-wp analytics")
+	accessLogDays := fs.Int("access-log-days", 30, "Days to keep load balancer access logs")
+	loginRateLimit := fs.Int64("login-rate-limit", 0, "Block client IPs sending more than this many requests to wp-login.php or xmlrpc.php in 5 minutes, with AWS WAF on the load balancer")
+	behindProxy := fs.Bool("behind-proxy", false, "Trust X-Forwarded-Proto/For from a proxy or CDN in front of WordPress (implied by -alb)")
+	userTags := tagsFlag{}
+	fs.Var(userTags, "tag", "Tag the stack's resources with key=value (repeatable), as the config's required_tags may demand")
+	environment := fs.String("environment", environmentProduction, "Stack environment: production, staging or dev, tagged as "+environmentTag)
+	allowIndexing := fs.Bool("allow-indexing", false, "Let search engines index a staging or dev stack")
+	ttl := fs.Duration("ttl", 0, "Let aws-wp gc destroy the stack after this long, e.g. 4h for a demo")
+	readOnlyCode := fs.Bool("read-only-code", false, "Mount WordPress, themes and plugins read-only, leaving only uploads writable; updates need aws-wp-code rw on the instance")
+	basicAuth := fs.String("basic-auth", "", "Put the whole site behind basic authentication as user:password, e.g. for staging")
+	healthPath := fs.String("health-path", "/", "Path the health check requests, e.g. /healthz or /blog/ (defaults to -site-path)")
+	healthMatch := fs.String("health-match", "", "Text the health check page must contain")
+	healthAuth := fs.String("health-auth", "", "user:password for a health check behind basic authentication")
+	bootstrapVersion := fs.String("bootstrap-version", bootstrapCurrent, "Release whose bootstrap scripts the stack is pinned to, current for this one's")
+	showUserData := fs.Bool("show-user-data", false, "Print the instance's bootstrap script, secrets redacted, and exit without creating anything")
+	reportProgress := fs.Bool("report-progress", false, "Have the instance report bootstrap progress through SSM (needs -instance-profile)")
+	fs.Parse(args)
+
+	// Taken before the preset sets its flags, which only stand in for
+	// defaults: -port still opens its port past a preset's -ingress.
+	flagsSet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+
+	if *presetName != "" {
+		if err := applyPreset(fs, *presetName); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if *imageId == "" && *osName == "" {
+		fmt.Println("You must supply an AMI or -os")
+		return
+	}
+	if err := validateDistro(*osName); err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	if *imageId == "" {
-		fmt.Println("You must supply an AMI")
+	if (*privateIp != "" || len(secondaryInterfaces) > 0) && *subnetId == "" {
+		fmt.Println("-private-ip and -secondary-eni need -subnet-id")
+		return
+	}
+	if len(secondaryInterfaces) > 0 && !*allocateEip && *eipAllocationId == "" {
+		fmt.Println("Instances with several network interfaces get no public IP, add -eip or -eip-allocation-id")
 		return
 	}
 
-	client := createClient()
+	if *alarmDisk < 0 || *alarmDisk > 100 {
+		fmt.Println("-alarm-disk is a percentage between 1 and 100")
+		return
+	}
 
-	instanceId := createInstance(client, *imageId)
+	if *reportProgress && *instanceProfile == "" {
+		fmt.Println("-report-progress needs -instance-profile with permission to write the progress parameter")
+		return
+	}
+	if (*certificateArn != "" || *stickiness != 0 || *accessLogs || *loginRateLimit != 0) && !*useAlb {
+		fmt.Println("-certificate-arn, -alb-stickiness, -alb-access-logs and -login-rate-limit need -alb")
+		return
+	}
+	if *stickiness != 0 && (*stickiness < minStickiness || *stickiness > maxStickiness) {
+		fmt.Printf("-alb-stickiness must be between %s and %s, the range the load balancer allows\n", minStickiness, maxStickiness)
+		return
+	}
+	if *loginRateLimit != 0 && *loginRateLimit < minLoginRateLimit {
+		fmt.Printf("-login-rate-limit must be at least %d, the lowest AWS WAF allows\n", minLoginRateLimit)
+		return
+	}
+	if err := validateEnvironment(*environment); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateDNSProvider(*dnsProvider); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *certificateArn == certificateAuto && *domain == "" {
+		fmt.Println("-certificate-arn auto needs -domain")
+		return
+	}
+	if !strings.HasPrefix(*healthPath, "/") {
+		fmt.Println("-health-path must start with /")
+		return
+	}
+	if *healthAuth != "" {
+		if parts := strings.SplitN(*healthAuth, ":", 2); len(parts) != 2 || parts[0] == "" {
+			fmt.Println("-health-auth must be user:password")
+			return
+		}
+	}
+	var htpasswd string
+	if *basicAuth != "" {
+		user, password, err := parseBasicAuth(*basicAuth)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if htpasswd, err = htpasswdLine(user, password); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if *accessLogDays < 1 {
+		fmt.Println("-access-log-days must be at least 1")
+		return
+	}
+	if *useAlb && (*allocateEip || *eipAllocationId != "") {
+		fmt.Println("A stack behind a load balancer is reached through it, drop -eip")
+		return
+	}
 
-	publicDnsName := waitRunning(client, instanceId)
+	if *port < 1 || *port > 65535 {
+		fmt.Println("-port must be between 1 and 65535")
+		return
+	}
+	if err := validateSitePath(*sitePath); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Behind a load balancer port 80 stays open for its listener.
+	if *port != defaultPort && !flagsSet["ingress"] {
+		*ingress += "," + strconv.Itoa(*port)
+	}
+	if *sitePath != "" && !flagsSet["health-path"] {
+		*healthPath = *sitePath + "/"
+	}
 
-	if publicDnsName != "" {
-		openBrowser(publicDnsName)
+	if *sshCidr != "" {
+		*ingress += ",22=" + *sshCidr
+	}
+	ingressRules, err := parseIngress(*ingress)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
-}
 
-func createClient() *ec2.Client {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	env, err := options.load()
 	if err != nil {
-		panic("Configuration error, " + err.Error())
+		fmt.Println(err)
+		return
+	}
+
+	if err := validatePlugins(splitList(*plugins)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := checkRequiredTags(env.config, userTags); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "create")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	if _, err := loadState(env.name); err == nil {
+		fmt.Printf("Stack %s already exists, destroy it first\n", env.name)
+		return
+	}
+	maskSecret(*healthAuth)
+	maskSecret(*basicAuth)
+
+	state := &stackState{
+		Name:   env.name,
+		Region: env.aws.Region,
+		launchSpec: launchSpec{
+			ImageId:         *imageId,
+			OS:              *osName,
+			InstanceType:    *instanceType,
+			InstanceProfile: *instanceProfile,
+			VolumeSize:      int32(*volumeSize),
+			Plugins:         splitList(*plugins),
+			AutoRecovery:    *autoRecovery,
+			AlarmDisk:       *alarmDisk,
+
+			SubnetId:            *subnetId,
+			PrivateIp:           *privateIp,
+			SecondaryInterfaces: secondaryInterfaces,
+
+			BehindProxy:    *behindProxy || *useAlb,
+			ReportProgress: *reportProgress,
+
+			HealthCheck: healthCheck{Path: *healthPath, Match: *healthMatch},
+			Htpasswd:    htpasswd,
+
+			Tags:         userTags,
+			ReadOnlyCode: *readOnlyCode,
+
+			SitePath: *sitePath,
+
+			Environment:   *environment,
+			AllowIndexing: *allowIndexing,
+
+			WPConfig: env.config.WPConfig,
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	if *port != defaultPort {
+		state.Port = int32(*port)
+	}
+	if *domain != "" {
+		state.Domain = strings.TrimSuffix(*domain, ".")
+		state.DNSProvider = *dnsProvider
+	}
+	if *ttl > 0 {
+		expiresAt := state.CreatedAt.Add(*ttl).Truncate(time.Second)
+		state.ExpiresAt = &expiresAt
+	}
+
+	if state.BootstrapVersion, err = resolveBootstrapVersion(*bootstrapVersion); err == nil {
+		err = useBootstrap(env, state.BootstrapVersion)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if state.ImageId == "" {
+		client := ec2.NewFromConfig(env.aws)
+		if !*stock {
+			state.ImageId = bakedImageFor(client, state.Region, *osName, *instanceType, state.BootstrapVersion)
+			state.Baked = state.ImageId != ""
+		}
+		if state.ImageId == "" {
+			if state.ImageId = stockImage(client, ssm.NewFromConfig(env.aws), *osName, *instanceType); state.ImageId == "" {
+				return
+			}
+		}
+	}
+
+	if *showUserData {
+		// A load balancer's URL is only known once it exists, so the
+		// script shown lacks it.
+		params := state.userDataParams(env.name)
+		script, err := renderUserData(params)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		encoded, err := encodeUserData(script)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Print(redactUserData(script, params))
+		fmt.Fprintf(os.Stderr, "%d bytes, %d base64-encoded for EC2\n", len(script), len(encoded))
+		return
+	}
+
+	if err := runHooks(env.aws, env.config.Hooks, hookBeforeLaunch, state.vars()); err != nil {
+		fmt.Println("Got an error running hooks:")
+		fmt.Println(err)
+		return
+	}
+
+	client := ec2.NewFromConfig(env.aws)
+
+	var reusedEip *elasticIp
+	if *eipAllocationId != "" {
+		if reusedEip = existingElasticIp(client, *eipAllocationId); reusedEip == nil {
+			return
+		}
+	}
+
+	if *subnetId != "" {
+		if state.VpcId = subnetVpcId(client, *subnetId); state.VpcId == "" {
+			return
+		}
+	}
+
+	state.SecurityGroupId = getSecurityGroup(client, env.name, state.VpcId, ingressRules)
+	if state.SecurityGroupId == "" {
+		return
+	}
+
+	// The health check logs in with the stored credential, which the load
+	// balancer's health check codes depend on.
+	if *basicAuth != "" {
+		user, password, _ := parseBasicAuth(*basicAuth)
+		if state.BasicAuthSecret = storeBasicAuth(secretsmanager.NewFromConfig(env.aws), env.name, user, password); state.BasicAuthSecret == "" {
+			return
+		}
+		if *healthAuth == "" {
+			state.HealthCheck.AuthSecret = state.BasicAuthSecret
+		}
+		saveStackState(state)
+	}
+	if *healthAuth != "" {
+		parts := strings.SplitN(*healthAuth, ":", 2)
+		if state.HealthCheck.AuthSecret = storeHealthAuth(secretsmanager.NewFromConfig(env.aws), env.name, parts[0], parts[1]); state.HealthCheck.AuthSecret == "" {
+			return
+		}
+		saveStackState(state)
+	}
+
+	if *useAlb {
+		if *certificateArn == certificateAuto {
+			if *certificateArn = requestCertificate(env, state); *certificateArn == "" {
+				return
+			}
+		}
+		elbClient := elb.NewFromConfig(env.aws)
+		lb, vpcId, ok := createLoadBalancer(client, elbClient, env.name, state.VpcId, state.SecurityGroupId, albOptions{
+			certificateArn: *certificateArn,
+			stickiness:     *stickiness,
+			healthCheck:    state.HealthCheck,
+			port:           state.port(),
+		})
+		state.LoadBalancer = lb
+		if lb != nil {
+			state.VpcId = vpcId
+			state.SiteURL = state.siteURL(lb.url())
+			if state.Domain != "" {
+				state.SiteURL = strings.Replace(state.SiteURL, lb.DNSName, state.Domain, 1)
+			}
+			saveStackState(state)
+		}
+		if !ok {
+			return
+		}
+		if *accessLogs && !enableAccessLogs(s3.NewFromConfig(env.aws), elbClient, state, int32(*accessLogDays)) {
+			return
+		}
+		if *loginRateLimit > 0 && !enableLoginRateLimit(wafv2.NewFromConfig(env.aws), state, *loginRateLimit) {
+			return
+		}
+	}
+
+	// Recorded first so destroy finds the instance even if this run is
+	// interrupted before its id is known.
+	state.LaunchToken = launchToken(env.name, newOperationId())
+	saveStackState(state)
+	state.InstanceId = createInstance(client, env.name, state.SecurityGroupId, state.launchSpec, state.LaunchToken)
+	if state.InstanceId == "" {
+		return
+	}
+	state.LaunchToken = ""
+	saveStackState(state)
+
+	publicDnsName, ok := waitRunning(client, state.InstanceId)
+	if !ok {
+		return
+	}
+	state.PublicDnsName = publicDnsName
+	state.URL = state.instanceURL(publicDnsName)
+
+	switch {
+	case reusedEip != nil:
+		state.ElasticIp = reusedEip
+	case *allocateEip:
+		state.ElasticIp = allocateElasticIp(client, env.name)
+	}
+	if state.ElasticIp != nil {
+		// Record the address before associating it so destroy knows about it
+		// whatever happens next.
+		saveStackState(state)
+		if !attachElasticIp(client, state, state.InstanceId) {
+			saveStackState(state)
+			return
+		}
+	}
+
+	if state.PublicDnsName == "" {
+		fmt.Println("The instance has no public address, give the stack one with -eip")
+		saveStackState(state)
+		return
+	}
+
+	if state.AutoRecovery {
+		state.RecoveryAlarm = createRecoveryAlarm(cloudwatch.NewFromConfig(env.aws), env.aws.Region, env.name, state.InstanceId)
+	}
+	saveStackState(state)
+
+	if state.ReportProgress && !waitBootstrapped(ssm.NewFromConfig(env.aws), env.name, state.InstanceId) {
+		return
+	}
+
+	if lb := state.LoadBalancer; lb != nil {
+		state.URL = state.siteURL(lb.url())
+		saveStackState(state)
+		if !registerTarget(elb.NewFromConfig(env.aws), lb.TargetGroupArn, state.InstanceId) {
+			emit(eventHealthFailed, "url", state.URL)
+			return
+		}
+		// The load balancer only checks the status code, the page content
+		// is checked on the instance itself.
+		if state.HealthCheck.Match != "" && state.PublicDnsName != "" && !waitHealthy(env.http, state.instanceURL(state.PublicDnsName), healthCheckAuth(env, state.HealthCheck)) {
+			emit(eventHealthFailed, "url", state.URL)
+			return
+		}
+	} else if !waitHealthy(env.http, state.URL, healthCheckAuth(env, state.HealthCheck)) {
+		emit(eventHealthFailed, "url", state.URL)
+		return
+	}
+	emit(eventHealthOK, "url", state.URL)
+
+	if !updateSiteRecord(env, state) {
+		return
+	}
+
+	// The agent only reports once the instance is up.
+	if state.AlarmDisk > 0 {
+		state.DiskAlarm = createDiskAlarm(cloudwatch.NewFromConfig(env.aws), env.name, state.InstanceId, state.AlarmDisk, notifyTopics(env))
+		saveStackState(state)
+	}
+
+	if !tagStackResources(env, state) {
+		return
+	}
+
+	if err := runHooks(env.aws, env.config.Hooks, hookAfterReady, state.vars()); err != nil {
+		fmt.Println("Got an error running hooks:")
+		fmt.Println(err)
+		return
+	}
+
+	writeOutputs(state)
+	if events == nil && !ciMode {
+		openBrowser(state.URL)
 	}
-	return ec2.NewFromConfig(cfg)
 }
 
-func createInstance(client *ec2.Client, imageId string) string {
+func saveStackState(state *stackState) {
+	if err := state.save(); err != nil {
+		fmt.Println("Got an error saving the stack state:")
+		fmt.Println(err)
+	}
+}
+
+// launchSpec describes the stack's instance. It is kept in the stack state so
+// replace can launch an equivalent one.
+type launchSpec struct {
+	ImageId         string   `json:"image_id"`
+	OS              string   `json:"os,omitempty"`
+	InstanceType    string   `json:"instance_type"`
+	InstanceProfile string   `json:"instance_profile,omitempty"`
+	VolumeSize      int32    `json:"volume_size,omitempty"`
+	Plugins         []string `json:"plugins,omitempty"`
+	AutoRecovery    bool     `json:"auto_recovery,omitempty"`
+
+	// AlarmDisk is the root filesystem usage in percent to alarm at, 0 for
+	// no alarm. It needs the CloudWatch agent on the instance.
+	AlarmDisk int `json:"alarm_disk,omitempty"`
+
+	SubnetId            string             `json:"subnet_id,omitempty"`
+	PrivateIp           string             `json:"private_ip,omitempty"`
+	SecondaryInterfaces []networkInterface `json:"secondary_interfaces,omitempty"`
+
+	BehindProxy    bool   `json:"behind_proxy,omitempty"`
+	SiteURL        string `json:"site_url,omitempty"`
+	ReportProgress bool   `json:"report_progress,omitempty"`
+
+	HealthCheck healthCheck `json:"health_check"`
+
+	// Htpasswd is the bcrypt htpasswd line of -basic-auth.
+	Htpasswd string `json:"htpasswd,omitempty"`
+
+	Environment   string `json:"environment,omitempty"`
+	AllowIndexing bool   `json:"allow_indexing,omitempty"`
+
+	// ExpiresAt is when aws-wp gc may destroy the stack, set by -ttl.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// BootstrapVersion is the release whose bootstrap scripts instances
+	// get, empty for those built into the running tool.
+	BootstrapVersion string `json:"bootstrap_version,omitempty"`
+
+	// Tags are the -tag tags, put on every resource of the stack.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// ReadOnlyCode is set by -read-only-code.
+	ReadOnlyCode bool `json:"read_only_code,omitempty"`
+
+	// Port and SitePath are where the instance serves the site, port 80
+	// and the root when empty.
+	Port     int32  `json:"port,omitempty"`
+	SitePath string `json:"site_path,omitempty"`
+
+	// Baked is set when ImageId is an image of OS from aws-wp bake.
+	Baked bool `json:"baked,omitempty"`
 
-	securityGroupId := getSecurityGroup(client)
+	// PHP holds the settings of aws-wp tune.
+	PHP *phpSettings `json:"php,omitempty"`
+
+	// WPConfig holds the wp_config constants of the config file.
+	WPConfig map[string]wpConstant `json:"wp_config,omitempty"`
+}
+
+func createInstance(client *ec2.Client, stack string, securityGroupId string, spec launchSpec, clientToken string) string {
+	userData, err := renderUserData(spec.userDataParams(stack))
+	if err == nil {
+		userData, err = encodeUserData(userData)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return ""
+	}
 
 	instancesInput := &ec2.RunInstancesInput{
-		ImageId:          aws.String(imageId),
-		InstanceType:     types.InstanceTypeT2Micro,
+		ImageId:          aws.String(spec.ImageId),
+		InstanceType:     types.InstanceType(spec.InstanceType),
 		MinCount:         aws.Int32(1),
 		MaxCount:         aws.Int32(1),
 		SecurityGroupIds: []string{securityGroupId},
+		ClientToken:      aws.String(clientToken),
+	}
+
+	if interfaces := spec.networkInterfaceSpecs(securityGroupId); interfaces != nil {
+		instancesInput.NetworkInterfaces = interfaces
+		instancesInput.SecurityGroupIds = nil
+		instancesInput.TagSpecifications = []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeNetworkInterface,
+				Tags:         []types.Tag{stackTagFor(stack)},
+			},
+		}
+	}
+
+	if userData != "" {
+		instancesInput.UserData = aws.String(userData)
+	}
+
+	if spec.VolumeSize > 0 {
+		deviceName := rootDeviceName(client, spec.ImageId)
+		if deviceName == "" {
+			return ""
+		}
+		instancesInput.BlockDeviceMappings = []types.BlockDeviceMapping{
+			{
+				DeviceName: aws.String(deviceName),
+				Ebs: &types.EbsBlockDevice{
+					VolumeSize:          aws.Int32(spec.VolumeSize),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			},
+		}
+	}
+
+	if spec.InstanceProfile != "" {
+		instancesInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{
+			Name: aws.String(spec.InstanceProfile),
+		}
 	}
 
 	result, err := client.RunInstances(context.TODO(), instancesInput)
@@ -67,38 +681,75 @@ func createInstance(client *ec2.Client, imageId string) string {
 	}
 
 	instanceId := *result.Instances[0].InstanceId
+	emit(eventInstanceLaunched, "instance_id", instanceId, "image_id", spec.ImageId)
 
-	setTagName(client, instanceId)
+	setTagName(client, instanceId, stack, spec.instanceTags()...)
 
 	return instanceId
 }
 
-func getSecurityGroup(client *ec2.Client) string {
-	var groupName string = "wordpress-sg"
+func rootDeviceName(client *ec2.Client, imageId string) string {
+	result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{
+		ImageIds: []string{imageId},
+	})
+	if err != nil || len(result.Images) == 0 {
+		fmt.Println("Got an error retrieving information about the image:")
+		fmt.Println(imageId, err)
+		return ""
+	}
+	return aws.ToString(result.Images[0].RootDeviceName)
+}
+
+// getSecurityGroup returns the stack's security group in vpcId (the default
+// VPC when empty), creating it when needed, and reconciles its ingress with
+// rules.
+func getSecurityGroup(client *ec2.Client, stack string, vpcId string, rules []ingressRule) string {
+	var groupName string = stack + "-sg"
 	describeSecurityGroupsInput := &ec2.DescribeSecurityGroupsInput{
 		GroupNames: []string{groupName},
 	}
+	if vpcId != "" {
+		// Group names only resolve in the default VPC.
+		describeSecurityGroupsInput = &ec2.DescribeSecurityGroupsInput{
+			Filters: []types.Filter{
+				{Name: aws.String("group-name"), Values: []string{groupName}},
+				{Name: aws.String("vpc-id"), Values: []string{vpcId}},
+			},
+		}
+	}
 	describeSecurityGroup, err := client.DescribeSecurityGroups(context.TODO(), describeSecurityGroupsInput)
 
 	if err == nil && len(describeSecurityGroup.SecurityGroups) > 0 {
-		return *describeSecurityGroup.SecurityGroups[0].GroupId
+		group := describeSecurityGroup.SecurityGroups[0]
+		emit(eventSecurityGroupFound, "group_id", *group.GroupId, "group_name", groupName)
+		if isLegacyGroup(group) && !adoptSecurityGroup(client, group, stack) {
+			return ""
+		}
+		if !reconcileIngress(client, group, rules) {
+			return ""
+		}
+		return *group.GroupId
 	}
 
-	if err != nil {
-		var ae smithy.APIError
-		if errors.As(err, &ae) {
-			if ae.ErrorCode() != "InvalidGroup.NotFound" {
-				fmt.Println("Got an error retrieving information about security griop:")
-				fmt.Println(groupName)
-				fmt.Println(err)
-				return ""
-			}
-		}
+	if err != nil && !isErrorCode(err, "InvalidGroup.NotFound") {
+		fmt.Println("Got an error retrieving information about security group:")
+		fmt.Println(groupName)
+		fmt.Println(err)
+		return ""
 	}
 
 	sgInput := &ec2.CreateSecurityGroupInput{
 		GroupName:   aws.String(groupName),
 		Description: aws.String("Security group for wordpress"),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSecurityGroup,
+				Tags:         []types.Tag{stackTagFor(stack)},
+			},
+		},
+	}
+	if vpcId != "" {
+		sgInput.VpcId = aws.String(vpcId)
 	}
 
 	securityGroup, err := client.CreateSecurityGroup(context.TODO(), sgInput)
@@ -109,43 +760,26 @@ func getSecurityGroup(client *ec2.Client) string {
 		return ""
 	}
 
-	permissions := []types.IpPermission{
-		types.IpPermission{
-			FromPort:   aws.Int32(80),
-			ToPort:     aws.Int32(80),
-			IpProtocol: aws.String("tcp"),
-			IpRanges: []types.IpRange{
-				types.IpRange{
-					CidrIp: aws.String("0.0.0.0/0"),
-				},
-			},
-			Ipv6Ranges: []types.Ipv6Range{
-				types.Ipv6Range{
-					CidrIpv6: aws.String("::/0"),
-				},
-			},
-		},
-	}
+	emit(eventSecurityGroupCreated, "group_id", *securityGroup.GroupId, "group_name", groupName)
 
-	sgIngressInput := &ec2.AuthorizeSecurityGroupIngressInput{
-		GroupId:       securityGroup.GroupId,
-		IpPermissions: permissions,
+	group := types.SecurityGroup{GroupId: securityGroup.GroupId}
+	if !reconcileIngress(client, group, rules) {
+		return ""
 	}
 
-	client.AuthorizeSecurityGroupIngress(context.TODO(), sgIngressInput)
-
 	return *securityGroup.GroupId
 }
 
-func setTagName(client *ec2.Client, instanceId string) {
+func setTagName(client *ec2.Client, instanceId string, stack string, extra ...types.Tag) {
 	tagInput := &ec2.CreateTagsInput{
 		Resources: []string{instanceId},
-		Tags: []types.Tag{
+		Tags: append([]types.Tag{
 			{
 				Key:   aws.String("Name"),
 				Value: aws.String("WordPress"),
 			},
-		},
+			stackTagFor(stack),
+		}, extra...),
 	}
 
 	_, err := client.CreateTags(context.TODO(), tagInput)
@@ -156,7 +790,9 @@ func setTagName(client *ec2.Client, instanceId string) {
 	}
 }
 
-func waitRunning(client *ec2.Client, instanceId string) string {
+// waitRunning waits for the instance to run and returns its public DNS name,
+// which is empty when the instance has no public address of its own.
+func waitRunning(client *ec2.Client, instanceId string) (string, bool) {
 	input := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceId},
 	}
@@ -167,20 +803,21 @@ func waitRunning(client *ec2.Client, instanceId string) string {
 		if err != nil {
 			fmt.Println("Got an error retrieving information about your Amazon EC2 instances:")
 			fmt.Println(err)
-			return ""
+			return "", false
 		}
 
 		for _, r := range result.Reservations {
 			for _, i := range r.Instances {
 				// running
 				if *i.State.Code == 16 {
-					time.Sleep(7 * time.Second)
-					return "http://" + *i.PublicDnsName
+					publicDnsName := aws.ToString(i.PublicDnsName)
+					emit(eventInstanceRunning, "instance_id", instanceId, "public_dns_name", publicDnsName)
+					return publicDnsName, true
 				}
 				// not pending
 				if *i.State.Code != 0 {
 					fmt.Println("Got an error creating an instance")
-					return ""
+					return "", false
 				}
 				log.Printf("Still pending...")
 			}
@@ -212,3 +849,21 @@ func openBrowser(url string) {
 func duration(start time.Time) {
 	log.Printf("Start-up time: %v\n", time.Since(start))
 }
+
+func stackTagFor(stack string) types.Tag {
+	return types.Tag{
+		Key:   aws.String(stackTag),
+		Value: aws.String(stack),
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
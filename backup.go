@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// pruneInterval spaces out the deregister and delete calls so pruning a long
+// backlog of images does not run into the EC2 API request limits.
+const pruneInterval = 500 * time.Millisecond
+
+// backup manages the stack's images: "backup create" images the instance
+// like replace does, "backup prune" removes all but the newest ones.
+func backup(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp backup create|prune [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "create":
+		createBackup(args[1:])
+	case "prune":
+		pruneBackups(args[1:])
+	default:
+		fmt.Printf("Unknown backup command %q, expected create or prune\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func createBackup(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("backup create", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	noReboot := fs.Bool("no-reboot", false, "Image the instance without rebooting it first")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "backup create")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	imageId := createStackImage(client, state, !*noReboot)
+	if imageId == "" {
+		return
+	}
+	fmt.Println("Backup image: " + imageId)
+}
+
+// pruneBackups deregisters the stack's images beyond the newest -keep and
+// then deletes their snapshots. A snapshot cannot be deleted while an image
+// still refers to it, so each image goes first. The image the instance runs
+// from is never pruned.
+func pruneBackups(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("backup prune", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	keep := fs.Int("keep", 7, "Number of newest images to keep")
+	dryRun := fs.Bool("dry-run", false, "Only list the images that would be removed")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	if *keep < 0 {
+		fmt.Println("-keep cannot be negative")
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "backup prune")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	images, err := stackImages(client, state.Name)
+	if err != nil {
+		fmt.Println("Got an error retrieving the stack's images:")
+		fmt.Println(err)
+		return
+	}
+
+	var prune []types.Image
+	kept := 0
+	for _, image := range images {
+		if aws.ToString(image.ImageId) == state.ImageId {
+			continue
+		}
+		if kept < *keep {
+			kept++
+			continue
+		}
+		prune = append(prune, image)
+	}
+
+	if len(prune) == 0 {
+		fmt.Printf("Nothing to prune, stack %s has %d image(s)\n", state.Name, len(images))
+		return
+	}
+	for _, image := range prune {
+		fmt.Printf("%s  %s  %s\n", aws.ToString(image.ImageId), aws.ToString(image.CreationDate), aws.ToString(image.Name))
+	}
+	if *dryRun {
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Deregister these %d image(s) and delete their snapshots?", len(prune))) {
+		return
+	}
+
+	for _, image := range prune {
+		if !deregisterImage(client, image) {
+			return
+		}
+	}
+}
+
+// stackImages returns the stack's own images, newest first.
+func stackImages(client *ec2.Client, stack string) ([]types.Image, error) {
+	result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:" + stackTag),
+				Values: []string{stack},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	images := result.Images
+	sort.Slice(images, func(i, j int) bool {
+		// CreationDate is ISO 8601, so it sorts as a string.
+		return aws.ToString(images[i].CreationDate) > aws.ToString(images[j].CreationDate)
+	})
+	return images, nil
+}
+
+func deregisterImage(client *ec2.Client, image types.Image) bool {
+	imageId := aws.ToString(image.ImageId)
+	_, err := client.DeregisterImage(context.TODO(), &ec2.DeregisterImageInput{
+		ImageId: image.ImageId,
+	})
+	if err != nil && !isErrorCode(err, "InvalidAMIID.NotFound") {
+		fmt.Println("Got an error deregistering the image:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventImageDeregistered, "image_id", imageId)
+	time.Sleep(pruneInterval)
+
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+			continue
+		}
+		if !deleteSnapshot(client, aws.ToString(mapping.Ebs.SnapshotId)) {
+			return false
+		}
+		time.Sleep(pruneInterval)
+	}
+	return true
+}
+
+// deleteSnapshot retries while the snapshot is still reported in use, which
+// it can be for a short while after its image was deregistered.
+func deleteSnapshot(client *ec2.Client, snapshotId string) bool {
+	for i := 0; ; i++ {
+		_, err := client.DeleteSnapshot(context.TODO(), &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotId),
+		})
+		if err == nil || isErrorCode(err, "InvalidSnapshot.NotFound") {
+			emit(eventSnapshotDeleted, "snapshot_id", snapshotId)
+			return true
+		}
+		if isErrorCode(err, "InvalidSnapshot.InUse") && i < 10 {
+			log.Printf("Snapshot %s still in use, retrying...", snapshotId)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		fmt.Println("Got an error deleting the snapshot:")
+		fmt.Println(err)
+		return false
+	}
+}
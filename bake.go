@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// bakedTag marks images made by aws-wp bake with their distro.
+const bakedTag = "aws-wp:baked"
+
+// bakedImage is a golden image of a distro with the web server, PHP, the
+// database and the WordPress files installed. create -os launches the
+// newest one for its region and architecture instead of the stock image,
+// leaving only the site's own setup for first boot.
+type bakedImage struct {
+	ImageId          string    `json:"image_id"`
+	Region           string    `json:"region"`
+	OS               string    `json:"os"`
+	Architecture     string    `json:"architecture"`
+	SourceImage      string    `json:"source_image"`
+	BootstrapVersion string    `json:"bootstrap_version,omitempty"`
+	BakedAt          time.Time `json:"baked_at"`
+}
+
+func bakedImagesPath() string {
+	return filepath.Join(homeDir(), "images.json")
+}
+
+func loadBakedImages() ([]bakedImage, error) {
+	data, err := ioutil.ReadFile(bakedImagesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []bakedImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", bakedImagesPath(), err)
+	}
+	return images, nil
+}
+
+func saveBakedImages(images []bakedImage) error {
+	if readOnly {
+		return fmt.Errorf("read-only mode: %s is not written", bakedImagesPath())
+	}
+	if err := os.MkdirAll(homeDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bakedImagesPath(), data, 0600)
+}
+
+// bakeParams are the values bootstrap/bake.sh is rendered with.
+type bakeParams struct {
+	OS      string
+	Install string
+}
+
+// bake launches a temporary instance of the distro's stock image, installs
+// everything that is the same for every site, and images it once the
+// instance powers itself off. The image replaces the previous one for the
+// region, distro and architecture, which is deregistered unless a stack
+// still runs on it.
+func bake(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("bake", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	osName := fs.String("os", "", "Distro to bake: al2023, ubuntu or debian")
+	instanceType := fs.String("instance-type", string(types.InstanceTypeT2Micro), "Instance type to bake on, which sets the image's architecture")
+	subnetId := fs.String("subnet-id", "", "Bake in this subnet instead of a default one, it needs internet access")
+	timeout := fs.Duration("timeout", 30*time.Minute, "Give up when the install has not finished after this long")
+	fs.Parse(args)
+
+	if *osName == "" {
+		fmt.Println("You must supply -os")
+		return
+	}
+	if err := validateDistro(*osName); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if bootstrapTemplates.Lookup("download-wordpress.sh") == nil {
+		fmt.Println("The bootstrap scripts in use cannot be baked, they lack download-wordpress.sh")
+		return
+	}
+
+	client := ec2.NewFromConfig(env.aws)
+	sourceImage := stockImage(client, ssm.NewFromConfig(env.aws), *osName, *instanceType)
+	if sourceImage == "" {
+		return
+	}
+
+	install, err := renderSteps(installSteps(*osName), userDataParams{OS: *osName})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var script strings.Builder
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "bake.sh", bakeParams{OS: *osName, Install: install}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	userData, err := encodeUserData(script.String())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(sourceImage),
+		InstanceType: types.InstanceType(*instanceType),
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		UserData:     aws.String(userData),
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String("aws-wp-bake-" + *osName)},
+				{Key: aws.String(bakedTag), Value: aws.String(*osName)},
+			},
+		}},
+	}
+	if *subnetId != "" {
+		input.SubnetId = aws.String(*subnetId)
+	}
+	result, err := client.RunInstances(context.TODO(), input)
+	if err != nil {
+		fmt.Println("Got an error launching the instance to bake on:")
+		fmt.Println(err)
+		return
+	}
+	instanceId := aws.ToString(result.Instances[0].InstanceId)
+	architecture := string(result.Instances[0].Architecture)
+	defer terminateInstance(client, instanceId)
+	log.Printf("Installing on %s, which powers off when done", instanceId)
+
+	if !waitBaked(client, instanceId, *timeout) {
+		return
+	}
+
+	name := fmt.Sprintf("aws-wp-%s-%s", *osName, time.Now().UTC().Format("20060102-150405"))
+	image, err := client.CreateImage(context.TODO(), &ec2.CreateImageInput{
+		InstanceId:  aws.String(instanceId),
+		Name:        aws.String(name),
+		Description: aws.String("WordPress packages and files on " + sourceImage + ", baked by aws-wp"),
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeImage,
+			Tags:         []types.Tag{{Key: aws.String(bakedTag), Value: aws.String(*osName)}},
+		}},
+	})
+	if err != nil {
+		fmt.Println("Got an error creating an image:")
+		fmt.Println(err)
+		return
+	}
+	imageId := aws.ToString(image.ImageId)
+	if !waitImageAvailable(client, imageId) {
+		return
+	}
+
+	baked := bakedImage{
+		ImageId:          imageId,
+		Region:           env.aws.Region,
+		OS:               *osName,
+		Architecture:     architecture,
+		SourceImage:      sourceImage,
+		BootstrapVersion: version,
+		BakedAt:          time.Now().UTC(),
+	}
+	if !recordBakedImage(client, baked) {
+		return
+	}
+	emit(eventImageBaked, "image_id", imageId, "os", *osName, "source_image", sourceImage)
+	fmt.Printf("Baked %s, create -os %s now launches it in %s\n", imageId, *osName, baked.Region)
+}
+
+// waitBaked waits for the instance to power itself off, which bake.sh does
+// once the install succeeded.
+func waitBaked(client *ec2.Client, instanceId string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		instance := describeInstance(client, instanceId)
+		if instance == nil {
+			return false
+		}
+		switch instance.State.Name {
+		case types.InstanceStateNameStopped:
+			return true
+		case types.InstanceStateNameTerminated, types.InstanceStateNameShuttingDown:
+			fmt.Printf("Instance %s was terminated before the install finished\n", instanceId)
+			return false
+		}
+		log.Printf("Still installing...")
+		time.Sleep(15 * time.Second)
+	}
+
+	fmt.Printf("The install on %s did not finish within %s\n", instanceId, timeout)
+	output, err := client.GetConsoleOutput(context.TODO(), &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instanceId),
+		Latest:     aws.Bool(true),
+	})
+	if err == nil && output.Output != nil {
+		if text, err := base64.StdEncoding.DecodeString(*output.Output); err == nil {
+			fmt.Println(string(text))
+		}
+	}
+	return false
+}
+
+func waitImageAvailable(client *ec2.Client, imageId string) bool {
+	for {
+		result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{
+			ImageIds: []string{imageId},
+		})
+		if err != nil && !isErrorCode(err, "InvalidAMIID.NotFound") {
+			fmt.Println("Got an error retrieving information about the image:")
+			fmt.Println(err)
+			return false
+		}
+
+		if err == nil && len(result.Images) > 0 {
+			switch result.Images[0].State {
+			case types.ImageStateAvailable:
+				return true
+			case types.ImageStateFailed, types.ImageStateError, types.ImageStateInvalid:
+				fmt.Printf("Got an error creating an image: %s is %s\n", imageId, result.Images[0].State)
+				return false
+			}
+		}
+		log.Printf("Image still pending...")
+		time.Sleep(15 * time.Second)
+	}
+}
+
+// recordBakedImage makes the image the one create uses and deregisters the
+// one it replaces, unless a stack was launched from it.
+func recordBakedImage(client *ec2.Client, baked bakedImage) bool {
+	images, err := loadBakedImages()
+	if err != nil {
+		fmt.Println("Got an error reading the baked images:")
+		fmt.Println(err)
+		return false
+	}
+
+	var previous string
+	kept := images[:0]
+	for _, image := range images {
+		if image.Region == baked.Region && image.OS == baked.OS && image.Architecture == baked.Architecture {
+			previous = image.ImageId
+			continue
+		}
+		kept = append(kept, image)
+	}
+	if err := saveBakedImages(append(kept, baked)); err != nil {
+		fmt.Println("Got an error recording the baked image:")
+		fmt.Println(err)
+		return false
+	}
+
+	if previous == "" {
+		return true
+	}
+	states, err := listStates()
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	for _, state := range states {
+		if state.ImageId == previous {
+			log.Printf("Keeping %s, stack %s was launched from it", previous, state.Name)
+			return true
+		}
+	}
+	result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{ImageIds: []string{previous}})
+	if err == nil && len(result.Images) > 0 {
+		deregisterImage(client, result.Images[0])
+	}
+	return true
+}
+
+// bakedImageFor returns the baked image of the distro for the instance
+// type, or "" when there is none or it is gone. The image must have been
+// baked with the bootstrap scripts the stack is pinned to; unpinned stacks
+// use those of this release.
+func bakedImageFor(client *ec2.Client, region string, osName string, instanceType string, bootstrapVersion string) string {
+	if bootstrapTemplates.Lookup("download-wordpress.sh") == nil {
+		// Older scripts download WordPress again, over the baked files.
+		return ""
+	}
+	images, err := loadBakedImages()
+	if err != nil || len(images) == 0 {
+		return ""
+	}
+	if bootstrapVersion == "" {
+		bootstrapVersion = version
+	}
+
+	for _, arch := range instanceArchitectures(client, instanceType) {
+		for _, image := range images {
+			if image.Region != region || image.OS != osName || image.Architecture != string(arch) || image.BootstrapVersion != bootstrapVersion {
+				continue
+			}
+			result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{
+				ImageIds: []string{image.ImageId},
+			})
+			if err != nil || len(result.Images) == 0 || result.Images[0].State != types.ImageStateAvailable {
+				log.Printf("Baked image %s is not available, using the stock %s image", image.ImageId, osName)
+				return ""
+			}
+			return image.ImageId
+		}
+	}
+	return ""
+}
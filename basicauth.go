@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func basicAuthSecretName(stack string) string {
+	return "aws-wp/" + stack + "/basic-auth"
+}
+
+func healthAuthSecretName(stack string) string {
+	return "aws-wp/" + stack + "/health-auth"
+}
+
+// parseBasicAuth splits user:password. The user name ends up in an
+// htpasswd file, so it cannot contain a colon or whitespace.
+func parseBasicAuth(s string) (string, string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[0], " \t\n") {
+		return "", "", fmt.Errorf("invalid -basic-auth, expected user:password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// htpasswdLine hashes the password with bcrypt, so the user data carries a
+// hash rather than the password. Apache expects the $2y$ prefix, which is
+// the same algorithm as Go's $2a$.
+func htpasswdLine(user string, password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + strings.Replace(string(hash), "$2a$", "$2y$", 1), nil
+}
+
+// storeBasicAuth keeps the credential in Secrets Manager, where the team
+// can look it up, and returns the secret's ARN. A leftover secret of the
+// same name gets the new value.
+func storeBasicAuth(client *secretsmanager.Client, stack string, user string, password string) string {
+	return storeCredential(client, basicAuthSecretName(stack), "Basic authentication for WordPress stack "+stack, stack, user, password)
+}
+
+// storeHealthAuth keeps the -health-auth credential like storeBasicAuth, so
+// the state does not hold it either.
+func storeHealthAuth(client *secretsmanager.Client, stack string, user string, password string) string {
+	return storeCredential(client, healthAuthSecretName(stack), "Health check credential for WordPress stack "+stack, stack, user, password)
+}
+
+func storeCredential(client *secretsmanager.Client, name string, description string, stack string, user string, password string) string {
+	value, _ := json.Marshal(map[string]string{"username": user, "password": password})
+
+	created, err := client.CreateSecret(context.TODO(), &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String(description),
+		SecretString: aws.String(string(value)),
+		Tags:         []types.Tag{{Key: aws.String(stackTag), Value: aws.String(stack)}},
+	})
+	if err == nil {
+		emit(eventSecretStored, "arn", aws.ToString(created.ARN))
+		return aws.ToString(created.ARN)
+	}
+	if !isErrorCode(err, "ResourceExistsException") {
+		fmt.Println("Got an error storing the credential:")
+		fmt.Println(err)
+		return ""
+	}
+
+	updated, err := client.PutSecretValue(context.TODO(), &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(string(value)),
+	})
+	if err != nil {
+		fmt.Println("Got an error storing the credential:")
+		fmt.Println(err)
+		return ""
+	}
+	emit(eventSecretStored, "arn", aws.ToString(updated.ARN))
+	return aws.ToString(updated.ARN)
+}
+
+// healthCheckAuth returns the check with the credential of its AuthSecret
+// filled in, to probe the site with. Callers must not save it in the state.
+// When the secret cannot be read the check goes without, and fails on the
+// site's 401.
+func healthCheckAuth(env *environment, check healthCheck) healthCheck {
+	if check.AuthSecret == "" || check.Auth != "" {
+		return check
+	}
+	result, err := secretsmanager.NewFromConfig(env.aws).GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(check.AuthSecret),
+	})
+	if err != nil {
+		fmt.Println("Got an error reading the health check credential:")
+		fmt.Println(err)
+		return check
+	}
+	var value map[string]string
+	if err := json.Unmarshal([]byte(aws.ToString(result.SecretString)), &value); err != nil {
+		fmt.Println("Got an error reading the health check credential:")
+		fmt.Println(err)
+		return check
+	}
+	check.Auth = value["username"] + ":" + value["password"]
+	return check
+}
+
+// deleteSecret deletes at once, without the recovery window, so a stack of
+// the same name can be created again right away.
+func deleteSecret(client *secretsmanager.Client, secretId string) bool {
+	_, err := client.DeleteSecret(context.TODO(), &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(secretId),
+		ForceDeleteWithoutRecovery: true,
+	})
+	if err != nil && !isErrorCode(err, "ResourceNotFoundException") {
+		fmt.Println("Got an error deleting the secret:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+#!/bin/bash
+# Rendered by aws-wp bake. Installs the web server, PHP, the database and
+# the WordPress files on the stock {{.OS}} image, then powers off to be
+# imaged. Each stack creates its database and passwords on first boot, so
+# none of them end up in the image. A failure leaves the instance running
+# and the end of the log on its console.
+set -eu
+exec > /var/log/aws-wp-bake.log 2>&1
+trap '{ echo "aws-wp: bake failed"; tail -n 20 /var/log/aws-wp-bake.log; } > /dev/console' ERR
+
+{{.Install}}
+
+# What the install scripts would have set, for stacks booting the image.
+echo "WEB_USER=$WEB_USER" > /etc/aws-wp-baked
+
+# Leave no package caches, and let cloud-init run the stacks' user data as
+# on a fresh image, with new SSH host keys.
+dnf clean all 2> /dev/null || apt-get clean
+cloud-init clean --logs
+echo "aws-wp: bake finished" > /dev/console
+shutdown -h now
@@ -0,0 +1,281 @@
+#!/bin/bash
+# Rendered by aws-wp for stack {{.Stack}}.
+# Customizes the WordPress that ships with the image{{if .OS}}, after
+# installing it on the stock {{.OS}} image{{end}}.
+set -u
+exec >> /var/log/aws-wp-bootstrap.log 2>&1
+{{- if .ProgressParameter}}
+
+# report publishes progress to {{.ProgressParameter}}, which aws-wp polls
+# while it waits for the instance. It needs the AWS CLI and an instance
+# profile allowing ssm:PutParameter.
+IMDS=http://169.254.169.254/latest
+TOKEN=$(curl -fsS -X PUT -H "X-aws-ec2-metadata-token-ttl-seconds: 3600" $IMDS/api/token)
+INSTANCE_ID=$(curl -fsS -H "X-aws-ec2-metadata-token: $TOKEN" $IMDS/meta-data/instance-id)
+REGION=$(curl -fsS -H "X-aws-ec2-metadata-token: $TOKEN" $IMDS/meta-data/placement/region)
+report() {
+  aws ssm put-parameter --region "$REGION" --name '{{.ProgressParameter}}' --type String --overwrite \
+    --value "{\"instance_id\":\"$INSTANCE_ID\",\"percent\":$1,\"status\":\"$2\",\"message\":\"$3\"}" > /dev/null ||
+    echo "aws-wp: could not report progress"
+}
+{{- else}}
+
+report() { :; }
+{{- end}}
+{{- if .Install}}
+
+report 5 running "Installing WordPress"
+{{.Install}}
+{{- end}}
+
+{{template "find-wordpress.sh" .}}
+# include_config loads a file next to wp-config.php from it, once.
+include_config() {
+  grep -q "$1" "$WP_PATH/wp-config.php" ||
+    sed -i "1a require_once __DIR__ . '/$1';" "$WP_PATH/wp-config.php"
+}
+
+# Images that finish their own setup on first boot need a moment.
+report 20 running "Waiting for WordPress to be installed"
+for i in $(seq 1 60); do
+  wp core is-installed && break
+  sleep 10
+done
+report 40 running "Configuring WordPress"
+{{- if .BehindProxy}}
+
+# Behind a load balancer or CDN: take the scheme and client address from the
+# forwarded headers, so HTTPS detection and logins work.
+cat > "$WP_PATH/wp-config-aws-wp-proxy.php" <<'PHP'
+<?php
+if (isset($_SERVER['HTTP_X_FORWARDED_PROTO']) && $_SERVER['HTTP_X_FORWARDED_PROTO'] === 'https') {
+	$_SERVER['HTTPS'] = 'on';
+}
+if (isset($_SERVER['HTTP_X_FORWARDED_FOR'])) {
+	// The proxy appends the address it saw; anything before it is client-supplied.
+	$forwarded = explode(',', $_SERVER['HTTP_X_FORWARDED_FOR']);
+	$_SERVER['REMOTE_ADDR'] = trim(end($forwarded));
+}
+PHP
+include_config wp-config-aws-wp-proxy.php
+{{- end}}
+{{- if and .SitePath (not .SiteURL) (not .OS)}}
+
+# Under {{.SitePath}}, on whatever address the request came in on.
+cat > "$WP_PATH/wp-config-aws-wp-site-path.php" <<'PHP'
+<?php
+if (isset($_SERVER['HTTP_HOST'])) {
+	define('WP_HOME', 'http://' . $_SERVER['HTTP_HOST'] . '{{.SitePath}}');
+	define('WP_SITEURL', WP_HOME);
+}
+PHP
+include_config wp-config-aws-wp-site-path.php
+{{- end}}
+{{- if .SiteURL}}
+
+wp option update home '{{.SiteURL}}'
+wp option update siteurl '{{.SiteURL}}'
+{{- end}}
+{{- if .WPConfig}}
+
+# The wp_config constants of the config file, set in wp-config.php itself so
+# they take the place of its own defines and setting them again changes
+# nothing. Secrets are fetched here rather than carried in the user data,
+# which needs the AWS CLI and an instance profile allowing
+# secretsmanager:GetSecretValue.
+report 45 running "Setting wp-config.php constants"
+# In a replace's copy of a hardened stack the code is already read-only.
+CODE_RO=""
+if [ -x /usr/local/sbin/aws-wp-code ] && ! [ -w "$WP_PATH/wp-config.php" ]; then
+  /usr/local/sbin/aws-wp-code rw
+  CODE_RO=yes
+fi
+if [ -z "${REGION:-}" ]; then
+  IMDS=http://169.254.169.254/latest
+  TOKEN=$(curl -fsS -X PUT -H "X-aws-ec2-metadata-token-ttl-seconds: 300" $IMDS/api/token)
+  REGION=$(curl -fsS -H "X-aws-ec2-metadata-token: $TOKEN" $IMDS/meta-data/placement/region)
+fi
+# secret prints the secret, or the given key of its JSON.
+secret() {
+  aws secretsmanager get-secret-value --region "$REGION" --secret-id "$1" --query SecretString --output text |
+    if [ -n "${2:-}" ]; then
+      php -r '$v = json_decode(stream_get_contents(STDIN), true); echo $v[$argv[1]] ?? "";' "$2"
+    else
+      cat
+    fi
+}
+{{- range .WPConfig}}
+{{- if .Secret}}
+if value=$(secret {{.Secret}}{{with .Key}} {{.}}{{end}}) && [ -n "$value" ]; then
+  wp config set {{.Name}} "$value" --type=constant --quiet
+else
+  echo "aws-wp: could not fetch {{.Name}} from Secrets Manager"
+  report 45 failed "Could not fetch {{.Name}} from Secrets Manager"
+  [ -z "$CODE_RO" ] || /usr/local/sbin/aws-wp-code ro
+  exit 1
+fi
+{{- else}}
+wp config set {{.Name}} {{.Value}} --raw --type=constant --quiet
+{{- end}}
+{{- end}}
+[ -z "$CODE_RO" ] || /usr/local/sbin/aws-wp-code ro
+{{- end}}
+{{- if .Plugins}}
+
+report 60 running "Installing plugins"
+{{- range .Plugins}}
+wp plugin install {{.}} --activate
+{{- end}}
+{{- end}}
+{{- with .PHP}}
+
+report 65 running "Tuning PHP"
+{{template "tune-php.sh" .}}
+{{- end}}
+{{- if or .Htpasswd .Noindex .ReadOnlyCode .Port .SitePath}}
+
+# apache_conf installs the configuration on stdin as aws-wp-$1.conf where
+# this image's Apache picks it up.
+if [ -d /etc/apache2/conf-available ]; then
+  APACHE_DIR=/etc/apache2
+elif [ -d /etc/httpd/conf.d ]; then
+  APACHE_DIR=/etc/httpd
+elif [ -d /opt/bitnami/apache/conf ]; then
+  APACHE_DIR=/opt/bitnami/apache/conf
+else
+  echo "aws-wp: no Apache found"
+  report 70 failed "No Apache found to configure"
+  exit 1
+fi
+apache_conf() {
+  case $APACHE_DIR in
+  /etc/apache2)
+    cat > "$APACHE_DIR/conf-available/aws-wp-$1.conf"
+    a2enconf "aws-wp-$1"
+    ;;
+  /etc/httpd)
+    cat > "$APACHE_DIR/conf.d/aws-wp-$1.conf"
+    ;;
+  *)
+    cat > "$APACHE_DIR/aws-wp-$1.conf"
+    grep -q "aws-wp-$1.conf" "$APACHE_DIR/httpd.conf" ||
+      echo "Include conf/aws-wp-$1.conf" >> "$APACHE_DIR/httpd.conf"
+    ;;
+  esac
+}
+{{- end}}
+{{- if .Noindex}}
+
+# Not production: ask search engines to stay away, in WordPress and on
+# every response.
+report 70 running "Hiding the site from search engines"
+wp option update blog_public 0
+if [ "$APACHE_DIR" = /etc/apache2 ]; then
+  a2enmod headers
+fi
+apache_conf noindex <<'CONF'
+<IfModule mod_headers.c>
+  Header always set X-Robots-Tag "noindex, nofollow"
+</IfModule>
+CONF
+{{- end}}
+{{- if .Htpasswd}}
+
+# Staging: the whole site behind basic authentication.
+report 80 running "Enabling basic authentication"
+cat > "$APACHE_DIR/aws-wp.htpasswd" <<'HTPASSWD'
+{{.Htpasswd}}
+HTPASSWD
+chmod 644 "$APACHE_DIR/aws-wp.htpasswd"
+apache_conf basic-auth <<CONF
+<Location "/">
+  AuthType Basic
+  AuthName "Staging"
+  AuthUserFile $APACHE_DIR/aws-wp.htpasswd
+  Require valid-user
+</Location>
+CONF
+{{- end}}
+{{- if .Port}}
+
+# Serve the site on port {{.Port}} instead of 80.
+report 85 running "Moving the site to port {{.Port}}"
+for conf in /etc/apache2/ports.conf /etc/httpd/conf/httpd.conf /opt/bitnami/apache/conf/httpd.conf; do
+  [ -f "$conf" ] && sed -i 's/^Listen 80$/Listen {{.Port}}/' "$conf"
+done
+for conf in /etc/apache2/sites-available/*.conf /opt/bitnami/apache/conf/vhosts/*.conf; do
+  [ -f "$conf" ] && sed -i 's/<VirtualHost \([^>]*\):80>/<VirtualHost \1:{{.Port}}>/' "$conf"
+done
+{{- end}}
+{{- if .SitePath}}
+
+# WordPress under {{.SitePath}}, for a domain shared with other sites or a
+# proxy passing the path on. The root sends visitors there.
+apache_conf site-path <<CONF
+Alias {{.SitePath}} $WP_PATH
+RedirectMatch ^/$ {{.SitePath}}/
+CONF
+{{- end}}
+{{- if .ReadOnlyCode}}
+
+# Uploads stay writable with the code read-only, so PHP must not run from
+# them.
+apache_conf uploads <<CONF
+<Directory "$WP_PATH/wp-content/uploads">
+  <FilesMatch "\.(php[0-9]?|phtml|phar)$">
+    Require all denied
+  </FilesMatch>
+</Directory>
+CONF
+{{- end}}
+{{- if or .Htpasswd .Noindex .ReadOnlyCode .Port .SitePath}}
+systemctl reload apache2 2> /dev/null || systemctl reload httpd 2> /dev/null ||
+  /opt/bitnami/ctlscript.sh restart apache
+{{- end}}
+
+report 90 running "Fixing file ownership"
+OWNER=$(stat -c %U "$WP_PATH/wp-content")
+chown -R "$OWNER" "$WP_PATH/wp-content"
+{{- if .ReadOnlyCode}}
+
+# Hardened: WordPress, its themes and plugins are mounted read-only, so an
+# exploited plugin can neither change nor add code. Only the uploads are
+# writable, from a directory outside the read-only mount. aws-wp-code rw
+# lifts this for maintenance and aws-wp-code ro restores it.
+report 95 running "Mounting the code read-only"
+# A replace's copy of this instance comes with the mounts and the uploads
+# already moved: copying and deleting them again would wipe the uploads.
+if grep -q "^# aws-wp read-only code" /etc/fstab || [ -x /usr/local/sbin/aws-wp-code ]; then
+  echo "aws-wp: the code is already read-only"
+else
+  cat > "$WP_PATH/wp-config-aws-wp-read-only.php" <<'PHP'
+<?php
+// The code is read-only: hide the plugin and theme installers and updates.
+define('DISALLOW_FILE_MODS', true);
+PHP
+  include_config wp-config-aws-wp-read-only.php
+  UPLOADS=/var/lib/aws-wp/uploads
+  mkdir -p "$UPLOADS" "$WP_PATH/wp-content/uploads"
+  cp -a "$WP_PATH/wp-content/uploads/." "$UPLOADS/" &&
+    find "$WP_PATH/wp-content/uploads" -mindepth 1 -delete
+  chown -R "$OWNER" "$UPLOADS"
+  cat >> /etc/fstab <<FSTAB
+# aws-wp read-only code
+$WP_PATH $WP_PATH none bind,ro 0 0
+$UPLOADS $WP_PATH/wp-content/uploads none bind 0 0
+FSTAB
+  mount "$WP_PATH"
+  mount "$WP_PATH/wp-content/uploads"
+  cat > /usr/local/sbin/aws-wp-code <<SCRIPT
+#!/bin/sh
+# aws-wp-code rw|ro makes the WordPress code writable, for updates, and
+# read-only again.
+case "\$1" in
+rw | ro) exec mount -o "remount,bind,\$1" $WP_PATH ;;
+*) echo "usage: aws-wp-code rw|ro" >&2; exit 2 ;;
+esac
+SCRIPT
+  chmod 755 /usr/local/sbin/aws-wp-code
+fi
+{{- end}}
+report 100 done "WordPress is ready"
@@ -0,0 +1,5 @@
+# wp-cli and the WordPress files, the part of the install that is the same
+# for every site and can be baked into an image.
+curl -fsSL -o /usr/local/bin/wp https://raw.githubusercontent.com/wp-cli/builds/gh-pages/phar/wp-cli.phar
+chmod +x /usr/local/bin/wp
+/usr/local/bin/wp --allow-root --path=/var/www/html core download
@@ -0,0 +1,29 @@
+# Breaks the site for "aws-wp drill" and, with .Restore, puts it back. Run
+# over SSM, not at boot.
+set -e
+if systemctl cat apache2 > /dev/null 2>&1; then
+  service=apache2
+  conf=/etc/apache2/conf-enabled/aws-wp-drill.conf
+elif systemctl cat httpd > /dev/null 2>&1; then
+  service=httpd
+  conf=/etc/httpd/conf.d/aws-wp-drill.conf
+else
+  echo "No Apache service found" >&2
+  exit 1
+fi
+{{- if eq .Scenario "apache"}}
+{{- if .Restore}}
+systemctl start "$service"
+{{- else}}
+# As in a crash: no clean shutdown, systemd decides whether to restart.
+systemctl kill --signal=SIGKILL "$service"
+{{- end}}
+{{- else if eq .Scenario "health"}}
+{{- if .Restore}}
+rm -f "$conf"
+{{- else}}
+# Every request gets a 503, Apache itself stays up.
+echo "Redirect 503 /" > "$conf"
+{{- end}}
+systemctl reload "$service"
+{{- end}}
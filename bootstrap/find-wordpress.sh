@@ -0,0 +1,28 @@
+{{/* Sets WP_PATH to the WordPress installation and wp to wp-cli for it.
+Included by the scripts that need WordPress; they define report. */ -}}
+for dir in /var/www/html /var/www/wordpress /opt/bitnami/wordpress; do
+  if [ -f "$dir/wp-config.php" ] || [ -f "$dir/wp-config-sample.php" ]; then
+    WP_PATH=$dir
+    break
+  fi
+done
+if [ -z "${WP_PATH:-}" ]; then
+  echo "aws-wp: no WordPress installation found"
+  report 0 failed "No WordPress installation found"
+  exit 1
+fi
+report 10 running "Preparing wp-cli"
+
+WP=$(command -v wp || true)
+if [ -z "$WP" ] && [ -x /opt/bitnami/wp-cli/bin/wp ]; then
+  WP=/opt/bitnami/wp-cli/bin/wp
+fi
+if [ -z "$WP" ]; then
+  curl -fsSL -o /usr/local/bin/wp https://raw.githubusercontent.com/wp-cli/builds/gh-pages/phar/wp-cli.phar
+  chmod +x /usr/local/bin/wp
+  WP=/usr/local/bin/wp
+fi
+
+wp() {
+  "$WP" --allow-root --path="$WP_PATH" "$@"
+}
@@ -0,0 +1,17 @@
+# Grows the root partition and filesystem into the space added to the root
+# volume. Run over SSM by "aws-wp volume grow", not at boot.
+set -e
+source=$(findmnt -n -o SOURCE /)
+fstype=$(findmnt -n -o FSTYPE /)
+disk=$(lsblk -n -d -o PKNAME "$source")
+if [ -n "$disk" ]; then
+  part=$(cat "/sys/class/block/$(basename "$source")/partition")
+  # growpart exits 1 when the partition already fills the disk.
+  growpart "/dev/$disk" "$part" || [ $? -eq 1 ]
+fi
+case "$fstype" in
+  ext2|ext3|ext4) resize2fs "$source" ;;
+  xfs) xfs_growfs -d / ;;
+  *) echo "Cannot grow a $fstype root filesystem" >&2; exit 1 ;;
+esac
+df -h /
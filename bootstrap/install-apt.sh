@@ -0,0 +1,10 @@
+# Web server, PHP and database from the Debian and Ubuntu packages.
+export DEBIAN_FRONTEND=noninteractive
+apt-get update
+# Unlike Amazon Linux these images lack the AWS CLI, which progress reports
+# and secret-backed wp_config constants need.
+apt-get install -y apache2 libapache2-mod-php php-mysql php-curl php-gd php-intl php-mbstring php-xml php-zip mariadb-server curl openssl awscli
+systemctl enable --now apache2 mariadb
+# Apache's placeholder page would be served before index.php.
+rm -f /var/www/html/index.html
+WEB_USER=www-data
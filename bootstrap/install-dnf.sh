@@ -0,0 +1,5 @@
+# Web server, PHP and database from the Amazon Linux packages. PHP runs
+# under php-fpm, which httpd hands .php requests to.
+dnf install -y httpd php php-fpm php-mysqlnd php-gd php-intl php-mbstring php-xml mariadb105-server openssl
+systemctl enable --now httpd php-fpm mariadb
+WEB_USER=apache
@@ -0,0 +1,27 @@
+# WordPress itself, installed with wp-cli against a local database. The
+# admin password is left in /root, readable only by root.
+{{- if .Baked}}
+# The packages and files come with the baked image.
+. /etc/aws-wp-baked
+{{- end}}
+install_wp() {
+  /usr/local/bin/wp --allow-root --path=/var/www/html "$@"
+}
+
+DB_PASSWORD=$(openssl rand -hex 16)
+ADMIN_PASSWORD=$(openssl rand -base64 18)
+mysql -e "CREATE DATABASE IF NOT EXISTS wordpress;
+  CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$DB_PASSWORD';
+  GRANT ALL ON wordpress.* TO 'wordpress'@'localhost';"
+
+install_wp config create --dbname=wordpress --dbuser=wordpress --dbpass="$DB_PASSWORD" --dbhost=localhost
+{{- if not .SiteURL}}
+# Without a fixed site URL, answer on whatever address the request came in
+# on: the public DNS name changes with an Elastic IP or a restart.
+install_wp config set WP_HOME "(isset(\$_SERVER['HTTP_HOST']) ? 'http://' . \$_SERVER['HTTP_HOST'] : 'http://localhost') . '{{.SitePath}}'" --raw
+install_wp config set WP_SITEURL WP_HOME --raw
+{{- end}}
+install_wp core install --url='{{if .SiteURL}}{{.SiteURL}}{{else}}http://localhost{{.SitePath}}{{end}}' --title=WordPress \
+  --admin_user=admin --admin_password="$ADMIN_PASSWORD" --admin_email=admin@example.com --skip-email
+(umask 077; echo "$ADMIN_PASSWORD" > /root/aws-wp-admin-password)
+chown -R "$WEB_USER" /var/www/html
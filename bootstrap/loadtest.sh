@@ -0,0 +1,8 @@
+# Run over SSM by "aws-wp loadtest -from spot" on a temporary instance:
+# fetches the same release of the tool and drives the load from here. Only
+# the summary goes to stdout.
+set -eu
+curl -fsSL -o /tmp/aws-wp '{{.BinaryURL}}'
+echo '{{.Checksum}}  /tmp/aws-wp' | sha256sum -c - >&2
+chmod +x /tmp/aws-wp
+/tmp/aws-wp loadtest -url '{{.URL}}' -rps {{.RPS}} -duration {{.Duration}} -json
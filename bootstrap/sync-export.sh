@@ -0,0 +1,19 @@
+# Run over SSM by "aws-wp sync" on the source stack's instance: exports the
+# database and wp-content into a directory that outlives the command, from
+# which sync-upload.sh uploads them in parts, and prints their sizes and
+# checksums.
+set -eu
+report() { :; }
+{{template "find-wordpress.sh" .}}
+DIR='{{.Dir}}'
+rm -rf "$DIR"
+mkdir -m 700 "$DIR"
+
+wp db export "$DIR/database.sql"
+gzip "$DIR/database.sql"
+# From inside wp-content, which images like Bitnami link elsewhere.
+tar -czf "$DIR/wp-content.tar.gz" -C "$WP_PATH/wp-content/" .
+for file in database.sql.gz wp-content.tar.gz; do
+  echo "Exported $file $(stat -c %s "$DIR/$file") bytes sha256 $(sha256sum "$DIR/$file" | cut -d' ' -f1)"
+done
+du -h "$DIR"/*
@@ -0,0 +1,57 @@
+# Run over SSM by "aws-wp sync" on the target stack's instance: replaces its
+# wp-content and database with the source's and points the URLs in the
+# database at this site. wp-config.php stays as it is. The downloads are
+# kept until the import succeeded, so running it again resumes them, and
+# checked against the checksums of the export.
+set -eu
+report() { :; }
+{{template "find-wordpress.sh" .}}
+DIR=$(mktemp -d)
+trap 'rm -rf "$DIR"' EXIT
+if [ -x /usr/local/sbin/aws-wp-code ]; then
+  # The code is read-only, and the source's replaces it.
+  /usr/local/sbin/aws-wp-code rw
+  trap '/usr/local/sbin/aws-wp-code ro; rm -rf "$DIR"' EXIT
+fi
+
+DOWNLOADS='{{.Dir}}'
+mkdir -p -m 700 "$DOWNLOADS"
+download() {
+  if ! echo "$3  $DOWNLOADS/$1" | sha256sum -c --status 2> /dev/null; then
+    curl -fsS --retry 3 {{- with .RateLimit}} --limit-rate {{.}}{{end}} -C - -o "$DOWNLOADS/$1" "$2"
+  fi
+  if ! echo "$3  $DOWNLOADS/$1" | sha256sum -c --status; then
+    rm -f "$DOWNLOADS/$1"
+    echo "aws-wp: $1 does not match the checksum of the export"
+    exit 1
+  fi
+}
+download database.sql.gz '{{.DatabaseURL}}' {{.DatabaseSHA256}}
+download wp-content.tar.gz '{{.ContentURL}}' {{.ContentSHA256}}
+cp "$DOWNLOADS/database.sql.gz" "$DIR/"
+TARGET_HOME=$(wp option get home)
+
+mkdir "$DIR/wp-content"
+tar -xzf "$DOWNLOADS/wp-content.tar.gz" -C "$DIR/wp-content"
+OWNER=$(stat -c %U "$WP_PATH/wp-content")
+if command -v rsync > /dev/null; then
+  rsync -a --delete "$DIR/wp-content/" "$WP_PATH/wp-content/"
+else
+  find "$WP_PATH/wp-content/" -mindepth 1 -delete
+  cp -a "$DIR/wp-content/." "$WP_PATH/wp-content/"
+fi
+chown -R "$OWNER" "$WP_PATH/wp-content/"
+
+gunzip "$DIR/database.sql.gz"
+wp db import "$DIR/database.sql"
+SOURCE_HOME=$(wp option get home)
+if [ "$SOURCE_HOME" != "$TARGET_HOME" ]; then
+  wp search-replace "$SOURCE_HOME" "$TARGET_HOME" --all-tables-with-prefix --skip-columns=guid
+fi
+{{- if .Noindex}}
+# The source's setting came along with the database.
+wp option update blog_public 0
+{{- end}}
+wp cache flush || true
+rm -rf "$DOWNLOADS"
+echo "Synced $SOURCE_HOME to $TARGET_HOME"
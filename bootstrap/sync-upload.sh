@@ -0,0 +1,42 @@
+# Run over SSM by "aws-wp sync" on the source stack's instance, once for
+# each round of parts: cuts the parts out of the export and uploads them to
+# the presigned UploadPart URLs, -concurrency at a time. S3 checks each part
+# against its Content-MD5, and the printed MD5s let sync check what S3 kept.
+set -eu
+DIR='{{.Dir}}'
+{{- range .Files}}
+if [ "$(stat -c %s "$DIR/{{.Key}}" 2> /dev/null)" != {{.Size}} ]; then
+  echo "aws-wp: $DIR/{{.Key}} is gone or changed since the export, run sync with -restart"
+  exit 1
+fi
+{{- end}}
+mkdir -p "$DIR/parts"
+
+upload() {
+  part="$DIR/parts/$1.$2"
+  tail -c +$(( ($2 - 1) * {{.PartSize}} + 1 )) "$DIR/$1" | head -c {{.PartSize}} > "$part"
+  md5=$(openssl dgst -md5 -binary "$part" | openssl base64)
+  curl -fsS --retry 3 {{- with .RateLimit}} --limit-rate {{.}}{{end}} -X PUT -H "Content-MD5: $md5" \
+    --upload-file "$part" -o /dev/null "$3"
+  echo "Uploaded $1 part $2 md5 $(md5sum "$part" | cut -d' ' -f1)"
+  rm -f "$part"
+}
+
+pids=""
+failed=""
+while read -r key number url; do
+  upload "$key" "$number" "$url" &
+  pids="$pids $!"
+  if [ $(echo $pids | wc -w) -ge {{.Concurrency}} ]; then
+    for pid in $pids; do wait "$pid" || failed=yes; done
+    pids=""
+  fi
+done <<'PARTS'
+{{range .Parts}}{{.Key}} {{.Number}} {{.URL}}
+{{end -}}
+PARTS
+for pid in $pids; do wait "$pid" || failed=yes; done
+if [ -n "$failed" ]; then
+  echo "aws-wp: some parts failed to upload"
+  exit 1
+fi
@@ -0,0 +1,30 @@
+# Writes the PHP settings of "aws-wp tune" and reloads PHP gracefully, so
+# requests in flight finish on the old settings. Run at boot and as the
+# script of the SSM document tune applies, whose parameters the values
+# then are. Empty values leave PHP's defaults.
+MEMORY_LIMIT='{{.MemoryLimit}}'
+UPLOAD_MAX_FILESIZE='{{.UploadMaxFilesize}}'
+OPCACHE='{{.OPcache}}'
+ini=$(mktemp)
+[ -z "$MEMORY_LIMIT" ] || echo "memory_limit = $MEMORY_LIMIT" >> "$ini"
+if [ -n "$UPLOAD_MAX_FILESIZE" ]; then
+  echo "upload_max_filesize = $UPLOAD_MAX_FILESIZE" >> "$ini"
+  echo "post_max_size = $UPLOAD_MAX_FILESIZE" >> "$ini"
+fi
+[ -z "$OPCACHE" ] || echo "opcache.enable = $OPCACHE" >> "$ini"
+found=""
+for dir in /etc/php.d /etc/php/*/apache2/conf.d /etc/php/*/fpm/conf.d /opt/bitnami/php/etc/conf.d; do
+  [ -d "$dir" ] || continue
+  install -m 644 "$ini" "$dir/99-aws-wp.ini"
+  found=yes
+done
+rm -f "$ini"
+if [ -z "$found" ]; then
+  echo "aws-wp: no PHP configuration directory found"
+  exit 1
+fi
+for service in $(systemctl list-units --type=service --state=running --plain --no-legend 'php*-fpm.service' | cut -d' ' -f1); do
+  systemctl reload "$service"
+done
+systemctl reload apache2 2> /dev/null || systemctl reload httpd 2> /dev/null ||
+  /opt/bitnami/ctlscript.sh restart apache
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+const defaultCanarySteps = "10,50,100"
+
+// canaryOptions are the replace flags that control the traffic shift.
+type canaryOptions struct {
+	steps     []int32
+	interval  time.Duration
+	maxErrors float64
+}
+
+// parseCanarySteps reads the percentages of traffic sent to the new
+// instance at each step, like "10,50,100". They must grow and the last one
+// is always 100.
+func parseCanarySteps(s string) ([]int32, error) {
+	var steps []int32
+	for _, part := range splitList(s) {
+		percent, err := strconv.Atoi(part)
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, fmt.Errorf("invalid canary step %q, expected a percentage from 1 to 100", part)
+		}
+		if len(steps) > 0 && int32(percent) <= steps[len(steps)-1] {
+			return nil, fmt.Errorf("canary steps must grow, got %s", s)
+		}
+		steps = append(steps, int32(percent))
+	}
+	if len(steps) > 0 && steps[len(steps)-1] != 100 {
+		steps = append(steps, 100)
+	}
+	return steps, nil
+}
+
+// canaryTargetGroupName gives the new target group a name of its own, since
+// the old one still exists while traffic shifts. The random suffix keeps it
+// within the 32 characters AWS allows.
+func canaryTargetGroupName(stack string) string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return "awp-" + stack + "-" + hex.EncodeToString(suffix)[:3]
+}
+
+// shiftTraffic moves the load balancer from its target group to a new one
+// holding only the green instance, step by step through weighted forwarding.
+// After each step the green target group's 5XX rate is checked, and if it is
+// above the limit, or green fails its health check, all traffic goes back to
+// the old target group. Once everything is on green the old target group is
+// deleted and the stack switches to the new one.
+func shiftTraffic(client *elb.Client, cwClient *cloudwatch.Client, state *stackState, greenId string, options canaryOptions) bool {
+	lb := state.LoadBalancer
+	blueGroup := lb.TargetGroupArn
+
+	greenGroup := createCanaryTargetGroup(client, state.Name, blueGroup)
+	if greenGroup == "" {
+		return false
+	}
+	lb.CanaryTargetGroupArn = greenGroup
+	saveStackState(state)
+
+	abort := func() bool {
+		forwardTo(client, lb.Arn, blueGroup, "", 0)
+		emit(eventTrafficRolledBack, "target_group_arn", blueGroup)
+		if deleteTargetGroup(client, greenGroup) {
+			lb.CanaryTargetGroupArn = ""
+			saveStackState(state)
+		}
+		return false
+	}
+
+	split := &elbTrafficSplit{client: client, cwClient: cwClient, lb: lb, blueGroup: blueGroup, greenGroup: greenGroup, greenId: greenId, maxErrors: options.maxErrors}
+	if !shiftSteps(split, options) {
+		return abort()
+	}
+
+	if !forwardTo(client, lb.Arn, greenGroup, "", 0) {
+		return abort()
+	}
+	lb.TargetGroupArn = greenGroup
+	lb.CanaryTargetGroupArn = ""
+	saveStackState(state)
+
+	deleteTargetGroup(client, blueGroup)
+	return true
+}
+
+// trafficSplit is what shiftSteps does to the load balancer.
+type trafficSplit interface {
+	// register adds green to its target group without waiting.
+	register() bool
+	// forward sends weight percent of the traffic to green.
+	forward(weight int32) bool
+	// waitHealthy waits for green to pass the health check.
+	waitHealthy() bool
+	// healthy checks green's health and error rate since the step began.
+	healthy(since time.Time) bool
+}
+
+// shiftSteps moves the traffic to green through the steps and reports
+// whether it all got there. The green target group is put on the listeners
+// with no traffic before green's health is waited for, since the load
+// balancer does not check the targets of a group no listener uses.
+func shiftSteps(split trafficSplit, options canaryOptions) bool {
+	if !split.register() || !split.forward(0) || !split.waitHealthy() {
+		return false
+	}
+	for _, weight := range options.steps {
+		if !split.forward(weight) {
+			return false
+		}
+		if weight == 100 {
+			break
+		}
+
+		since := time.Now()
+		time.Sleep(options.interval)
+		if !split.healthy(since) {
+			return false
+		}
+	}
+	return true
+}
+
+// elbTrafficSplit splits a load balancer's traffic between the stack's
+// target group and the canary one.
+type elbTrafficSplit struct {
+	client     *elb.Client
+	cwClient   *cloudwatch.Client
+	lb         *loadBalancer
+	blueGroup  string
+	greenGroup string
+	greenId    string
+	maxErrors  float64
+}
+
+func (s *elbTrafficSplit) register() bool {
+	return addTarget(s.client, s.greenGroup, s.greenId)
+}
+
+func (s *elbTrafficSplit) forward(weight int32) bool {
+	if !forwardTo(s.client, s.lb.Arn, s.blueGroup, s.greenGroup, weight) {
+		return false
+	}
+	emit(eventTrafficShifted, "target_group_arn", s.greenGroup, "weight", strconv.Itoa(int(weight)))
+	log.Printf("%d%% of traffic on %s", weight, s.greenId)
+	return true
+}
+
+func (s *elbTrafficSplit) waitHealthy() bool {
+	return waitTargetHealthy(s.client, s.greenGroup, s.greenId)
+}
+
+func (s *elbTrafficSplit) healthy(since time.Time) bool {
+	return canaryHealthy(s.client, s.cwClient, s.lb, s.greenGroup, s.greenId, since, s.maxErrors)
+}
+
+// createCanaryTargetGroup creates a target group like the existing one: same
+// VPC, health check and stickiness.
+func createCanaryTargetGroup(client *elb.Client, stack string, templateArn string) string {
+	result, err := client.DescribeTargetGroups(context.TODO(), &elb.DescribeTargetGroupsInput{
+		TargetGroupArns: []string{templateArn},
+	})
+	if err != nil || len(result.TargetGroups) == 0 {
+		fmt.Println("Got an error retrieving the target group:")
+		fmt.Println(err)
+		return ""
+	}
+	template := result.TargetGroups[0]
+
+	targetGroup, err := client.CreateTargetGroup(context.TODO(), &elb.CreateTargetGroupInput{
+		Name:                       aws.String(canaryTargetGroupName(stack)),
+		Protocol:                   template.Protocol,
+		Port:                       template.Port,
+		VpcId:                      template.VpcId,
+		TargetType:                 template.TargetType,
+		HealthCheckPath:            template.HealthCheckPath,
+		HealthCheckPort:            template.HealthCheckPort,
+		HealthCheckProtocol:        template.HealthCheckProtocol,
+		HealthCheckIntervalSeconds: template.HealthCheckIntervalSeconds,
+		HealthCheckTimeoutSeconds:  template.HealthCheckTimeoutSeconds,
+		HealthyThresholdCount:      template.HealthyThresholdCount,
+		UnhealthyThresholdCount:    template.UnhealthyThresholdCount,
+		Matcher:                    template.Matcher,
+		Tags:                       []types.Tag{{Key: aws.String(stackTag), Value: aws.String(stack)}},
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the target group:")
+		fmt.Println(err)
+		return ""
+	}
+	arn := aws.ToString(targetGroup.TargetGroups[0].TargetGroupArn)
+
+	if stickiness := targetGroupStickiness(client, templateArn); stickiness > 0 && !setStickiness(client, arn, stickiness) {
+		deleteTargetGroup(client, arn)
+		return ""
+	}
+	return arn
+}
+
+// targetGroupStickiness returns the cookie duration, or 0 without stickiness.
+func targetGroupStickiness(client *elb.Client, targetGroupArn string) time.Duration {
+	result, err := client.DescribeTargetGroupAttributes(context.TODO(), &elb.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+	})
+	if err != nil {
+		return 0
+	}
+
+	attributes := map[string]string{}
+	for _, a := range result.Attributes {
+		attributes[aws.ToString(a.Key)] = aws.ToString(a.Value)
+	}
+	if attributes["stickiness.enabled"] != "true" {
+		return 0
+	}
+	seconds, _ := strconv.Atoi(attributes["stickiness.lb_cookie.duration_seconds"])
+	return time.Duration(seconds) * time.Second
+}
+
+// forwardTo points every forwarding listener of the load balancer at the
+// target group, or with a second one, splits traffic between the two and
+// sends weight percent to second. Redirecting listeners are left alone.
+func forwardTo(client *elb.Client, loadBalancerArn string, first string, second string, weight int32) bool {
+	result, err := client.DescribeListeners(context.TODO(), &elb.DescribeListenersInput{
+		LoadBalancerArn: aws.String(loadBalancerArn),
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the listeners:")
+		fmt.Println(err)
+		return false
+	}
+
+	action := types.Action{Type: types.ActionTypeEnumForward, TargetGroupArn: aws.String(first)}
+	if second != "" {
+		action = types.Action{
+			Type: types.ActionTypeEnumForward,
+			ForwardConfig: &types.ForwardActionConfig{
+				TargetGroups: []types.TargetGroupTuple{
+					{TargetGroupArn: aws.String(first), Weight: aws.Int32(100 - weight)},
+					{TargetGroupArn: aws.String(second), Weight: aws.Int32(weight)},
+				},
+			},
+		}
+		// Keep each visitor on the side they landed on, or a login on one
+		// instance would be lost on the next request to the other.
+		if stickiness := targetGroupStickiness(client, first); stickiness > 0 {
+			action.ForwardConfig.TargetGroupStickinessConfig = &types.TargetGroupStickinessConfig{
+				Enabled:         aws.Bool(true),
+				DurationSeconds: aws.Int32(int32(stickiness.Seconds())),
+			}
+		}
+	}
+
+	for _, listener := range result.Listeners {
+		if len(listener.DefaultActions) == 0 || listener.DefaultActions[0].Type != types.ActionTypeEnumForward {
+			continue
+		}
+		_, err := client.ModifyListener(context.TODO(), &elb.ModifyListenerInput{
+			ListenerArn:    listener.ListenerArn,
+			DefaultActions: []types.Action{action},
+		})
+		if err != nil {
+			fmt.Println("Got an error updating the listener:")
+			fmt.Println(err)
+			return false
+		}
+	}
+	return true
+}
+
+// canaryHealthy checks green's target health and the share of its requests
+// since the step began that ended in a 5XX response.
+func canaryHealthy(client *elb.Client, cwClient *cloudwatch.Client, lb *loadBalancer, targetGroupArn string, instanceId string, since time.Time, maxErrors float64) bool {
+	health, err := client.DescribeTargetHealth(context.TODO(), &elb.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []types.TargetDescription{{Id: aws.String(instanceId)}},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving target health:")
+		fmt.Println(err)
+		return false
+	}
+	for _, t := range health.TargetHealthDescriptions {
+		if t.TargetHealth.State != types.TargetHealthStateEnumHealthy {
+			fmt.Printf("The new instance is %s behind the load balancer, rolling back\n", t.TargetHealth.State)
+			return false
+		}
+	}
+
+	requests, err := targetGroupSum(cwClient, lb.Arn, targetGroupArn, "RequestCount", since)
+	if err != nil {
+		fmt.Println("Got an error retrieving load balancer metrics:")
+		fmt.Println(err)
+		return false
+	}
+	if requests == 0 {
+		return true
+	}
+	errors, err := targetGroupSum(cwClient, lb.Arn, targetGroupArn, "HTTPCode_Target_5XX_Count", since)
+	if err != nil {
+		fmt.Println("Got an error retrieving load balancer metrics:")
+		fmt.Println(err)
+		return false
+	}
+
+	rate := 100 * errors / requests
+	if rate > maxErrors {
+		fmt.Printf("%.1f%% of requests to the new instance failed, rolling back\n", rate)
+		return false
+	}
+	return true
+}
+
+// targetGroupSum adds up an ALB metric of the target group since the time
+// given. The metric dimensions are the trailing parts of the ARNs.
+func targetGroupSum(client *cloudwatch.Client, loadBalancerArn string, targetGroupArn string, metric string, since time.Time) (float64, error) {
+	result, err := client.GetMetricStatistics(context.TODO(), &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/ApplicationELB"),
+		MetricName: aws.String(metric),
+		Dimensions: []cwtypes.Dimension{
+			{Name: aws.String("LoadBalancer"), Value: aws.String(arnSuffix(loadBalancerArn, ":loadbalancer/"))},
+			{Name: aws.String("TargetGroup"), Value: aws.String(arnSuffix(targetGroupArn, ":"))},
+		},
+		StartTime:  aws.Time(since.Truncate(time.Minute)),
+		EndTime:    aws.Time(time.Now()),
+		Period:     aws.Int32(60),
+		Statistics: []cwtypes.Statistic{cwtypes.StatisticSum},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sum := 0.0
+	for _, point := range result.Datapoints {
+		sum += aws.ToFloat64(point.Sum)
+	}
+	return sum, nil
+}
+
+func arnSuffix(arn string, separator string) string {
+	return arn[strings.LastIndex(arn, separator)+len(separator):]
+}
+
+func deleteTargetGroup(client *elb.Client, targetGroupArn string) bool {
+	for attempt := 0; ; attempt++ {
+		_, err := client.DeleteTargetGroup(context.TODO(), &elb.DeleteTargetGroupInput{
+			TargetGroupArn: aws.String(targetGroupArn),
+		})
+		if err == nil || isErrorCode(err, "TargetGroupNotFound") {
+			return true
+		}
+		if !isErrorCode(err, "ResourceInUse") || attempt == 20 {
+			fmt.Println("Got an error deleting the target group:")
+			fmt.Println(err)
+			return false
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
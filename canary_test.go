@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCanarySteps(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int32
+		err   bool
+	}{
+		{value: ""},
+		{value: "10,50,100", want: []int32{10, 50, 100}},
+		{value: "10, 50", want: []int32{10, 50, 100}},
+		{value: "100", want: []int32{100}},
+		{value: "1", want: []int32{1, 100}},
+		{value: "50,10", err: true},
+		{value: "10,10", err: true},
+		{value: "0", err: true},
+		{value: "101", err: true},
+		{value: "ten", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseCanarySteps(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseCanarySteps(%q) = %v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCanarySteps(%q): %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCanarySteps(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+// recordedSplit records what shiftSteps does and fails the call named fail.
+type recordedSplit struct {
+	calls []string
+	fail  string
+}
+
+func (s *recordedSplit) record(call string) bool {
+	s.calls = append(s.calls, call)
+	return call != s.fail
+}
+
+func (s *recordedSplit) register() bool { return s.record("register") }
+
+func (s *recordedSplit) forward(weight int32) bool {
+	return s.record(fmt.Sprintf("forward %d", weight))
+}
+
+func (s *recordedSplit) waitHealthy() bool { return s.record("wait") }
+
+func (s *recordedSplit) healthy(since time.Time) bool { return s.record("healthy") }
+
+func TestShiftSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []int32
+		fail  string
+		want  []string
+		ok    bool
+	}{
+		{
+			name:  "waits for health once the group is on the listeners",
+			steps: []int32{10, 50, 100},
+			want:  []string{"register", "forward 0", "wait", "forward 10", "healthy", "forward 50", "healthy", "forward 100"},
+			ok:    true,
+		},
+		{
+			name:  "stops when green does not become healthy",
+			steps: []int32{10, 100},
+			fail:  "wait",
+			want:  []string{"register", "forward 0", "wait"},
+		},
+		{
+			name:  "stops when a step goes wrong",
+			steps: []int32{10, 50, 100},
+			fail:  "healthy",
+			want:  []string{"register", "forward 0", "wait", "forward 10", "healthy"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			split := &recordedSplit{fail: test.fail}
+			ok := shiftSteps(split, canaryOptions{steps: test.steps})
+			if ok != test.ok {
+				t.Errorf("shiftSteps returned %t, want %t", ok, test.ok)
+			}
+			if !reflect.DeepEqual(split.calls, test.want) {
+				t.Errorf("shiftSteps did %q, want %q", split.calls, test.want)
+			}
+		})
+	}
+}
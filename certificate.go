@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+)
+
+// certificateAuto as -certificate-arn has the tool request the certificate.
+const certificateAuto = "auto"
+
+// requestCertificate gets an ACM certificate for the stack's domain and
+// waits until it is issued. ACM validates it through a CNAME record, which
+// goes into the zone with the stack's DNS provider like the site record,
+// so this works wherever the domain is hosted.
+func requestCertificate(env *environment, state *stackState) string {
+	client := acm.NewFromConfig(env.aws)
+
+	requested, err := client.RequestCertificate(context.TODO(), &acm.RequestCertificateInput{
+		DomainName:       aws.String(state.Domain),
+		ValidationMethod: types.ValidationMethodDns,
+		// Alphanumeric only, so the stack name loses its dashes.
+		IdempotencyToken: aws.String(strings.ReplaceAll(state.Name, "-", "")),
+		Tags:             []types.Tag{{Key: aws.String(stackTag), Value: aws.String(state.Name)}},
+	})
+	if err != nil {
+		fmt.Println("Got an error requesting the certificate:")
+		fmt.Println(err)
+		return ""
+	}
+	arn := aws.ToString(requested.CertificateArn)
+	state.CertificateArn = arn
+	saveStackState(state)
+
+	provider, err := newDNSProvider(env, state.DNSProvider, state.Domain)
+	if err != nil {
+		fmt.Println("Got an error finding the DNS zone:")
+		fmt.Println(err)
+		return ""
+	}
+
+	recorded := false
+	for {
+		result, err := client.DescribeCertificate(context.TODO(), &acm.DescribeCertificateInput{
+			CertificateArn: aws.String(arn),
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving the certificate:")
+			fmt.Println(err)
+			return ""
+		}
+		certificate := result.Certificate
+
+		switch certificate.Status {
+		case types.CertificateStatusIssued:
+			return arn
+		case types.CertificateStatusPendingValidation:
+		default:
+			fmt.Printf("Got an error: certificate %s is %s\n", arn, certificate.Status)
+			return ""
+		}
+
+		// The validation record shows up shortly after the request.
+		if !recorded && len(certificate.DomainValidationOptions) > 0 && certificate.DomainValidationOptions[0].ResourceRecord != nil {
+			rr := certificate.DomainValidationOptions[0].ResourceRecord
+			record := dnsRecord{
+				Name:  strings.TrimSuffix(aws.ToString(rr.Name), "."),
+				Type:  string(rr.Type),
+				Value: strings.TrimSuffix(aws.ToString(rr.Value), "."),
+			}
+			if err := provider.upsert(record); err != nil {
+				fmt.Println("Got an error creating the certificate validation record:")
+				fmt.Println(err)
+				return ""
+			}
+			emit(eventDNSUpserted, "name", record.Name, "type", record.Type, "value", record.Value)
+			state.DNSRecords = append(state.DNSRecords, record)
+			saveStackState(state)
+			recorded = true
+			fmt.Println("Waiting for ACM to validate the certificate for " + state.Domain)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// deleteCertificate deletes a certificate the stack requested. It can only
+// go once the load balancer no longer uses it, which ACM notices a little
+// after the load balancer is deleted.
+func deleteCertificate(env *environment, arn string) bool {
+	client := acm.NewFromConfig(env.aws)
+	var err error
+	for attempt := 0; attempt < 12; attempt++ {
+		_, err = client.DeleteCertificate(context.TODO(), &acm.DeleteCertificateInput{
+			CertificateArn: aws.String(arn),
+		})
+		if !isErrorCode(err, "ResourceInUseException") {
+			break
+		}
+		time.Sleep(10 * time.Second)
+	}
+	if err != nil && !isErrorCode(err, "ResourceNotFoundException") {
+		fmt.Println("Got an error deleting the certificate:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
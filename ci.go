@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ciMode is set by -ci. Nothing waits for a person then: prompts are
+// refused, so destructive actions need -yes, and no browser is opened.
+var ciMode bool
+
+// writeOutputs passes the stack's details on to later workflow steps through
+// the file GitHub Actions names in GITHUB_OUTPUT. The keys are the hook
+// variables without the AWS_WP_ prefix, in lower case: url, instance_id, ...
+func writeOutputs(state *stackState) {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if !ciMode || path == "" {
+		return
+	}
+
+	vars := state.vars()
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("Got an error writing the step outputs:")
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+
+	for _, k := range keys {
+		fmt.Fprintf(f, "%s=%s\n", strings.ToLower(strings.TrimPrefix(k, "AWS_WP_")), vars[k])
+	}
+}
+
+// maskSecret keeps a secret out of the workflow log: GitHub Actions replaces
+// every later occurrence of it with ***.
+func maskSecret(secret string) {
+	if !ciMode || secret == "" || os.Getenv("GITHUB_ACTIONS") != "true" {
+		return
+	}
+	for _, line := range strings.Split(secret, "\n") {
+		if line != "" {
+			fmt.Fprintf(os.Stderr, "::add-mask::%s\n", line)
+		}
+	}
+}
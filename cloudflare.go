@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflareProvider struct {
+	client *http.Client
+	token  string
+	zoneId string
+}
+
+type cloudflareRecord struct {
+	Id      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// newCloudflareProvider looks up the most specific zone the token can see
+// that contains domain.
+func newCloudflareProvider(client *http.Client, token string, domain string) (*cloudflareProvider, error) {
+	p := &cloudflareProvider{client: client, token: token}
+	for _, candidate := range zoneCandidates(domain) {
+		var zones []struct {
+			Id string `json:"id"`
+		}
+		if err := p.call("GET", "/zones?name="+url.QueryEscape(candidate), nil, &zones); err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			p.zoneId = zones[0].Id
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no Cloudflare zone the token can access contains %s", domain)
+}
+
+// call sends a request to the Cloudflare API and decodes the result of the
+// response envelope into result.
+func (p *cloudflareProvider) call(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, resp.Status)
+	}
+	if !envelope.Success {
+		messages := make([]string, len(envelope.Errors))
+		for i, e := range envelope.Errors {
+			messages[i] = fmt.Sprintf("%s (%d)", e.Message, e.Code)
+		}
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, strings.Join(messages, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+func (p *cloudflareProvider) find(record dnsRecord) (string, error) {
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	var records []cloudflareRecord
+	if err := p.call("GET", "/zones/"+p.zoneId+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0].Id, nil
+}
+
+// upsert keeps records DNS only, not proxied: a proxied record would put
+// Cloudflare in front of WordPress, which -behind-proxy is for.
+func (p *cloudflareProvider) upsert(record dnsRecord) error {
+	id, err := p.find(record)
+	if err != nil {
+		return err
+	}
+	body := cloudflareRecord{Type: record.Type, Name: record.Name, Content: record.Value, TTL: dnsTTL}
+	if id == "" {
+		return p.call("POST", "/zones/"+p.zoneId+"/dns_records", body, nil)
+	}
+	return p.call("PUT", "/zones/"+p.zoneId+"/dns_records/"+id, body, nil)
+}
+
+func (p *cloudflareProvider) delete(record dnsRecord) error {
+	id, err := p.find(record)
+	if err != nil || id == "" {
+		return err
+	}
+	return p.call("DELETE", "/zones/"+p.zoneId+"/dns_records/"+id, nil, nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read from the working directory when -config is not
+// given.
+const defaultConfigFile = "aws-wp.yaml"
+
+// fileConfig is the YAML configuration file. A minimal example:
+//
+//	hooks:
+//	  before:launch:
+//	    - run: ./cmdb.sh check "$AWS_WP_STACK"
+//	  after:ready:
+//	    - run: curl -fsS "$AWS_WP_URL" > /dev/null
+//	    - ssm: wp --path=/var/www/html plugin list
+//	  after:destroy:
+//	    - run: ./cmdb.sh deregister "$AWS_WP_INSTANCE_ID"
+//	notify:
+//	  - type: slack
+//	    url: https://hooks.slack.com/services/...
+//	  - type: sns
+//	    topic_arn: arn:aws:sns:eu-west-1:123456789012:wordpress
+//	    events: [health.failed, alb.traffic_rolled_back]
+//
+//	language: de
+//	formats:
+//	  list: "{{range .}}{{.Name}}\t{{.Environment}}\t{{.URL}}\n{{end}}"
+//	required_tags: [CostCenter, Owner, DataClass]
+//	wp_config:
+//	  WP_DEBUG: false
+//	  FS_METHOD: direct
+//	  STRIPE_SECRET_KEY:
+//	    secret: wordpress/stripe
+//	    key: secret_key
+//
+// Notify sinks are sns, slack, webhook (url, gets the event as JSON) and
+// ses (from, to). Without events they get defaultNotifyEvents; "*" is all.
+// Language selects the message catalog and formats replace the layouts of
+// list and status, see defaultMessages and defaultListFormat. Releases is
+// the URL self-update and pinned bootstrap scripts come from, see
+// releaseBase. create refuses stacks without the required tags and audit
+// lists resources without them. The wp_config constants are set in
+// wp-config.php when instances boot, see wpConstant; create and replace
+// take them from the config, replace keeps the stack's when it has none.
+type fileConfig struct {
+	Hooks    map[string][]hook `yaml:"hooks"`
+	Notify   []notifyConfig    `yaml:"notify"`
+	Language string            `yaml:"language"`
+	Formats  map[string]string `yaml:"formats"`
+	Releases string            `yaml:"releases"`
+
+	RequiredTags []string              `yaml:"required_tags"`
+	WPConfig     map[string]wpConstant `yaml:"wp_config"`
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return &fileConfig{}, nil
+		}
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	c := &fileConfig{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateHooks(c.Hooks); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateNotify(c.Notify); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateFormats(c.Formats); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateWPConfig(c.WPConfig); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
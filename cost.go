@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ce "github.com/aws/aws-sdk-go-v2/service/costexplorer"
+	cetypes "github.com/aws/aws-sdk-go-v2/service/costexplorer/types"
+)
+
+// Cost Explorer is served from a single region whatever the stack's region is.
+const costExplorerRegion = "us-east-1"
+
+// cost shows what the stack has cost over the last -days and how much of the
+// usage of its instance type is covered by Reserved Instances and Savings
+// Plans. Coverage is account-wide for the instance type in the stack's
+// region, Cost Explorer cannot narrow it down to a single instance.
+func cost(args []string) {
+	fs := flag.NewFlagSet("cost", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	days := fs.Int("days", 30, "Number of days to look back")
+	fs.Parse(args)
+
+	if *days < 1 {
+		fmt.Println("-days must be at least 1")
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := newCostExplorerClient(env)
+
+	end := time.Now().UTC()
+	period := &cetypes.DateInterval{
+		Start: aws.String(end.AddDate(0, 0, -*days).Format("2006-01-02")),
+		End:   aws.String(end.Format("2006-01-02")),
+	}
+
+	fmt.Printf("Stack:         %s\n", state.Name)
+	fmt.Printf("Period:        last %d days\n", *days)
+
+	spend, unit, err := stackSpend(client, state.Name, period)
+	if err != nil {
+		fmt.Println("Got an error retrieving the stack's cost:")
+		fmt.Println(err)
+		return
+	}
+	if spend == 0 {
+		fmt.Printf("Cost:          none recorded, run aws-wp init-account to activate the %s cost allocation tag\n", stackTag)
+	} else {
+		fmt.Printf("Cost:          %.2f %s\n", spend, unit)
+	}
+
+	fmt.Printf("Coverage of %s in %s:\n", state.InstanceType, state.Region)
+	reserved, err := reservationCoverage(client, state.InstanceType, state.Region, period)
+	if err != nil {
+		fmt.Println("Got an error retrieving Reserved Instance coverage:")
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("  Reserved Instances: %s\n", reserved)
+
+	savingsPlans, err := savingsPlansCoverage(client, instanceFamily(state.InstanceType), state.Region, period)
+	if err != nil {
+		fmt.Println("Got an error retrieving Savings Plans coverage:")
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("  Savings Plans:      %s\n", savingsPlans)
+}
+
+// recommend shows what committing to a Savings Plan or Reserved Instance for
+// the stack's instance family would save, based on the account's usage over
+// the last 30 days.
+func recommend(args []string) {
+	fs := flag.NewFlagSet("recommend", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	term := fs.Int("term", 1, "Commitment term in years, 1 or 3")
+	payment := fs.String("payment", "no-upfront", "Payment option: no-upfront, partial-upfront or all-upfront")
+	fs.Parse(args)
+
+	termInYears := cetypes.TermInYearsOneYear
+	switch *term {
+	case 1:
+	case 3:
+		termInYears = cetypes.TermInYearsThreeYears
+	default:
+		fmt.Println("-term must be 1 or 3")
+		os.Exit(2)
+	}
+	paymentOption := cetypes.PaymentOption(strings.ToUpper(strings.ReplaceAll(*payment, "-", "_")))
+	switch paymentOption {
+	case cetypes.PaymentOptionNoUpfront, cetypes.PaymentOptionPartialUpfront, cetypes.PaymentOptionAllUpfront:
+	default:
+		fmt.Printf("Unknown payment option %q\n", *payment)
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := newCostExplorerClient(env)
+	family := instanceFamily(state.InstanceType)
+
+	spResult, err := client.GetSavingsPlansPurchaseRecommendation(context.TODO(), &ce.GetSavingsPlansPurchaseRecommendationInput{
+		SavingsPlansType:     cetypes.SupportedSavingsPlansTypeEc2InstanceSp,
+		TermInYears:          termInYears,
+		PaymentOption:        paymentOption,
+		LookbackPeriodInDays: cetypes.LookbackPeriodInDaysThirtyDays,
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving Savings Plans recommendations:")
+		fmt.Println(err)
+		return
+	}
+
+	found := false
+	if recommendation := spResult.SavingsPlansPurchaseRecommendation; recommendation != nil {
+		for _, detail := range recommendation.SavingsPlansPurchaseRecommendationDetails {
+			sp := detail.SavingsPlansDetails
+			if sp == nil || aws.ToString(sp.InstanceFamily) != family || aws.ToString(sp.Region) != state.Region {
+				continue
+			}
+			found = true
+			fmt.Printf("EC2 Instance Savings Plan for %s in %s: commit %s %s/hour, save about %s %s/month (%s%%)\n",
+				family, state.Region,
+				aws.ToString(detail.HourlyCommitmentToPurchase), aws.ToString(detail.CurrencyCode),
+				aws.ToString(detail.EstimatedMonthlySavingsAmount), aws.ToString(detail.CurrencyCode),
+				aws.ToString(detail.EstimatedSavingsPercentage))
+		}
+	}
+
+	riResult, err := client.GetReservationPurchaseRecommendation(context.TODO(), &ce.GetReservationPurchaseRecommendationInput{
+		Service:              aws.String("Amazon Elastic Compute Cloud - Compute"),
+		TermInYears:          termInYears,
+		PaymentOption:        paymentOption,
+		LookbackPeriodInDays: cetypes.LookbackPeriodInDaysThirtyDays,
+		ServiceSpecification: &cetypes.ServiceSpecification{
+			EC2Specification: &cetypes.EC2Specification{OfferingClass: cetypes.OfferingClassStandard},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving Reserved Instance recommendations:")
+		fmt.Println(err)
+		return
+	}
+
+	for _, recommendation := range riResult.Recommendations {
+		for _, detail := range recommendation.RecommendationDetails {
+			if detail.InstanceDetails == nil || detail.InstanceDetails.EC2InstanceDetails == nil {
+				continue
+			}
+			instance := detail.InstanceDetails.EC2InstanceDetails
+			if aws.ToString(instance.Family) != family || aws.ToString(instance.Region) != state.Region {
+				continue
+			}
+			found = true
+			fmt.Printf("Reserved Instance: buy %s x %s, save about %s %s/month (%s%%)\n",
+				aws.ToString(detail.RecommendedNumberOfInstancesToPurchase), aws.ToString(instance.InstanceType),
+				aws.ToString(detail.EstimatedMonthlySavingsAmount), aws.ToString(detail.CurrencyCode),
+				aws.ToString(detail.EstimatedMonthlySavingsPercentage))
+		}
+	}
+
+	if !found {
+		fmt.Printf("No commitment recommended for %s in %s, usage may already be covered or too low\n", family, state.Region)
+	}
+}
+
+func newCostExplorerClient(env *environment) *ce.Client {
+	return ce.NewFromConfig(env.aws, func(o *ce.Options) {
+		o.Region = costExplorerRegion
+	})
+}
+
+// stackSpend sums the unblended cost of everything carrying the stack tag.
+func stackSpend(client *ce.Client, stack string, period *cetypes.DateInterval) (float64, string, error) {
+	result, err := client.GetCostAndUsage(context.TODO(), &ce.GetCostAndUsageInput{
+		TimePeriod:  period,
+		Granularity: cetypes.GranularityMonthly,
+		Metrics:     []string{"UnblendedCost"},
+		Filter: &cetypes.Expression{
+			Tags: &cetypes.TagValues{
+				Key:    aws.String(stackTag),
+				Values: []string{stack},
+			},
+		},
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	total, unit := 0.0, ""
+	for _, r := range result.ResultsByTime {
+		if m, ok := r.Total["UnblendedCost"]; ok {
+			total += parseAmount(m.Amount)
+			unit = aws.ToString(m.Unit)
+		}
+	}
+	return total, unit, nil
+}
+
+func reservationCoverage(client *ce.Client, instanceType string, region string, period *cetypes.DateInterval) (string, error) {
+	result, err := client.GetReservationCoverage(context.TODO(), &ce.GetReservationCoverageInput{
+		TimePeriod: period,
+		Filter: &cetypes.Expression{
+			And: []cetypes.Expression{
+				{Dimensions: &cetypes.DimensionValues{Key: cetypes.DimensionInstanceType, Values: []string{instanceType}}},
+				{Dimensions: &cetypes.DimensionValues{Key: cetypes.DimensionRegion, Values: []string{region}}},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Total == nil || result.Total.CoverageHours == nil || parseAmount(result.Total.CoverageHours.TotalRunningHours) == 0 {
+		return "no usage", nil
+	}
+
+	hours := result.Total.CoverageHours
+	return fmt.Sprintf("%.0f%% of %.0f hours", parseAmount(hours.CoverageHoursPercentage), parseAmount(hours.TotalRunningHours)), nil
+}
+
+func savingsPlansCoverage(client *ce.Client, family string, region string, period *cetypes.DateInterval) (string, error) {
+	input := &ce.GetSavingsPlansCoverageInput{
+		TimePeriod:  period,
+		Granularity: cetypes.GranularityMonthly,
+		Filter: &cetypes.Expression{
+			And: []cetypes.Expression{
+				{Dimensions: &cetypes.DimensionValues{Key: cetypes.DimensionInstanceTypeFamily, Values: []string{family}}},
+				{Dimensions: &cetypes.DimensionValues{Key: cetypes.DimensionRegion, Values: []string{region}}},
+			},
+		},
+	}
+
+	covered, total := 0.0, 0.0
+	for {
+		result, err := client.GetSavingsPlansCoverage(context.TODO(), input)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range result.SavingsPlansCoverages {
+			if c.Coverage != nil {
+				covered += parseAmount(c.Coverage.SpendCoveredBySavingsPlans)
+				total += parseAmount(c.Coverage.TotalCost)
+			}
+		}
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+
+	if total == 0 {
+		return "no usage", nil
+	}
+	return fmt.Sprintf("%.0f%% of %.2f spend", 100*covered/total, total), nil
+}
+
+// instanceFamily returns "t3" for "t3.micro".
+func instanceFamily(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
+
+// parseAmount reads the decimal strings Cost Explorer reports amounts in.
+func parseAmount(s *string) float64 {
+	v, _ := strconv.ParseFloat(aws.ToString(s), 64)
+	return v
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// costAllocationTags are the tags cost reports group the stacks by.
+var costAllocationTags = []string{stackTag}
+
+type costAllocationTagStatus struct {
+	TagKey string `json:"TagKey"`
+	Status string `json:"Status"`
+}
+
+type costAllocationTagError struct {
+	TagKey  string `json:"TagKey"`
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// initAccount prepares the account for the tool. For now that is activating
+// the cost allocation tags, without which Cost Explorer cannot break costs
+// down by stack.
+func initAccount(args []string) {
+	fs := flag.NewFlagSet("init-account", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	failed, err := activateCostAllocationTags(env, costAllocationTags)
+	if err != nil {
+		fmt.Println("Got an error activating the cost allocation tags:")
+		fmt.Println(err)
+		return
+	}
+	for _, tag := range costAllocationTags {
+		if e, ok := failed[tag]; ok {
+			fmt.Printf("Could not activate cost allocation tag %s: %s\n", tag, e.Message)
+			if strings.Contains(e.Code, "NotFound") {
+				fmt.Println("Tags show up in billing about a day after the first stack is created, run init-account again then")
+			}
+			continue
+		}
+		fmt.Printf("Activated cost allocation tag %s\n", tag)
+	}
+}
+
+// activateCostAllocationTags calls UpdateCostAllocationTagsStatus, which the
+// Cost Explorer client of the SDK version in use does not have yet, as a
+// signed request of its own. It returns the tags that could not be
+// activated. The request bypasses the SDK middleware, so it refuses
+// -read-only itself.
+func activateCostAllocationTags(env *environment, tags []string) (map[string]costAllocationTagError, error) {
+	if readOnly {
+		emit(eventWriteRefused, "service", "Cost Explorer", "operation", "UpdateCostAllocationTagsStatus")
+		return nil, &writeRefusedError{service: "Cost Explorer", operation: "UpdateCostAllocationTagsStatus"}
+	}
+	statuses := make([]costAllocationTagStatus, len(tags))
+	for i, tag := range tags {
+		statuses[i] = costAllocationTagStatus{TagKey: tag, Status: "Active"}
+	}
+	body, err := json.Marshal(map[string]interface{}{"CostAllocationTagsStatus": statuses})
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := env.aws.Credentials.Retrieve(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", "https://ce."+costExplorerRegion+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "AWSInsightsIndexService.UpdateCostAllocationTagsStatus")
+
+	hash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(context.TODO(), credentials, request, hex.EncodeToString(hash[:]), "ce", costExplorerRegion, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := env.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	payload, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		var apiError struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(payload, &apiError)
+		return nil, fmt.Errorf("%s: %s", response.Status, apiError.Message)
+	}
+
+	var result struct {
+		Errors []costAllocationTagError `json:"Errors"`
+	}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return nil, err
+	}
+
+	failed := map[string]costAllocationTagError{}
+	for _, e := range result.Errors {
+		failed[e.TagKey] = e
+	}
+	return failed, nil
+}
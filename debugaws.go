@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// addDebugMiddleware logs every AWS call for -debug-aws: the operation,
+// its region, how long it took including retries, the HTTP status of the
+// last attempt and the request IDs AWS support asks for. Parameters are
+// not logged, they may hold secrets. Like addPermissionMiddleware it runs
+// once the SDK has recorded the operation.
+func addDebugMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("aws-wp:debug", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(ctx, in)
+
+		fields := []string{
+			awsmiddleware.GetServiceID(ctx) + ":" + awsmiddleware.GetOperationName(ctx),
+			"region=" + awsmiddleware.GetRegion(ctx),
+			"duration=" + time.Since(start).Round(time.Millisecond).String(),
+		}
+		if response, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+			fields = append(fields, fmt.Sprintf("status=%d", response.StatusCode))
+			// S3 identifies requests by a second, extended ID as well.
+			if hostId := response.Header.Get("X-Amz-Id-2"); hostId != "" {
+				fields = append(fields, "host-id="+hostId)
+			}
+		}
+		requestId, ok := awsmiddleware.GetRequestIDMetadata(metadata)
+		var responseErr *awshttp.ResponseError
+		if !ok && errors.As(err, &responseErr) {
+			requestId, ok = responseErr.ServiceRequestID(), true
+		}
+		if ok && requestId != "" {
+			fields = append(fields, "request-id="+requestId)
+		}
+		if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 1 {
+			fields = append(fields, fmt.Sprintf("attempts=%d", len(attempts.Results)))
+		}
+		if err != nil {
+			fields = append(fields, "error="+fmt.Sprintf("%q", err.Error()))
+		}
+		log.Printf("aws: %s", strings.Join(fields, " "))
+		return out, metadata, err
+	}), middleware.After)
+}
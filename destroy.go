@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/smithy-go"
+)
+
+func destroy(args []string) {
+	fs := flag.NewFlagSet("destroy", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	yes := fs.Bool("yes", false, "Confirm the destruction, required with -ci")
+	keepLogs := fs.Bool("keep-logs", false, "Keep the load balancer access log bucket")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if ciMode && !*yes {
+		fmt.Println("Refusing to destroy the stack in -ci mode without -yes")
+		os.Exit(2)
+	}
+	destroyStack(env, *keepLogs)
+}
+
+// destroyStack deletes everything of env's stack and then its state. What
+// it could not delete stays in the state, so running it again carries on.
+func destroyStack(env *environment, keepLogs bool) {
+	unlock := lockStack(env.name, "destroy")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	if !deleteDNSRecords(env, state) {
+		return
+	}
+
+	if state.LoadBalancer != nil {
+		if state.LoadBalancer.WebACLArn != "" {
+			ok := deleteWebACL(wafv2.NewFromConfig(env.aws), state.Name, state.LoadBalancer)
+			saveStackState(state)
+			if !ok {
+				return
+			}
+		}
+		if !deleteLoadBalancer(elb.NewFromConfig(env.aws), state.LoadBalancer) {
+			return
+		}
+		if bucket := state.LoadBalancer.AccessLogBucket; bucket != "" {
+			if keepLogs {
+				fmt.Println("Keeping the access logs in bucket " + bucket)
+			} else if !deleteBucket(s3.NewFromConfig(env.aws), bucket) {
+				return
+			}
+		}
+		state.LoadBalancer = nil
+		saveStackState(state)
+	}
+
+	if state.CertificateArn != "" {
+		if !deleteCertificate(env, state.CertificateArn) {
+			return
+		}
+		state.CertificateArn = ""
+		saveStackState(state)
+	}
+
+	if state.ElasticIp != nil {
+		if !state.ElasticIp.detach(client, env.name) {
+			saveStackState(state)
+			return
+		}
+		state.ElasticIp = nil
+	}
+
+	if state.InstanceId != "" && !terminateInstance(client, state.InstanceId) {
+		return
+	}
+
+	leftover, ok := interruptedLaunch(client, state)
+	if !ok || (leftover != "" && !terminateInstance(client, leftover)) {
+		return
+	}
+
+	if !deleteStackInterfaces(client, env.name) {
+		return
+	}
+
+	if state.ReportProgress && !deleteProgressParameter(ssm.NewFromConfig(env.aws), env.name) {
+		return
+	}
+
+	if state.BasicAuthSecret != "" && !deleteSecret(secretsmanager.NewFromConfig(env.aws), state.BasicAuthSecret) {
+		return
+	}
+
+	if secret := state.HealthCheck.AuthSecret; secret != "" && secret != state.BasicAuthSecret && !deleteSecret(secretsmanager.NewFromConfig(env.aws), secret) {
+		return
+	}
+
+	if state.RecoveryAlarm != "" && !deleteAlarms(cloudwatch.NewFromConfig(env.aws), state.RecoveryAlarm) {
+		return
+	}
+
+	if state.DiskAlarm != "" && !deleteAlarms(cloudwatch.NewFromConfig(env.aws), state.DiskAlarm) {
+		return
+	}
+
+	if len(state.LogAlarms) > 0 && !deleteLogMetrics(env, state) {
+		return
+	}
+
+	if state.StatusPage != nil && !deleteStatusPage(env, state) {
+		return
+	}
+
+	if state.UptimeCheck != "" && !deleteUptimeCheck(env, state) {
+		return
+	}
+
+	if state.SecurityGroupId != "" && !deleteSecurityGroup(client, state.SecurityGroupId, env.name) {
+		return
+	}
+
+	if err := removeState(env.name); err != nil {
+		fmt.Println("Got an error removing the stack state:")
+		fmt.Println(err)
+		return
+	}
+
+	if err := runHooks(env.aws, env.config.Hooks, hookAfterDestroy, state.vars()); err != nil {
+		fmt.Println("Got an error running hooks:")
+		fmt.Println(err)
+	}
+}
+
+// terminateInstance terminates the instance and waits until it is gone, so
+// the security group can be deleted afterwards.
+func terminateInstance(client *ec2.Client, instanceId string) bool {
+	_, err := client.TerminateInstances(context.TODO(), &ec2.TerminateInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if isErrorCode(err, "InvalidInstanceID.NotFound") {
+		return true
+	}
+	if err != nil {
+		fmt.Println("Got an error terminating the instance:")
+		fmt.Println(err)
+		return false
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}
+
+	for {
+		result, err := client.DescribeInstances(context.TODO(), input)
+		if err != nil {
+			fmt.Println("Got an error retrieving information about your Amazon EC2 instances:")
+			fmt.Println(err)
+			return false
+		}
+
+		for _, r := range result.Reservations {
+			for _, i := range r.Instances {
+				// terminated
+				if *i.State.Code == 48 {
+					emit(eventInstanceTerminated, "instance_id", instanceId)
+					return true
+				}
+				log.Printf("Still shutting down...")
+			}
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// deleteSecurityGroup deletes the group if the stack created it. Groups
+// without the stack tag were made by someone else and are left alone.
+func deleteSecurityGroup(client *ec2.Client, groupId string, stack string) bool {
+	describe, err := client.DescribeSecurityGroups(context.TODO(), &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []string{groupId},
+	})
+	if isErrorCode(err, "InvalidGroup.NotFound") {
+		return true
+	}
+	if err != nil {
+		fmt.Println("Got an error retrieving information about security group:")
+		fmt.Println(err)
+		return false
+	}
+
+	if !hasStackTag(describe.SecurityGroups[0].Tags, stack) {
+		log.Printf("Keeping security group %s, it does not belong to stack %s", groupId, stack)
+		return true
+	}
+
+	// A wordpress-sg adopted from an earlier version may still hold other
+	// instances, like those migrated into other stacks. The group stays
+	// and goes to one of those stacks, whose destroy deletes it once the
+	// last of them is gone.
+	others, err := client.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("instance.group-id"), Values: []string{groupId}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the instances in the security group:")
+		fmt.Println(err)
+		return false
+	}
+	var users []string
+	var heir string
+	for _, r := range others.Reservations {
+		for _, i := range r.Instances {
+			users = append(users, aws.ToString(i.InstanceId))
+			if owner := tagValue(i.Tags, stackTag); heir == "" && owner != "" && owner != stack {
+				heir = owner
+			}
+		}
+	}
+	if len(users) > 0 {
+		fmt.Printf("Keeping security group %s, instances %s still use it\n", groupId, strings.Join(users, ", "))
+		if heir == "" {
+			return true
+		}
+		_, err := client.CreateTags(context.TODO(), &ec2.CreateTagsInput{
+			Resources: []string{groupId},
+			Tags:      []types.Tag{stackTagFor(heir)},
+		})
+		if err != nil {
+			fmt.Println("Got an error tagging the security group:")
+			fmt.Println(err)
+			return false
+		}
+		log.Printf("Security group %s now belongs to stack %s", groupId, heir)
+		return true
+	}
+
+	// The group stays attached to the network interface for a little while
+	// after the instance is terminated.
+	for attempt := 0; ; attempt++ {
+		_, err = client.DeleteSecurityGroup(context.TODO(), &ec2.DeleteSecurityGroupInput{
+			GroupId: aws.String(groupId),
+		})
+		if err == nil || isErrorCode(err, "InvalidGroup.NotFound") {
+			emit(eventSecurityGroupDeleted, "group_id", groupId)
+			return true
+		}
+		if !isErrorCode(err, "DependencyViolation") || attempt == 20 {
+			fmt.Println("Got an error deleting the security group:")
+			fmt.Println(err)
+			return false
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// isErrorCode reports whether err is an AWS API error with the given code.
+func isErrorCode(err error, code string) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == code
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// distro is an operating system whose stock images -os installs WordPress
+// on. installer names the bootstrap/install-*.sh template that sets up the
+// web server, PHP and the database with the distro's packages.
+type distro struct {
+	installer string
+
+	// imageParameters are the public SSM parameters holding the current
+	// image id, by architecture.
+	imageParameters map[types.ArchitectureType]string
+}
+
+var distros = map[string]distro{
+	"al2023": {
+		installer: "dnf",
+		imageParameters: map[types.ArchitectureType]string{
+			types.ArchitectureTypeX8664: "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64",
+			types.ArchitectureTypeArm64: "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64",
+		},
+	},
+	"ubuntu": {
+		installer: "apt",
+		imageParameters: map[types.ArchitectureType]string{
+			types.ArchitectureTypeX8664: "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+			types.ArchitectureTypeArm64: "/aws/service/canonical/ubuntu/server/22.04/stable/current/arm64/hvm/ebs-gp2/ami-id",
+		},
+	},
+	"debian": {
+		installer: "apt",
+		imageParameters: map[types.ArchitectureType]string{
+			types.ArchitectureTypeX8664: "/aws/service/debian/release/12/latest/amd64",
+			types.ArchitectureTypeArm64: "/aws/service/debian/release/12/latest/arm64",
+		},
+	},
+}
+
+func validateDistro(name string) error {
+	if _, ok := distros[name]; name != "" && !ok {
+		return fmt.Errorf("unknown -os %q, expected al2023, ubuntu or debian", name)
+	}
+	return nil
+}
+
+// instanceArchitectures returns the architectures the instance type runs.
+func instanceArchitectures(client *ec2.Client, instanceType string) []types.ArchitectureType {
+	result, err := client.DescribeInstanceTypes(context.TODO(), &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	})
+	if err != nil || len(result.InstanceTypes) == 0 {
+		fmt.Println("Got an error retrieving information about the instance type:")
+		fmt.Println(instanceType, err)
+		return nil
+	}
+	return result.InstanceTypes[0].ProcessorInfo.SupportedArchitectures
+}
+
+// stockImage looks up the current image of the distro for the instance
+// type's architecture.
+func stockImage(client *ec2.Client, ssmClient *ssm.Client, name string, instanceType string) string {
+	architectures := instanceArchitectures(client, instanceType)
+	if architectures == nil {
+		return ""
+	}
+
+	d := distros[name]
+	for _, arch := range architectures {
+		parameter, ok := d.imageParameters[arch]
+		if !ok {
+			continue
+		}
+
+		image, err := ssmClient.GetParameter(context.TODO(), &ssm.GetParameterInput{
+			Name: aws.String(parameter),
+		})
+		if err != nil {
+			fmt.Println("Got an error looking up the " + name + " image:")
+			fmt.Println(err)
+			return ""
+		}
+		return aws.ToString(image.Parameter.Value)
+	}
+
+	fmt.Printf("No %s image for %s, which is %s\n", name, instanceType, strings.Trim(fmt.Sprint(architectures), "[]"))
+	return ""
+}
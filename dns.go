@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// dnsTTL is short so the record follows the instance quickly when its
+// address changes.
+const dnsTTL = 60
+
+// dnsRecord is a record the stack manages in its domain's zone. With an
+// AliasZone it is a Route 53 alias to the name in Value, which is hosted in
+// that zone.
+type dnsRecord struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	AliasZone string `json:"alias_zone,omitempty"`
+}
+
+// dnsProvider manages records in the zone that holds a domain, wherever the
+// zone is hosted.
+type dnsProvider interface {
+	upsert(record dnsRecord) error
+	delete(record dnsRecord) error
+}
+
+// dnsProviders are the values of -dns.
+const (
+	dnsRoute53    = "route53"
+	dnsCloudflare = "cloudflare"
+)
+
+func validateDNSProvider(name string) error {
+	switch name {
+	case dnsRoute53, dnsCloudflare:
+		return nil
+	}
+	return fmt.Errorf("unknown -dns %q, expected route53 or cloudflare", name)
+}
+
+// newDNSProvider finds the zone of domain with the named provider.
+// Cloudflare takes an API token with DNS edit permission from
+// $CLOUDFLARE_API_TOKEN.
+func newDNSProvider(env *environment, name string, domain string) (dnsProvider, error) {
+	switch name {
+	case dnsRoute53:
+		return newRoute53Provider(route53.NewFromConfig(env.aws), domain)
+	case dnsCloudflare:
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("set CLOUDFLARE_API_TOKEN to manage DNS records in Cloudflare")
+		}
+		return newCloudflareProvider(env.http, token, domain)
+	}
+	return nil, validateDNSProvider(name)
+}
+
+// siteRecord points the stack's domain at its load balancer, Elastic IP or
+// instance, in that order. Without an Elastic IP the instance's address
+// changes, so the record follows its public DNS name. On Route 53 the load
+// balancer gets an alias, which unlike a CNAME also works at the zone apex.
+func siteRecord(state *stackState) dnsRecord {
+	switch {
+	case state.LoadBalancer != nil && state.DNSProvider == dnsRoute53 && state.LoadBalancer.HostedZoneId != "":
+		return dnsRecord{Name: state.Domain, Type: "A", Value: state.LoadBalancer.DNSName, AliasZone: state.LoadBalancer.HostedZoneId}
+	case state.LoadBalancer != nil:
+		return dnsRecord{Name: state.Domain, Type: "CNAME", Value: state.LoadBalancer.DNSName}
+	case state.ElasticIp != nil:
+		return dnsRecord{Name: state.Domain, Type: "A", Value: state.ElasticIp.PublicIp}
+	}
+	return dnsRecord{Name: state.Domain, Type: "CNAME", Value: state.PublicDnsName}
+}
+
+// updateSiteRecord upserts the site record when the stack has a domain and
+// the record's target changed, and keeps it in the state so destroy can
+// remove it.
+func updateSiteRecord(env *environment, state *stackState) bool {
+	if state.Domain == "" {
+		return true
+	}
+	record := siteRecord(state)
+	if record.Value == "" {
+		fmt.Println("The stack has no public address to point " + state.Domain + " at")
+		return false
+	}
+	for _, r := range state.DNSRecords {
+		if r == record {
+			return true
+		}
+	}
+
+	provider, err := newDNSProvider(env, state.DNSProvider, state.Domain)
+	if err != nil {
+		fmt.Println("Got an error finding the DNS zone:")
+		fmt.Println(err)
+		return false
+	}
+	// A CNAME cannot sit next to other records of the name, so one of the
+	// other type goes first, e.g. when the stack got an Elastic IP.
+	for _, r := range state.DNSRecords {
+		if r.Name == record.Name && r.Type != record.Type {
+			if err := provider.delete(r); err != nil {
+				fmt.Println("Got an error deleting the old DNS record:")
+				fmt.Println(err)
+				return false
+			}
+		}
+	}
+	if err := provider.upsert(record); err != nil {
+		fmt.Println("Got an error updating the DNS record:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventDNSUpserted, "name", record.Name, "type", record.Type, "value", record.Value)
+
+	records := []dnsRecord{record}
+	for _, r := range state.DNSRecords {
+		if r.Name != record.Name {
+			records = append(records, r)
+		}
+	}
+	state.DNSRecords = records
+	saveStackState(state)
+	return true
+}
+
+// deleteDNSRecords removes the records the stack created.
+func deleteDNSRecords(env *environment, state *stackState) bool {
+	if len(state.DNSRecords) == 0 {
+		return true
+	}
+	provider, err := newDNSProvider(env, state.DNSProvider, state.Domain)
+	if err != nil {
+		fmt.Println("Got an error finding the DNS zone:")
+		fmt.Println(err)
+		return false
+	}
+	for len(state.DNSRecords) > 0 {
+		record := state.DNSRecords[0]
+		if err := provider.delete(record); err != nil {
+			fmt.Println("Got an error deleting the DNS record:")
+			fmt.Println(err)
+			return false
+		}
+		emit(eventDNSDeleted, "name", record.Name, "type", record.Type)
+		state.DNSRecords = state.DNSRecords[1:]
+		saveStackState(state)
+	}
+	return true
+}
+
+// zoneCandidates lists the names the zone of domain may have, longest
+// first: www.blog.example.com, blog.example.com, example.com.
+func zoneCandidates(domain string) []string {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	var candidates []string
+	for i := 0; i < len(labels)-1; i++ {
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	return candidates
+}
+
+type route53Provider struct {
+	client *route53.Client
+	zoneId string
+}
+
+// newRoute53Provider picks the most specific public hosted zone of the
+// account that contains domain.
+func newRoute53Provider(client *route53.Client, domain string) (*route53Provider, error) {
+	zones := map[string]string{}
+	paginator := route53.NewListHostedZonesPaginator(client, &route53.ListHostedZonesInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, zone := range page.HostedZones {
+			if zone.Config != nil && zone.Config.PrivateZone {
+				continue
+			}
+			zones[strings.TrimSuffix(aws.ToString(zone.Name), ".")] = aws.ToString(zone.Id)
+		}
+	}
+
+	for _, candidate := range zoneCandidates(domain) {
+		if id, ok := zones[candidate]; ok {
+			return &route53Provider{client: client, zoneId: id}, nil
+		}
+	}
+	return nil, fmt.Errorf("no public Route 53 hosted zone contains %s", domain)
+}
+
+func (p *route53Provider) change(action types.ChangeAction, record dnsRecord) error {
+	recordSet := &types.ResourceRecordSet{
+		Name:            aws.String(record.Name),
+		Type:            types.RRType(record.Type),
+		TTL:             aws.Int64(dnsTTL),
+		ResourceRecords: []types.ResourceRecord{{Value: aws.String(record.Value)}},
+	}
+	if record.AliasZone != "" {
+		recordSet = &types.ResourceRecordSet{
+			Name: aws.String(record.Name),
+			Type: types.RRType(record.Type),
+			AliasTarget: &types.AliasTarget{
+				HostedZoneId: aws.String(record.AliasZone),
+				DNSName:      aws.String(record.Value),
+			},
+		}
+	}
+
+	_, err := p.client.ChangeResourceRecordSets(context.TODO(), &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(p.zoneId),
+		ChangeBatch: &types.ChangeBatch{
+			Comment: aws.String("aws-wp"),
+			Changes: []types.Change{
+				{
+					Action:            action,
+					ResourceRecordSet: recordSet,
+				},
+			},
+		},
+	})
+	return err
+}
+
+func (p *route53Provider) upsert(record dnsRecord) error {
+	return p.change(types.ChangeActionUpsert, record)
+}
+
+// delete needs the record exactly as it was created. Records already gone
+// count as deleted.
+func (p *route53Provider) delete(record dnsRecord) error {
+	err := p.change(types.ChangeActionDelete, record)
+	if isErrorCode(err, "InvalidChangeBatch") && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
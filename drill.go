@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// drillParams are the values drill.sh is rendered with.
+type drillParams struct {
+	Scenario string
+	Restore  bool
+}
+
+// drillCheck is one line of the drill report.
+type drillCheck struct {
+	name   string
+	passed bool
+	detail string
+}
+
+// drillRun is a drill in progress and what it found so far.
+type drillRun struct {
+	env     *environment
+	state   *stackState
+	probe   healthCheck
+	timeout time.Duration
+	checks  []drillCheck
+}
+
+// drill breaks the stack on purpose and checks that what should notice,
+// and what should repair it, does:
+//
+//   - stop stops the instance, then starts it again
+//   - apache kills Apache as in a crash and waits for it to come back,
+//     starting it when it does not
+//   - health has Apache answer 503 to everything, then undoes that
+//   - recover sets the recovery alarm to ALARM, which has EC2 move the
+//     instance as on a failed system status check
+//
+// The site, the Route 53 health check of sla enable and the load balancer,
+// when the stack has them, have to see it go down, except on recover, and
+// come back. The stack has a single instance, so there is nothing to fail
+// over to; the load balancer taking it out of service is what is checked.
+// The report ends with status 1 when a check failed, for CI.
+func drill(args []string) {
+	if !runDrill(args) {
+		os.Exit(1)
+	}
+}
+
+// runDrill reports whether no check failed. It returns before drill exits,
+// so that the stack is unlocked.
+func runDrill(args []string) bool {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("drill", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	scenario := fs.String("scenario", "", "The failure to simulate: stop, apache, health or recover")
+	timeout := fs.Duration("timeout", healthTimeout, "How long each check waits for the expected reaction")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+	switch *scenario {
+	case "stop", "apache", "health", "recover":
+	default:
+		fmt.Printf("Unknown -scenario %q, expected stop, apache, health or recover\n", *scenario)
+		return true
+	}
+
+	unlock := lockStack(env.name, "drill")
+	if unlock == nil {
+		return true
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return true
+	}
+	if *scenario == "recover" && state.RecoveryAlarm == "" {
+		fmt.Printf("Stack %s has no recovery alarm\n", state.Name)
+		return true
+	}
+	if (*scenario == "apache" || *scenario == "health") && state.InstanceProfile == "" {
+		fmt.Println("The apache and health drills run over SSM, which needs a stack created with -instance-profile")
+		return true
+	}
+	if !*yes && !confirm(fmt.Sprintf("Break stack %s with the %s drill? The site is down until the drill ends.", state.Name, *scenario)) {
+		return true
+	}
+
+	d := &drillRun{env: env, state: state, probe: healthCheckAuth(env, state.HealthCheck), timeout: *timeout}
+	switch *scenario {
+	case "stop":
+		d.stop()
+	case "apache":
+		d.apache()
+	case "health":
+		d.health()
+	case "recover":
+		d.recover()
+	}
+
+	return d.report()
+}
+
+func (d *drillRun) stop() {
+	client := ec2.NewFromConfig(d.env.aws)
+	if !d.check("Instance stopped", stopInstance(client, d.state.InstanceId), "") {
+		return
+	}
+	d.expectDown()
+
+	started := startInstance(client, d.state) && updateSiteRecord(d.env, d.state)
+	updateUptimeCheck(d.env, d.state)
+	if d.check("Instance started", started, "") {
+		d.expectUp()
+	}
+}
+
+func (d *drillRun) apache() {
+	if !d.runScript("Apache killed", drillParams{Scenario: "apache"}) {
+		return
+	}
+	// A restart within seconds may go unnoticed by the health checks, which
+	// is fine: the site is only checked for coming back.
+	if d.await("Apache restarted on its own", d.siteUp) {
+		return
+	}
+	d.expectDown()
+	if d.runScript("Apache started", drillParams{Scenario: "apache", Restore: true}) {
+		d.expectUp()
+	}
+}
+
+func (d *drillRun) health() {
+	if !d.runScript("Health check broken", drillParams{Scenario: "health"}) {
+		return
+	}
+	d.expectDown()
+	if d.runScript("Health check restored", drillParams{Scenario: "health", Restore: true}) {
+		d.expectUp()
+	}
+}
+
+func (d *drillRun) recover() {
+	client := cloudwatch.NewFromConfig(d.env.aws)
+	start := time.Now()
+	_, err := client.SetAlarmState(context.TODO(), &cloudwatch.SetAlarmStateInput{
+		AlarmName:   aws.String(d.state.RecoveryAlarm),
+		StateValue:  cwtypes.StateValueAlarm,
+		StateReason: aws.String("aws-wp drill"),
+	})
+	if !d.check("Recovery alarm set to ALARM", err == nil, errorText(err)) {
+		return
+	}
+	d.await("Recover action ran", func() (bool, string) {
+		return alarmActionRan(client, d.state.RecoveryAlarm, start)
+	})
+	d.expectUp()
+}
+
+// expectDown checks that the site and everything watching it see it down.
+func (d *drillRun) expectDown() {
+	if d.await("Site down", func() (bool, string) {
+		up, detail := d.siteUp()
+		return !up, detail
+	}) {
+		emit(eventHealthFailed, "url", d.state.URL, "drill", "true")
+	}
+	if d.state.UptimeCheck != "" {
+		d.await("Route 53 health check unhealthy", func() (bool, string) {
+			healthy, detail := uptimeCheckHealthy(d.env, d.state.UptimeCheck)
+			return !healthy && detail != "", detail
+		})
+	}
+	if d.state.LoadBalancer != nil {
+		d.await("Load balancer took the instance out", func() (bool, string) {
+			healthy, detail := targetHealthy(d.env, d.state)
+			return !healthy && detail != "", detail
+		})
+	}
+}
+
+// expectUp checks that the site and everything watching it see it back.
+func (d *drillRun) expectUp() {
+	if d.await("Site up", d.siteUp) {
+		emit(eventHealthOK, "url", d.state.URL, "drill", "true")
+	}
+	if d.state.UptimeCheck != "" {
+		d.await("Route 53 health check healthy", func() (bool, string) {
+			return uptimeCheckHealthy(d.env, d.state.UptimeCheck)
+		})
+	}
+	if d.state.LoadBalancer != nil {
+		d.await("Load balancer serves the instance", func() (bool, string) {
+			return targetHealthy(d.env, d.state)
+		})
+	}
+}
+
+func (d *drillRun) siteUp() (bool, string) {
+	status, err := probe(d.env.http, origin(d.state.URL)+d.probe.path(), d.probe)
+	if err != nil {
+		return false, err.Error()
+	}
+	return status < http.StatusBadRequest, fmt.Sprintf("HTTP %d", status)
+}
+
+func (d *drillRun) runScript(name string, params drillParams) bool {
+	var script strings.Builder
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "drill.sh", params); err != nil {
+		return d.check(name, false, "rendering the drill script: "+err.Error())
+	}
+	output, err := runShellScript(ssm.NewFromConfig(d.env.aws), d.state.InstanceId, script.String())
+	fmt.Print(output)
+	return d.check(name, err == nil, errorText(err))
+}
+
+func (d *drillRun) check(name string, passed bool, detail string) bool {
+	d.checks = append(d.checks, drillCheck{name: name, passed: passed, detail: detail})
+	return passed
+}
+
+// await polls cond every 10 seconds until it holds or the timeout passes.
+// cond returns whether it holds and what it saw.
+func (d *drillRun) await(name string, cond func() (bool, string)) bool {
+	start := time.Now()
+	for {
+		ok, detail := cond()
+		if ok {
+			return d.check(name, true, "after "+time.Since(start).Round(time.Second).String())
+		}
+		if time.Since(start) >= d.timeout {
+			return d.check(name, false, fmt.Sprintf("not within %s: %s", d.timeout, detail))
+		}
+		log.Printf("Waiting: %s... (%s)", name, detail)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// report prints the checks and whether all passed.
+func (d *drillRun) report() bool {
+	passed := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tCHECK\tDETAIL")
+	for _, c := range d.checks {
+		result := "PASS"
+		if !c.passed {
+			result = "FAIL"
+			passed = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result, c.name, c.detail)
+	}
+	w.Flush()
+	return passed
+}
+
+// uptimeCheckHealthy reports what Route 53 makes of the health check's
+// observations: healthy when more than 18% of its checkers see the site up.
+// The detail is empty until checkers report.
+func uptimeCheckHealthy(env *environment, id string) (bool, string) {
+	result, err := route53.NewFromConfig(env.aws).GetHealthCheckStatus(context.TODO(), &route53.GetHealthCheckStatusInput{
+		HealthCheckId: aws.String(id),
+	})
+	if err != nil {
+		return false, ""
+	}
+	total, successes := len(result.HealthCheckObservations), 0
+	for _, o := range result.HealthCheckObservations {
+		if o.StatusReport != nil && strings.HasPrefix(aws.ToString(o.StatusReport.Status), "Success") {
+			successes++
+		}
+	}
+	if total == 0 {
+		return false, ""
+	}
+	return successes*100 > total*18, fmt.Sprintf("%d of %d checkers see the site up", successes, total)
+}
+
+// targetHealthy reports the instance's state in the load balancer's target
+// group. The detail is empty when it cannot be read.
+func targetHealthy(env *environment, state *stackState) (bool, string) {
+	result, err := elb.NewFromConfig(env.aws).DescribeTargetHealth(context.TODO(), &elb.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(state.LoadBalancer.TargetGroupArn),
+		Targets:        []elbtypes.TargetDescription{{Id: aws.String(state.InstanceId)}},
+	})
+	if err != nil || len(result.TargetHealthDescriptions) == 0 {
+		return false, ""
+	}
+	health := result.TargetHealthDescriptions[0].TargetHealth
+	return health.State == elbtypes.TargetHealthStateEnumHealthy, string(health.State)
+}
+
+// alarmActionRan looks for the alarm's action in its history since start.
+func alarmActionRan(client *cloudwatch.Client, alarm string, start time.Time) (bool, string) {
+	result, err := client.DescribeAlarmHistory(context.TODO(), &cloudwatch.DescribeAlarmHistoryInput{
+		AlarmName:       aws.String(alarm),
+		HistoryItemType: cwtypes.HistoryItemTypeAction,
+		StartDate:       aws.Time(start),
+	})
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, item := range result.AlarmHistoryItems {
+		summary := aws.ToString(item.HistorySummary)
+		if strings.HasPrefix(summary, "Successfully executed action") {
+			return true, summary
+		}
+		if summary != "" {
+			return false, summary
+		}
+	}
+	return false, "no action yet"
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// elasticIp is the stack's Elastic IP. Owned is true only when the tool
+// allocated the address; destroy releases those and merely disassociates
+// addresses the user brought with -eip-allocation-id.
+type elasticIp struct {
+	AllocationId  string `json:"allocation_id"`
+	PublicIp      string `json:"public_ip"`
+	AssociationId string `json:"association_id,omitempty"`
+	Owned         bool   `json:"owned"`
+}
+
+// allocateElasticIp allocates a new address owned by the stack.
+func allocateElasticIp(client *ec2.Client, stack string) *elasticIp {
+	result, err := client.AllocateAddress(context.TODO(), &ec2.AllocateAddressInput{
+		Domain: types.DomainTypeVpc,
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeElasticIp,
+				Tags:         []types.Tag{stackTagFor(stack)},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error allocating an Elastic IP:")
+		fmt.Println(err)
+		return nil
+	}
+
+	emit(eventElasticIpAllocated, "allocation_id", aws.ToString(result.AllocationId), "public_ip", aws.ToString(result.PublicIp))
+	return &elasticIp{
+		AllocationId: aws.ToString(result.AllocationId),
+		PublicIp:     aws.ToString(result.PublicIp),
+		Owned:        true,
+	}
+}
+
+// existingElasticIp looks up an address the user already owns. It refuses
+// addresses that are in use elsewhere.
+func existingElasticIp(client *ec2.Client, allocationId string) *elasticIp {
+	result, err := client.DescribeAddresses(context.TODO(), &ec2.DescribeAddressesInput{
+		AllocationIds: []string{allocationId},
+	})
+	if err != nil || len(result.Addresses) == 0 {
+		fmt.Println("Got an error retrieving information about the Elastic IP:")
+		fmt.Println(allocationId, err)
+		return nil
+	}
+
+	address := result.Addresses[0]
+	if address.AssociationId != nil {
+		fmt.Printf("Elastic IP %s is associated with %s, disassociate it first\n",
+			aws.ToString(address.PublicIp), aws.ToString(address.InstanceId)+aws.ToString(address.NetworkInterfaceId))
+		return nil
+	}
+
+	return &elasticIp{
+		AllocationId: allocationId,
+		PublicIp:     aws.ToString(address.PublicIp),
+	}
+}
+
+// associate points the address at the instance's primary network
+// interface, taking it over from any instance it is currently associated
+// with. EC2 only takes an instance ID for instances with a single
+// interface, so the interface is passed instead.
+func (e *elasticIp) associate(client *ec2.Client, instanceId string) bool {
+	interfaceId := primaryInterface(client, instanceId)
+	if interfaceId == "" {
+		return false
+	}
+	result, err := client.AssociateAddress(context.TODO(), &ec2.AssociateAddressInput{
+		AllocationId:       aws.String(e.AllocationId),
+		NetworkInterfaceId: aws.String(interfaceId),
+		AllowReassociation: aws.Bool(true),
+	})
+	if err != nil {
+		fmt.Println("Got an error associating the Elastic IP:")
+		fmt.Println(err)
+		return false
+	}
+
+	e.AssociationId = aws.ToString(result.AssociationId)
+	emit(eventElasticIpAssociated, "public_ip", e.PublicIp, "instance_id", instanceId)
+	return true
+}
+
+// primaryInterface returns the network interface at device index 0 of the
+// instance, or an empty string when it cannot be found.
+func primaryInterface(client *ec2.Client, instanceId string) string {
+	result, err := client.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving information about the instance:")
+		fmt.Println(err)
+		return ""
+	}
+	for _, r := range result.Reservations {
+		for _, i := range r.Instances {
+			for _, n := range i.NetworkInterfaces {
+				if n.Attachment != nil && aws.ToInt32(n.Attachment.DeviceIndex) == 0 {
+					return aws.ToString(n.NetworkInterfaceId)
+				}
+			}
+		}
+	}
+	fmt.Printf("Got an error: %s has no primary network interface\n", instanceId)
+	return ""
+}
+
+// detach disassociates the address and releases it when the stack owns it.
+func (e *elasticIp) detach(client *ec2.Client, stack string) bool {
+	if e.AssociationId != "" {
+		_, err := client.DisassociateAddress(context.TODO(), &ec2.DisassociateAddressInput{
+			AssociationId: aws.String(e.AssociationId),
+		})
+		if err != nil && !isErrorCode(err, "InvalidAssociationID.NotFound") {
+			fmt.Println("Got an error disassociating the Elastic IP:")
+			fmt.Println(err)
+			return false
+		}
+		e.AssociationId = ""
+	}
+
+	if !e.Owned {
+		log.Printf("Keeping Elastic IP %s, it was not allocated by stack %s", e.PublicIp, stack)
+		return true
+	}
+
+	// Check the tag as well, so a hand-edited state cannot release someone
+	// else's address.
+	result, err := client.DescribeAddresses(context.TODO(), &ec2.DescribeAddressesInput{
+		AllocationIds: []string{e.AllocationId},
+	})
+	if isErrorCode(err, "InvalidAllocationID.NotFound") {
+		return true
+	}
+	if err != nil || len(result.Addresses) == 0 {
+		fmt.Println("Got an error retrieving information about the Elastic IP:")
+		fmt.Println(e.AllocationId, err)
+		return false
+	}
+	if !hasStackTag(result.Addresses[0].Tags, stack) {
+		log.Printf("Keeping Elastic IP %s, it is not tagged for stack %s", e.PublicIp, stack)
+		return true
+	}
+
+	_, err = client.ReleaseAddress(context.TODO(), &ec2.ReleaseAddressInput{
+		AllocationId: aws.String(e.AllocationId),
+	})
+	if err != nil {
+		fmt.Println("Got an error releasing the Elastic IP:")
+		fmt.Println(err)
+		return false
+	}
+
+	emit(eventElasticIpReleased, "public_ip", e.PublicIp)
+	return true
+}
+
+func hasStackTag(tags []types.Tag, stack string) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == stackTag && aws.ToString(tag.Value) == stack {
+			return true
+		}
+	}
+	return false
+}
+
+// attachElasticIp associates the stack's address with instanceId and points
+// the stack URL at it.
+func attachElasticIp(client *ec2.Client, state *stackState, instanceId string) bool {
+	if !state.ElasticIp.associate(client, instanceId) {
+		return false
+	}
+
+	state.PublicDnsName = state.ElasticIp.PublicIp
+	if instance := describeInstance(client, instanceId); instance != nil && aws.ToString(instance.PublicDnsName) != "" {
+		state.PublicDnsName = aws.ToString(instance.PublicDnsName)
+	}
+	state.URL = state.instanceURL(state.PublicDnsName)
+	return true
+}
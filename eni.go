@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// networkInterface places one of the instance's interfaces in a subnet,
+// optionally at a fixed private address.
+type networkInterface struct {
+	SubnetId  string `json:"subnet_id"`
+	PrivateIp string `json:"private_ip,omitempty"`
+}
+
+func parseNetworkInterface(s string) (networkInterface, error) {
+	n := networkInterface{SubnetId: s}
+	if i := strings.Index(s, "="); i >= 0 {
+		n.SubnetId, n.PrivateIp = s[:i], s[i+1:]
+		if net.ParseIP(n.PrivateIp) == nil {
+			return n, fmt.Errorf("invalid private IP %q", n.PrivateIp)
+		}
+	}
+	if !strings.HasPrefix(n.SubnetId, "subnet-") {
+		return n, fmt.Errorf("invalid subnet id %q", n.SubnetId)
+	}
+	return n, nil
+}
+
+// interfacesFlag collects repeated -secondary-eni subnet-id[=private-ip]
+// values.
+type interfacesFlag []networkInterface
+
+func (f *interfacesFlag) String() string {
+	items := make([]string, len(*f))
+	for i, n := range *f {
+		items[i] = n.SubnetId
+		if n.PrivateIp != "" {
+			items[i] += "=" + n.PrivateIp
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (f *interfacesFlag) Set(value string) error {
+	n, err := parseNetworkInterface(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, n)
+	return nil
+}
+
+// hasStaticAddresses reports whether any interface asks for a fixed private
+// IP, which only one instance at a time can hold.
+func (spec launchSpec) hasStaticAddresses() bool {
+	if spec.PrivateIp != "" {
+		return true
+	}
+	for _, n := range spec.SecondaryInterfaces {
+		if n.PrivateIp != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// networkInterfaceSpecs returns the interfaces to launch the instance with,
+// or nil to let EC2 pick a default subnet.
+func (spec launchSpec) networkInterfaceSpecs(securityGroupId string) []types.InstanceNetworkInterfaceSpecification {
+	if spec.SubnetId == "" {
+		return nil
+	}
+
+	interfaces := append([]networkInterface{{spec.SubnetId, spec.PrivateIp}}, spec.SecondaryInterfaces...)
+	specs := make([]types.InstanceNetworkInterfaceSpecification, len(interfaces))
+	for i, n := range interfaces {
+		specs[i] = types.InstanceNetworkInterfaceSpecification{
+			DeviceIndex:         aws.Int32(int32(i)),
+			SubnetId:            aws.String(n.SubnetId),
+			Groups:              []string{securityGroupId},
+			DeleteOnTermination: aws.Bool(true),
+			Description:         aws.String("WordPress"),
+		}
+		if n.PrivateIp != "" {
+			specs[i].PrivateIpAddress = aws.String(n.PrivateIp)
+		}
+	}
+
+	// EC2 only hands out a public address to single-interface instances;
+	// with more the stack relies on its Elastic IP.
+	if len(specs) == 1 {
+		specs[0].AssociatePublicIpAddress = aws.Bool(true)
+	}
+	return specs
+}
+
+func subnetVpcId(client *ec2.Client, subnetId string) string {
+	result, err := client.DescribeSubnets(context.TODO(), &ec2.DescribeSubnetsInput{
+		SubnetIds: []string{subnetId},
+	})
+	if err != nil || len(result.Subnets) == 0 {
+		fmt.Println("Got an error retrieving information about the subnet:")
+		fmt.Println(subnetId, err)
+		return ""
+	}
+	return aws.ToString(result.Subnets[0].VpcId)
+}
+
+// deleteStackInterfaces removes detached interfaces tagged for the stack.
+// Interfaces normally go with the instance; this catches the ones left
+// behind by a failed launch or detached by hand.
+func deleteStackInterfaces(client *ec2.Client, stack string) bool {
+	result, err := client.DescribeNetworkInterfaces(context.TODO(), &ec2.DescribeNetworkInterfacesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + stackTag), Values: []string{stack}},
+			{Name: aws.String("status"), Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the stack's network interfaces:")
+		fmt.Println(err)
+		return false
+	}
+
+	for _, n := range result.NetworkInterfaces {
+		_, err := client.DeleteNetworkInterface(context.TODO(), &ec2.DeleteNetworkInterfaceInput{
+			NetworkInterfaceId: n.NetworkInterfaceId,
+		})
+		if err != nil && !isErrorCode(err, "InvalidNetworkInterfaceID.NotFound") {
+			fmt.Println("Got an error deleting a network interface:")
+			fmt.Println(err)
+			return false
+		}
+	}
+	return true
+}
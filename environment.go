@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// environmentTag records what a stack is for on its instance.
+const environmentTag = "aws-wp:environment"
+
+const (
+	environmentProduction = "production"
+	environmentStaging    = "staging"
+	environmentDev        = "dev"
+)
+
+func validateEnvironment(environment string) error {
+	switch environment {
+	case environmentProduction, environmentStaging, environmentDev:
+		return nil
+	}
+	return fmt.Errorf("unknown -environment %q, expected production, staging or dev", environment)
+}
+
+// noindex reports whether search engines are kept away from the stack:
+// staging and dev stacks are often clones of a production site, and being
+// indexed would compete with it. -allow-indexing turns this off.
+func (spec launchSpec) noindex() bool {
+	nonProduction := spec.Environment == environmentStaging || spec.Environment == environmentDev
+	return nonProduction && !spec.AllowIndexing
+}
+
+// instanceTags are the tags the instance gets beyond its name and stack.
+func (spec launchSpec) instanceTags() []types.Tag {
+	tags := append(spec.expiryTags(), spec.userTags()...)
+	if spec.Environment != "" {
+		tags = append(tags, types.Tag{Key: aws.String(environmentTag), Value: aws.String(spec.Environment)})
+	}
+	return tags
+}
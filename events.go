@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Events emitted with -output events, one JSON object per line.
+const (
+	eventSecurityGroupFound     = "sg.found"
+	eventSecurityGroupCreated   = "sg.created"
+	eventSecurityGroupRuleAdded = "sg.rule_added"
+	eventSecurityGroupRuleExtra = "sg.rule_extraneous"
+	eventInstanceLaunched       = "instance.launched"
+	eventInstanceRunning        = "instance.running"
+	eventHealthOK               = "health.ok"
+	eventHealthFailed           = "health.failed"
+	eventHookStarted            = "hook.started"
+	eventHookFinished           = "hook.finished"
+	eventHookFailed             = "hook.failed"
+	eventInstanceTerminated     = "instance.terminated"
+	eventSecurityGroupDeleted   = "sg.deleted"
+	eventImageCreated           = "image.created"
+	eventInstanceReplaced       = "instance.replaced"
+	eventElasticIpAllocated     = "eip.allocated"
+	eventElasticIpAssociated    = "eip.associated"
+	eventElasticIpReleased      = "eip.released"
+	eventLoadBalancerCreated    = "alb.created"
+	eventLoadBalancerDeleted    = "alb.deleted"
+	eventTargetRegistered       = "alb.target_registered"
+	eventBootstrapProgress      = "bootstrap.progress"
+	eventSnapshotStarted        = "snapshot.started"
+	eventVolumeRestored         = "volume.restored"
+	eventInstanceStopped        = "instance.stopped"
+	eventImageDeregistered      = "image.deregistered"
+	eventSnapshotDeleted        = "snapshot.deleted"
+	eventTrafficShifted         = "alb.traffic_shifted"
+	eventTrafficRolledBack      = "alb.traffic_rolled_back"
+	eventAccessLogsEnabled      = "alb.access_logs_enabled"
+	eventBucketDeleted          = "bucket.deleted"
+	eventWriteRefused           = "aws.write_refused"
+	eventSecretStored           = "secret.stored"
+	eventSerialConsoleEnabled   = "serial_console.enabled"
+	eventVolumeModified         = "volume.modified"
+	eventStackSynced            = "stack.synced"
+	eventDNSUpserted            = "dns.upserted"
+	eventDNSDeleted             = "dns.deleted"
+	eventLoadTestFinished       = "loadtest.finished"
+	eventUptimeCheckCreated     = "uptime_check.created"
+	eventUptimeCheckDeleted     = "uptime_check.deleted"
+	eventStatusPageCreated      = "statuspage.created"
+	eventStatusPageDeleted      = "statuspage.deleted"
+	eventImageBaked             = "image.baked"
+	eventLoginRateLimitEnabled  = "login_rate_limit.enabled"
+	eventLoginRateLimitDeleted  = "login_rate_limit.deleted"
+	eventSecurityGroupAdopted   = "sg.adopted"
+	eventStackMigrated          = "stack.migrated"
+	eventLogMetricsEnabled      = "log_metrics.enabled"
+	eventLogMetricsDeleted      = "log_metrics.deleted"
+	eventPHPTuned               = "php.tuned"
+)
+
+type event struct {
+	Time  time.Time         `json:"time"`
+	Event string            `json:"event"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// events is nil unless the event stream is enabled.
+var events *json.Encoder
+
+// setOutput selects how progress is reported. With "events" stdout carries
+// only the event stream and everything human-readable moves to stderr.
+func setOutput(format string) error {
+	switch format {
+	case "text":
+	case "events":
+		events = json.NewEncoder(os.Stdout)
+		os.Stdout = os.Stderr
+	default:
+		return fmt.Errorf("unknown output format %q, expected text or events", format)
+	}
+	return nil
+}
+
+// emit writes an event with data given as key, value pairs.
+func emit(name string, keyvals ...string) {
+	if events == nil && len(sinks) == 0 {
+		return
+	}
+
+	e := event{Time: time.Now().UTC(), Event: name}
+	if len(keyvals) > 0 {
+		e.Data = make(map[string]string, len(keyvals)/2)
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			e.Data[keyvals[i]] = keyvals[i+1]
+		}
+	}
+
+	if events != nil {
+		events.Encode(e)
+	}
+	notify(e)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// The default layouts of list and status. -format, or formats in the
+// config file, replaces them with another Go template over the same data:
+// the stacks for list, the stack for status. Tabs align columns, and \t and
+// \n may be written as escapes, so a format fits on the command line:
+//
+//	aws-wp list -format '{{range .}}{{.Name}}\t{{.URL}}\n{{end}}'
+const (
+	defaultListFormat = `{{msg "list.name"}}\t{{msg "list.region"}}\t{{msg "list.instance"}}\t{{msg "list.state"}}\t{{msg "list.url"}}
+{{range .}}{{.Name}}\t{{.Region}}\t{{.InstanceId}}\t{{.InstanceState}}\t{{.URL}}
+{{end}}`
+
+	defaultStatusFormat = `{{msg "status.stack"}}:\t{{.Name}}
+{{msg "status.region"}}:\t{{.Region}}
+{{msg "status.instance"}}:\t{{.InstanceId}} ({{.InstanceType}}, {{.InstanceState}})
+{{msg "status.image"}}:\t{{.ImageId}}
+{{msg "status.url"}}:\t{{.URL}}
+{{if .Domain}}{{msg "status.domain"}}:\t{{.Domain}} ({{.DNSProvider}})
+{{end}}{{with .LoadBalancer}}{{msg "status.load_balancer"}}:\t{{.DNSName}}
+{{if .LoginRateLimit}}{{msg "status.login_limit"}}:\t{{msg "status.login_limit_per" .LoginRateLimit}}
+{{end}}{{end}}{{with .ElasticIp}}{{msg "status.elastic_ip"}}:\t{{.PublicIp}} ({{if .Owned}}{{msg "status.elastic_ip_owned"}}{{else}}{{msg "status.elastic_ip_kept"}}{{end}})
+{{end}}{{msg "status.created"}}:\t{{time .CreatedAt}}
+{{with .ExpiresAt}}{{msg "status.expires"}}:\t{{time .}}
+{{end}}{{with .Schedule}}{{msg "status.schedule"}}:\t{{.}}
+{{end}}{{with .Transition}}{{msg "status.next_transition"}}:\t{{if .Start}}{{msg "status.schedule_start" (time .At)}}{{else}}{{msg "status.schedule_stop" (time .At)}}{{end}}
+{{end}}{{with .StatusPage}}{{if .DomainName}}{{msg "status.status_page"}}:\t{{.URL}}
+{{end}}{{end}}{{with .BootstrapVersion}}{{msg "status.bootstrap"}}:\t{{.}}
+{{end}}{{with .PHP}}{{msg "status.php"}}:\t{{.}}
+{{end}}{{with .Usage.Disk}}{{msg "status.disk"}}:\t{{msg "status.disk_used" .Percent}}
+{{end}}{{with .Usage.Memory}}{{msg "status.memory"}}:\t{{msg "status.memory_used" .Percent}}
+{{end}}{{with .Usage.Inodes}}{{msg "status.inodes"}}:\t{{msg "status.inodes_used" .Percent .Used .Total}}
+{{end}}{{if .DiskAlarm}}{{msg "status.disk_alarm"}}:\t{{msg "status.disk_alarm_at" .DiskAlarm .AlarmDisk}}
+{{end}}{{with .LogAlarms}}{{msg "status.log_alarms"}}:\t{{join . ", "}}
+{{end}}{{with .Maintenance}}
+{{msg "status.maintenance"}}:
+{{range .}}  {{.Text}}
+{{end}}{{msg "status.move_before" $.Name (time (index . 0).Deadline)}}
+{{end}}`
+)
+
+// formatNames are the outputs a format can be configured for.
+var formatNames = map[string]string{
+	"list":   defaultListFormat,
+	"status": defaultStatusFormat,
+}
+
+var formatFuncs = template.FuncMap{
+	"msg":  msg,
+	"time": func(t time.Time) string { return t.Local().Format(time.RFC1123) },
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func validateFormats(formats map[string]string) error {
+	for name, text := range formats {
+		if _, ok := formatNames[name]; !ok {
+			return fmt.Errorf("unknown format %q, expected list or status", name)
+		}
+		if _, err := parseFormat(name, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputFormat picks the format of the named output: the -format flag, else
+// the config file's, else the default.
+func outputFormat(env *environment, name string, flagValue string) (*template.Template, error) {
+	text := flagValue
+	if text == "" {
+		text = env.config.Formats[name]
+	}
+	if text == "" {
+		text = formatNames[name]
+	}
+	return parseFormat(name, text)
+}
+
+// parseFormat parses a format given inline or, as @path, in a file.
+func parseFormat(name string, text string) (*template.Template, error) {
+	if strings.HasPrefix(text, "@") {
+		data, err := ioutil.ReadFile(text[1:])
+		if err != nil {
+			return nil, fmt.Errorf("reading the %s format: %w", name, err)
+		}
+		text = string(data)
+	}
+	text = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(text)
+	t, err := template.New(name).Funcs(formatFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the %s format: %w", name, err)
+	}
+	return t, nil
+}
+
+// render writes data with the format, aligning tab-separated columns.
+func render(t *template.Template, data interface{}) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if err := t.Execute(w, data); err != nil {
+		return fmt.Errorf("formatting the %s output: %w", t.Name(), err)
+	}
+	return w.Flush()
+}
@@ -3,15 +3,39 @@ module aws-wp
 go 1.17
 
 require (
-	github.com/aws/aws-sdk-go-v2 v1.9.1 // indirect
-	github.com/aws/aws-sdk-go-v2/config v1.8.1 // indirect
-	github.com/aws/aws-sdk-go-v2/credentials v1.4.1 // indirect
+	github.com/aws/aws-sdk-go-v2 v1.9.1
+	github.com/aws/aws-sdk-go-v2/config v1.8.1
+	github.com/aws/aws-sdk-go-v2/credentials v1.4.1
+	github.com/aws/aws-sdk-go-v2/service/acm v1.6.1
+	github.com/aws/aws-sdk-go-v2/service/athena v1.6.1
+	github.com/aws/aws-sdk-go-v2/service/cloudfront v1.7.1
+	github.com/aws/aws-sdk-go-v2/service/cloudwatch v1.8.1
+	github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs v1.7.1
+	github.com/aws/aws-sdk-go-v2/service/costexplorer v1.9.0
+	github.com/aws/aws-sdk-go-v2/service/ec2 v1.16.0
+	github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect v1.5.0
+	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2 v1.8.0
+	github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi v1.5.1
+	github.com/aws/aws-sdk-go-v2/service/route53 v1.11.1
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.16.0
+	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.6.1
+	github.com/aws/aws-sdk-go-v2/service/ses v1.6.1
+	github.com/aws/aws-sdk-go-v2/service/sns v1.8.1
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.11.0
+	github.com/aws/aws-sdk-go-v2/service/wafv2 v1.10.0
+	github.com/aws/smithy-go v1.8.0
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.5.0 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/ini v1.2.2 // indirect
-	github.com/aws/aws-sdk-go-v2/service/ec2 v1.16.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.3.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.3.1 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.7.1 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sso v1.4.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.7.0 // indirect
-	github.com/aws/smithy-go v1.8.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
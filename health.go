@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthTimeout bounds how long waitHealthy keeps probing a new instance.
+const healthTimeout = 5 * time.Minute
+
+// maxHealthBody caps how much of a page is searched for the expected text.
+const maxHealthBody = 1 << 20
+
+// healthCheck is what makes a site count as up: a non-error status for
+// Path, with Match in the page when set. For sites behind basic
+// authentication AuthSecret is the ARN of the -health-auth or -basic-auth
+// secret, which healthCheckAuth reads the user:password of into Auth, so
+// the state does not hold it. States of earlier versions may still have
+// Auth itself.
+type healthCheck struct {
+	Path       string `json:"path,omitempty"`
+	Match      string `json:"match,omitempty"`
+	Auth       string `json:"auth,omitempty"`
+	AuthSecret string `json:"auth_secret,omitempty"`
+}
+
+func (c healthCheck) hasAuth() bool {
+	return c.Auth != "" || c.AuthSecret != ""
+}
+
+func (c healthCheck) path() string {
+	if c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+// waitHealthy polls the site at base until it passes the check or
+// healthTimeout passes.
+func waitHealthy(client *http.Client, base string, check healthCheck) bool {
+	url := origin(base) + check.path()
+	deadline := time.Now().Add(healthTimeout)
+
+	for time.Now().Before(deadline) {
+		status, err := probe(client, url, check)
+		if err == nil && status < http.StatusBadRequest {
+			return true
+		}
+		if err != nil {
+			log.Printf("Waiting for web server... (%v)", err)
+		} else {
+			log.Printf("Waiting for web server... (HTTP %d)", status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	fmt.Println("Got an error waiting for the site to become healthy:")
+	fmt.Println(url)
+	return false
+}
+
+func probe(client *http.Client, url string, check healthCheck) (int, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if parts := strings.SplitN(check.Auth, ":", 2); len(parts) == 2 {
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if check.Match != "" && resp.StatusCode < http.StatusBadRequest {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			return 0, err
+		}
+		if !strings.Contains(string(body), check.Match) {
+			return 0, fmt.Errorf("HTTP %d without %q in the page", resp.StatusCode, check.Match)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Hook points that can be configured under hooks in the config file.
+const (
+	hookBeforeLaunch = "before:launch"
+	hookAfterReady   = "after:ready"
+	hookAfterDestroy = "after:destroy"
+)
+
+// hook is a single step: either a local shell command (run) or a shell
+// command executed on the instance through SSM (ssm). Both see the stack
+// variables (AWS_WP_STACK, AWS_WP_INSTANCE_ID, AWS_WP_URL, ...) in their
+// environment.
+type hook struct {
+	Run             string `yaml:"run"`
+	SSM             string `yaml:"ssm"`
+	ContinueOnError bool   `yaml:"continue_on_error"`
+}
+
+func validateHooks(hooks map[string][]hook) error {
+	for point, steps := range hooks {
+		switch point {
+		case hookBeforeLaunch, hookAfterReady, hookAfterDestroy:
+		default:
+			return fmt.Errorf("unknown hook %q, expected %s, %s or %s",
+				point, hookBeforeLaunch, hookAfterReady, hookAfterDestroy)
+		}
+		for i, h := range steps {
+			if (h.Run == "") == (h.SSM == "") {
+				return fmt.Errorf("hook %s #%d: set exactly one of run or ssm", point, i+1)
+			}
+			if h.SSM != "" && point != hookAfterReady {
+				return fmt.Errorf("hook %s #%d: ssm commands need a running instance, use them in %s",
+					point, i+1, hookAfterReady)
+			}
+		}
+	}
+	return nil
+}
+
+// runHooks runs the steps configured for point in order and stops at the
+// first failure, unless that step has continue_on_error set.
+func runHooks(cfg aws.Config, hooks map[string][]hook, point string, vars map[string]string) error {
+	if readOnly && len(hooks[point]) > 0 {
+		return fmt.Errorf("read-only mode: %s hooks are not run", point)
+	}
+	for i, h := range hooks[point] {
+		emit(eventHookStarted, "hook", point, "step", fmt.Sprint(i+1))
+
+		var err error
+		if h.Run != "" {
+			err = runLocalHook(h.Run, vars)
+		} else {
+			err = runSSMHook(cfg, h.SSM, vars)
+		}
+
+		if err != nil {
+			emit(eventHookFailed, "hook", point, "step", fmt.Sprint(i+1), "error", err.Error())
+			if h.ContinueOnError {
+				fmt.Printf("Hook %s #%d failed, continuing: %v\n", point, i+1, err)
+				continue
+			}
+			return fmt.Errorf("hook %s #%d: %w", point, i+1, err)
+		}
+		emit(eventHookFinished, "hook", point, "step", fmt.Sprint(i+1))
+	}
+	return nil
+}
+
+func runLocalHook(command string, vars map[string]string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	cmd.Env = os.Environ()
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func runSSMHook(cfg aws.Config, command string, vars map[string]string) error {
+	// Export the stack variables ahead of the command in a stable order.
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var script strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&script, "export %s=%s\n", k, shellQuote(vars[k]))
+	}
+	script.WriteString(command)
+
+	output, err := runShellScript(ssm.NewFromConfig(cfg), vars["AWS_WP_INSTANCE_ID"], script.String())
+	fmt.Print(output)
+	return err
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultIngress is what the stack security group allows unless told
+// otherwise.
+const defaultIngress = "80,443"
+
+// ingressRule opens a TCP port to a CIDR, or to everyone over IPv4 and IPv6
+// when CIDR is empty.
+type ingressRule struct {
+	Port int32  `yaml:"port"`
+	CIDR string `yaml:"cidr,omitempty"`
+}
+
+// parseIngress reads rules written as a comma-separated list of port or
+// port=cidr, e.g. "80,443,22=203.0.113.0/24".
+func parseIngress(s string) ([]ingressRule, error) {
+	var rules []ingressRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		portText, cidr := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			portText, cidr = item[:i], item[i+1:]
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, fmt.Errorf("ingress %q: %w", item, err)
+			}
+		}
+
+		port, err := strconv.Atoi(portText)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("ingress %q: invalid port", item)
+		}
+
+		rules = append(rules, ingressRule{Port: int32(port), CIDR: cidr})
+	}
+	return rules, nil
+}
+
+func formatIngress(rules []ingressRule) string {
+	items := make([]string, len(rules))
+	for i, r := range rules {
+		items[i] = strconv.Itoa(int(r.Port))
+		if r.CIDR != "" {
+			items[i] += "=" + r.CIDR
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// grant is a single port opened to a single CIDR.
+type grant struct {
+	port int32
+	cidr string
+}
+
+// grants expands the rule into one grant per CIDR.
+func (r ingressRule) grants() []grant {
+	if r.CIDR == "" {
+		return []grant{{r.Port, "0.0.0.0/0"}, {r.Port, "::/0"}}
+	}
+	return []grant{{r.Port, r.CIDR}}
+}
+
+func (g grant) permission() types.IpPermission {
+	permission := types.IpPermission{
+		FromPort:   aws.Int32(g.port),
+		ToPort:     aws.Int32(g.port),
+		IpProtocol: aws.String("tcp"),
+	}
+	if strings.Contains(g.cidr, ":") {
+		permission.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(g.cidr)}}
+	} else {
+		permission.IpRanges = []types.IpRange{{CidrIp: aws.String(g.cidr)}}
+	}
+	return permission
+}
+
+// covers reports whether the existing permission already lets g through.
+func covers(p types.IpPermission, g grant) bool {
+	protocol := aws.ToString(p.IpProtocol)
+	if protocol == "tcp" || protocol == "6" {
+		if g.port < aws.ToInt32(p.FromPort) || g.port > aws.ToInt32(p.ToPort) {
+			return false
+		}
+	} else if protocol != "-1" {
+		return false
+	}
+
+	for _, r := range p.IpRanges {
+		if aws.ToString(r.CidrIp) == g.cidr {
+			return true
+		}
+	}
+	for _, r := range p.Ipv6Ranges {
+		if aws.ToString(r.CidrIpv6) == g.cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileIngress makes sure the group allows every rule, adding whatever
+// is missing, and reports permissions the stack did not ask for without
+// touching them.
+func reconcileIngress(client *ec2.Client, group types.SecurityGroup, rules []ingressRule) bool {
+	groupId := aws.ToString(group.GroupId)
+	required := map[grant]bool{}
+
+	for _, rule := range rules {
+		for _, g := range rule.grants() {
+			required[g] = true
+
+			present := false
+			for _, p := range group.IpPermissions {
+				if covers(p, g) {
+					present = true
+					break
+				}
+			}
+			if present {
+				continue
+			}
+
+			_, err := client.AuthorizeSecurityGroupIngress(context.TODO(), &ec2.AuthorizeSecurityGroupIngressInput{
+				GroupId:       aws.String(groupId),
+				IpPermissions: []types.IpPermission{g.permission()},
+			})
+			// Another run may have added it in the meantime.
+			if err != nil && !isErrorCode(err, "InvalidPermission.Duplicate") {
+				fmt.Println("Got an error adding a security group rule:")
+				fmt.Println(err)
+				return false
+			}
+			emit(eventSecurityGroupRuleAdded, "group_id", groupId, "port", strconv.Itoa(int(g.port)), "cidr", g.cidr)
+		}
+	}
+
+	for _, extra := range extraneousIngress(group.IpPermissions, required) {
+		log.Printf("Security group %s also allows %s, which the stack does not need", groupId, extra)
+		emit(eventSecurityGroupRuleExtra, "group_id", groupId, "rule", extra)
+	}
+	return true
+}
+
+// extraneousIngress describes the parts of permissions that are not exact
+// matches for a required grant.
+func extraneousIngress(permissions []types.IpPermission, required map[grant]bool) []string {
+	var extra []string
+	for _, p := range permissions {
+		protocol := aws.ToString(p.IpProtocol)
+		ports := fmt.Sprintf("%s %d-%d", protocol, aws.ToInt32(p.FromPort), aws.ToInt32(p.ToPort))
+		single := protocol == "tcp" && aws.ToInt32(p.FromPort) == aws.ToInt32(p.ToPort)
+		switch {
+		case protocol == "-1":
+			ports = "all traffic"
+		case aws.ToInt32(p.FromPort) == aws.ToInt32(p.ToPort):
+			ports = fmt.Sprintf("%s %d", protocol, aws.ToInt32(p.FromPort))
+		}
+
+		var sources []string
+		for _, r := range p.IpRanges {
+			sources = append(sources, aws.ToString(r.CidrIp))
+		}
+		for _, r := range p.Ipv6Ranges {
+			sources = append(sources, aws.ToString(r.CidrIpv6))
+		}
+		for _, source := range sources {
+			if single && required[grant{aws.ToInt32(p.FromPort), source}] {
+				continue
+			}
+			extra = append(extra, ports+" from "+source)
+		}
+		for _, pair := range p.UserIdGroupPairs {
+			extra = append(extra, ports+" from "+aws.ToString(pair.GroupId))
+		}
+		for _, list := range p.PrefixListIds {
+			extra = append(extra, ports+" from "+aws.ToString(list.PrefixListId))
+		}
+	}
+	return extra
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The first versions of the tool kept no state and tagged nothing but the
+// instance's Name: every run launched an instance named WordPress into a
+// security group, wordpress-sg, that only opened port 80 and had no tags.
+const (
+	legacyGroupName    = "wordpress-sg"
+	legacyInstanceName = "WordPress"
+)
+
+// isLegacyGroup reports whether the group is the untagged wordpress-sg of an
+// earlier version.
+func isLegacyGroup(group types.SecurityGroup) bool {
+	return aws.ToString(group.GroupName) == legacyGroupName && tagValue(group.Tags, stackTag) == ""
+}
+
+// adoptSecurityGroup tags the legacy group into the stack, so destroy
+// deletes it like a group the stack created, and points out instances of
+// earlier versions that are still in it.
+func adoptSecurityGroup(client *ec2.Client, group types.SecurityGroup, stack string) bool {
+	groupId := aws.ToString(group.GroupId)
+	_, err := client.CreateTags(context.TODO(), &ec2.CreateTagsInput{
+		Resources: []string{groupId},
+		Tags:      []types.Tag{stackTagFor(stack)},
+	})
+	if err != nil {
+		fmt.Println("Got an error tagging the security group:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventSecurityGroupAdopted, "group_id", groupId, "stack", stack)
+	log.Printf("Adopted security group %s of an earlier version into stack %s", legacyGroupName, stack)
+
+	if instances := legacyInstances(client); len(instances) > 0 {
+		fmt.Printf("%d instances of earlier versions use %s, aws-wp migrate makes them stacks\n", len(instances), legacyGroupName)
+	}
+	return true
+}
+
+// legacyInstances finds the instances earlier versions launched: named
+// WordPress, in wordpress-sg and without a stack tag.
+func legacyInstances(client *ec2.Client) []types.Instance {
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:Name"), Values: []string{legacyInstanceName}},
+			{Name: aws.String("instance.group-name"), Values: []string{legacyGroupName}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+
+	var instances []types.Instance
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			fmt.Println("Got an error retrieving information about your Amazon EC2 instances:")
+			fmt.Println(err)
+			return nil
+		}
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				if tagValue(i.Tags, stackTag) == "" {
+					instances = append(instances, i)
+				}
+			}
+		}
+	}
+	return instances
+}
+
+// migrate turns an instance launched by an earlier version into a stack:
+// it tags the instance, its volumes and wordpress-sg with the stack,
+// brings the group's rules up to today's defaults and writes the stack's
+// state, after which every command works on it. With several such
+// instances -instance-id picks one, and the others are migrated with other
+// -name values; they share wordpress-sg, which belongs to the first stack
+// and passes to another one when that stack is destroyed.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	instanceId := fs.String("instance-id", "", "The instance to adopt, needed when there are several")
+	dryRun := fs.Bool("dry-run", false, "Only list the instances of earlier versions")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "migrate")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	if _, err := os.Stat(statePath(env.name)); err == nil {
+		fmt.Printf("Stack %s already exists, pass another -name\n", env.name)
+		return
+	}
+
+	client := ec2.NewFromConfig(env.aws)
+	instances := legacyInstances(client)
+	if len(instances) == 0 {
+		fmt.Printf("No instances of earlier versions in %s\n", env.aws.Region)
+		return
+	}
+
+	var instance *types.Instance
+	for i := range instances {
+		if aws.ToString(instances[i].InstanceId) == *instanceId || (*instanceId == "" && len(instances) == 1) {
+			instance = &instances[i]
+		}
+	}
+	if *dryRun || instance == nil {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "INSTANCE\tSTATE\tLAUNCHED\tPUBLIC DNS")
+		for _, i := range instances {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", aws.ToString(i.InstanceId), i.State.Name, aws.ToTime(i.LaunchTime).Local().Format(time.RFC1123), aws.ToString(i.PublicDnsName))
+		}
+		w.Flush()
+		if !*dryRun {
+			if *instanceId != "" {
+				fmt.Printf("%s is not an instance of an earlier version\n", *instanceId)
+			} else {
+				fmt.Println("Pass -instance-id to pick the instance to migrate")
+			}
+		}
+		return
+	}
+
+	var groupId string
+	for _, g := range instance.SecurityGroups {
+		if aws.ToString(g.GroupName) == legacyGroupName {
+			groupId = aws.ToString(g.GroupId)
+		}
+	}
+	groups, err := client.DescribeSecurityGroups(context.TODO(), &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []string{groupId},
+	})
+	if err != nil || len(groups.SecurityGroups) == 0 {
+		fmt.Println("Got an error retrieving information about security group:")
+		fmt.Println(legacyGroupName, err)
+		return
+	}
+	group := groups.SecurityGroups[0]
+	if isLegacyGroup(group) && !adoptSecurityGroup(client, group, env.name) {
+		return
+	}
+	rules, _ := parseIngress(defaultIngress)
+	if !reconcileIngress(client, group, rules) {
+		return
+	}
+
+	resources := []string{aws.ToString(instance.InstanceId)}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil {
+			resources = append(resources, aws.ToString(mapping.Ebs.VolumeId))
+		}
+	}
+	_, err = client.CreateTags(context.TODO(), &ec2.CreateTagsInput{
+		Resources: resources,
+		Tags:      []types.Tag{stackTagFor(env.name)},
+	})
+	if err != nil {
+		fmt.Println("Got an error tagging the instance:")
+		fmt.Println(err)
+		return
+	}
+
+	state := &stackState{
+		Name:   env.name,
+		Region: env.aws.Region,
+		launchSpec: launchSpec{
+			ImageId:      aws.ToString(instance.ImageId),
+			InstanceType: string(instance.InstanceType),
+			SubnetId:     aws.ToString(instance.SubnetId),
+		},
+		VpcId:           aws.ToString(instance.VpcId),
+		InstanceId:      aws.ToString(instance.InstanceId),
+		SecurityGroupId: groupId,
+		PublicDnsName:   aws.ToString(instance.PublicDnsName),
+		CreatedAt:       aws.ToTime(instance.LaunchTime),
+	}
+	if state.PublicDnsName != "" {
+		state.URL = state.instanceURL(state.PublicDnsName)
+	}
+	if err := state.save(); err != nil {
+		fmt.Println("Got an error saving the stack state:")
+		fmt.Println(err)
+		return
+	}
+	emit(eventStackMigrated, "instance_id", state.InstanceId, "group_id", groupId)
+	fmt.Printf("Instance %s is now stack %s\n", state.InstanceId, state.Name)
+}
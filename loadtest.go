@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	// loadRequestTimeout counts a request that takes longer as failed.
+	loadRequestTimeout = 10 * time.Second
+
+	// maxInFlight bounds the requests waiting for an answer. Once the site
+	// is that far behind, further requests are counted as failed instead
+	// of piling up on the client.
+	maxInFlight = 512
+)
+
+// loadSummary is the outcome of a load test. The spot worker prints it as
+// JSON for the tool that launched it.
+type loadSummary struct {
+	URL      string         `json:"url"`
+	RPS      int            `json:"rps"`
+	Start    time.Time      `json:"start"`
+	End      time.Time      `json:"end"`
+	Requests int            `json:"requests"`
+	Errors   int            `json:"errors"`
+	Statuses map[string]int `json:"statuses"`
+
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+func (s loadSummary) errorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return 100 * float64(s.Errors) / float64(s.Requests)
+}
+
+type loadSample struct {
+	status  string
+	failed  bool
+	latency time.Duration
+}
+
+// loadtest sends a steady rate of requests to the stack, from this machine
+// or from a temporary spot instance closer to it, and checks the load
+// against the instance's CPU and CPU credit metrics.
+func loadtest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	rps := fs.Int("rps", 50, "Requests per second")
+	length := fs.Duration("duration", 2*time.Minute, "How long to send requests")
+	path := fs.String("path", "", "Path to request, the health check path by default")
+	from := fs.String("from", "local", "Where the load comes from: local or spot, a temporary instance running this release of the tool")
+	instanceType := fs.String("instance-type", "c6i.large", "Instance type of the -from spot instance")
+	instanceProfile := fs.String("instance-profile", "", "Instance profile allowing Systems Manager for the -from spot instance, the stack's by default")
+	metricsWait := fs.Duration("metrics-wait", 5*time.Minute, "How long to wait for CloudWatch to have the instance's metrics of the test, 0 to skip them")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	target := fs.String("url", "", "Load this URL instead of a stack, as the spot instance does")
+	asJSON := fs.Bool("json", false, "Print the summary as JSON")
+	fs.Parse(args)
+
+	if *rps <= 0 || *length <= 0 {
+		fmt.Println("-rps and -duration must be positive")
+		os.Exit(2)
+	}
+	if *from != "local" && *from != "spot" {
+		fmt.Printf("Unknown -from %q, expected local or spot\n", *from)
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The spot worker: no stack, just the load and its summary.
+	if *target != "" {
+		summary := runLoad(env.http, *target, "", *rps, *length)
+		printLoadSummary(summary, *asJSON)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if *path == "" {
+		*path = state.HealthCheck.path()
+	}
+	url := strings.TrimSuffix(state.URL, "/") + *path
+
+	question := fmt.Sprintf("Send %d requests per second to %s for %s?", *rps, url, *length)
+	if !*yes && !confirm(question) {
+		return
+	}
+
+	var summary loadSummary
+	if *from == "spot" {
+		if state.HealthCheck.hasAuth() {
+			fmt.Println("The site needs basic authentication, which is not handed to a spot instance; use -from local")
+			return
+		}
+		profile := *instanceProfile
+		if profile == "" {
+			profile = state.InstanceProfile
+		}
+		var ok bool
+		if summary, ok = spotLoad(env, state, profile, *instanceType, url, *rps, *length); !ok {
+			return
+		}
+	} else {
+		summary = runLoad(env.http, url, healthCheckAuth(env, state.HealthCheck).Auth, *rps, *length)
+	}
+	emit(eventLoadTestFinished, "url", url, "requests", strconv.Itoa(summary.Requests),
+		"errors", strconv.Itoa(summary.Errors), "p95_ms", strconv.FormatInt(summary.P95.Milliseconds(), 10))
+	printLoadSummary(summary, *asJSON)
+
+	if *metricsWait > 0 {
+		fmt.Println()
+		printLoadMetrics(cloudwatch.NewFromConfig(env.aws), state, summary, *metricsWait)
+	}
+}
+
+// runLoad sends requests at a fixed rate whatever the answers take, as
+// visitors do, and sums them up.
+func runLoad(base *http.Client, url string, auth string, rps int, length time.Duration) loadSummary {
+	client := *base
+	client.Timeout = loadRequestTimeout
+	if t, ok := client.Transport.(*http.Transport); ok {
+		t = t.Clone()
+		t.MaxIdleConnsPerHost = maxInFlight
+		client.Transport = t
+	}
+
+	samples := make(chan loadSample, maxInFlight)
+	var latencies []time.Duration
+	summary := loadSummary{URL: url, RPS: rps, Statuses: map[string]int{}}
+	collected := make(chan struct{})
+	go func() {
+		for s := range samples {
+			summary.Requests++
+			summary.Statuses[s.status]++
+			if s.failed {
+				summary.Errors++
+			}
+			if s.latency > 0 {
+				latencies = append(latencies, s.latency)
+			}
+		}
+		close(collected)
+	}()
+
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, maxInFlight)
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+	summary.Start = time.Now()
+	deadline := summary.Start.Add(length)
+	lastReport := summary.Start
+	sent := 0
+
+	log.Printf("Sending %d requests per second to %s for %s", rps, url, length)
+	for now := range ticker.C {
+		if now.After(deadline) {
+			break
+		}
+		if now.Sub(lastReport) >= 10*time.Second {
+			log.Printf("Sent %d requests", sent)
+			lastReport = now
+		}
+		sent++
+		select {
+		case inFlight <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				samples <- loadRequest(&client, url, auth)
+				<-inFlight
+			}()
+		default:
+			samples <- loadSample{status: "saturated", failed: true}
+		}
+	}
+	wg.Wait()
+	summary.End = time.Now()
+	close(samples)
+	<-collected
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	summary.P50 = percentile(latencies, 50)
+	summary.P90 = percentile(latencies, 90)
+	summary.P95 = percentile(latencies, 95)
+	summary.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		summary.Max = latencies[len(latencies)-1]
+	}
+	return summary
+}
+
+func loadRequest(client *http.Client, url string, auth string) loadSample {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return loadSample{status: "error", failed: true}
+	}
+	if parts := strings.SplitN(auth, ":", 2); len(parts) == 2 {
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return loadSample{status: "timeout", failed: true}
+		}
+		return loadSample{status: "error", failed: true}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return loadSample{
+		status:  strconv.Itoa(resp.StatusCode),
+		failed:  resp.StatusCode >= http.StatusBadRequest,
+		latency: time.Since(start),
+	}
+}
+
+// percentile takes the nearest rank of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func printLoadSummary(s loadSummary, asJSON bool) {
+	if asJSON {
+		json.NewEncoder(os.Stdout).Encode(s)
+		return
+	}
+
+	statuses := make([]string, 0, len(s.Statuses))
+	for status, n := range s.Statuses {
+		statuses = append(statuses, fmt.Sprintf("%s: %d", status, n))
+	}
+	sort.Strings(statuses)
+
+	elapsed := s.End.Sub(s.Start)
+	fmt.Printf("Requests:  %d in %s (%.1f per second)\n", s.Requests, elapsed.Round(time.Second), float64(s.Requests)/elapsed.Seconds())
+	fmt.Printf("Errors:    %d (%.2f%%)\n", s.Errors, s.errorRate())
+	fmt.Printf("Responses: %s\n", strings.Join(statuses, ", "))
+	fmt.Printf("Latency:   p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+		roundLatency(s.P50), roundLatency(s.P90), roundLatency(s.P95), roundLatency(s.P99), roundLatency(s.Max))
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+type loadTestParams struct {
+	BinaryURL string
+	Checksum  string
+	URL       string
+	RPS       int
+	Duration  time.Duration
+}
+
+// spotLoad runs the load test on a temporary spot instance in the stack's
+// region. The instance fetches this release of the tool from the release
+// bucket, so it needs a release build, and is terminated afterwards.
+func spotLoad(env *environment, state *stackState, profile string, instanceType string, url string, rps int, length time.Duration) (loadSummary, bool) {
+	if version == "dev" {
+		fmt.Println("-from spot needs a release build of aws-wp, which the instance downloads")
+		return loadSummary{}, false
+	}
+	if profile == "" {
+		fmt.Println("Pass -instance-profile with a profile that allows Systems Manager, the stack has none")
+		return loadSummary{}, false
+	}
+	base, err := releaseBase(env)
+	if err != nil {
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+	sumsData, err := fetchRelease(env, base, version+"/SHA256SUMS")
+	if err != nil {
+		fmt.Println("Got an error retrieving the release checksums:")
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+	sums, err := parseChecksums(sumsData)
+	if err != nil {
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+
+	client := ec2.NewFromConfig(env.aws)
+	ssmClient := ssm.NewFromConfig(env.aws)
+	imageId := stockImage(client, ssmClient, "al2023", instanceType)
+	if imageId == "" {
+		return loadSummary{}, false
+	}
+
+	input := &ec2.RunInstancesInput{
+		ImageId:                           aws.String(imageId),
+		InstanceType:                      types.InstanceType(instanceType),
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		IamInstanceProfile:                &types.IamInstanceProfileSpecification{Name: aws.String(profile)},
+		InstanceInitiatedShutdownBehavior: types.ShutdownBehaviorTerminate,
+		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
+			MarketType: types.MarketTypeSpot,
+			SpotOptions: &types.SpotMarketOptions{
+				SpotInstanceType:             types.SpotInstanceTypeOneTime,
+				InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorTerminate,
+			},
+		},
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String(state.Name + "-loadtest")},
+				{Key: aws.String("aws-wp:loadtest"), Value: aws.String(state.Name)},
+			},
+		}},
+	}
+	if state.SubnetId != "" {
+		input.SubnetId = aws.String(state.SubnetId)
+	}
+	result, err := client.RunInstances(context.TODO(), input)
+	if err != nil {
+		fmt.Println("Got an error launching the spot instance:")
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+	workerId := aws.ToString(result.Instances[0].InstanceId)
+	defer terminateInstance(client, workerId)
+	log.Printf("Launched spot instance %s to send the load", workerId)
+
+	if _, ok := waitRunning(client, workerId); !ok || !waitManaged(ssmClient, workerId) {
+		return loadSummary{}, false
+	}
+	worker := describeInstance(client, workerId)
+	if worker == nil {
+		return loadSummary{}, false
+	}
+	arch := "amd64"
+	if worker.Architecture == types.ArchitectureValuesArm64 {
+		arch = "arm64"
+	}
+	binary := "aws-wp-linux-" + arch
+	checksum, ok := sums[binary]
+	if !ok {
+		fmt.Printf("Release %s has no %s\n", version, binary)
+		return loadSummary{}, false
+	}
+
+	var script bytes.Buffer
+	params := loadTestParams{BinaryURL: base + "/" + version + "/" + binary, Checksum: checksum, URL: url, RPS: rps, Duration: length}
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "loadtest.sh", params); err != nil {
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+	log.Printf("Sending %d requests per second to %s for %s from %s", rps, url, length, workerId)
+	output, err := runShellScript(ssmClient, workerId, script.String())
+	if err != nil {
+		fmt.Println("Got an error running the load test on the spot instance:")
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+
+	summary := loadSummary{}
+	if err := json.Unmarshal([]byte(output), &summary); err != nil {
+		fmt.Println("Got an error reading the load test summary:")
+		fmt.Println(err)
+		return loadSummary{}, false
+	}
+	return summary, true
+}
+
+// printLoadMetrics compares the load with the instance's CPU metrics once
+// CloudWatch has them: without detailed monitoring EC2 reports every five
+// minutes, so the last period of the test arrives a while after it.
+func printLoadMetrics(client *cloudwatch.Client, state *stackState, s loadSummary, wait time.Duration) {
+	dimensions := []cwtypes.Dimension{{Name: aws.String("InstanceId"), Value: aws.String(state.InstanceId)}}
+	query := func(id string, name string, stat string) cwtypes.MetricDataQuery {
+		return cwtypes.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cwtypes.MetricStat{
+				Metric: &cwtypes.Metric{Namespace: aws.String("AWS/EC2"), MetricName: aws.String(name), Dimensions: dimensions},
+				Period: aws.Int32(60),
+				Stat:   aws.String(stat),
+			},
+		}
+	}
+	queries := []cwtypes.MetricDataQuery{
+		query("cpuMax", "CPUUtilization", "Maximum"),
+		query("cpuAvg", "CPUUtilization", "Average"),
+	}
+	burstable := strings.HasPrefix(state.InstanceType, "t")
+	if burstable {
+		queries = append(queries,
+			query("credits", "CPUCreditBalance", "Minimum"),
+			query("surplus", "CPUSurplusCreditsCharged", "Sum"))
+	}
+
+	lastPeriod := s.End.Truncate(5 * time.Minute)
+	deadline := time.Now().Add(wait)
+	var series map[string][]float64
+	for {
+		var latest time.Time
+		var err error
+		series, latest, err = loadMetrics(client, queries, s.Start.Truncate(time.Minute).Add(-5*time.Minute), s.End.Add(time.Minute))
+		if err != nil {
+			fmt.Println("Got an error retrieving the instance metrics:")
+			fmt.Println(err)
+			return
+		}
+		if !latest.Before(lastPeriod) || time.Now().After(deadline) {
+			break
+		}
+		log.Printf("Waiting for CloudWatch to report the instance's CPU during the test...")
+		time.Sleep(30 * time.Second)
+	}
+
+	cpuMax := series["cpuMax"]
+	if len(cpuMax) == 0 {
+		fmt.Println("CloudWatch has no CPU metrics of the instance for the test yet")
+		return
+	}
+	peak := maxValue(cpuMax)
+	fmt.Printf("CPU:       %.0f%% average, %.0f%% peak on %s\n", average(series["cpuAvg"]), peak, state.InstanceType)
+
+	var findings []string
+	if peak >= 80 {
+		findings = append(findings, fmt.Sprintf("CPU reached %.0f%%, %s is at its limit at %d requests per second", peak, state.InstanceType, s.RPS))
+	}
+	if credits := series["credits"]; burstable && len(credits) > 1 {
+		// Datapoints are newest first.
+		first, last := credits[len(credits)-1], credits[0]
+		fmt.Printf("Credits:   %.0f at the start, %.0f at the end\n", first, last)
+		if last < first {
+			findings = append(findings, fmt.Sprintf("%s spent CPU credits, it cannot keep up this load once they run out; consider a larger or non-burstable type", state.InstanceType))
+		}
+	}
+	if surplus := series["surplus"]; len(surplus) > 0 && sum(surplus) > 0 {
+		findings = append(findings, fmt.Sprintf("the instance was charged for %.1f surplus CPU credits", sum(surplus)))
+	}
+	if s.errorRate() > 1 {
+		findings = append(findings, fmt.Sprintf("%.1f%% of the requests failed", s.errorRate()))
+	}
+
+	if len(findings) == 0 {
+		fmt.Printf("%s handled %d requests per second\n", state.InstanceType, s.RPS)
+		return
+	}
+	for _, f := range findings {
+		fmt.Println("Sizing: " + f)
+	}
+}
+
+// loadMetrics returns the values of each query, newest first, and the time
+// of the newest datapoint.
+func loadMetrics(client *cloudwatch.Client, queries []cwtypes.MetricDataQuery, start time.Time, end time.Time) (map[string][]float64, time.Time, error) {
+	result, err := client.GetMetricData(context.TODO(), &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: queries,
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		ScanBy:            cwtypes.ScanByTimestampDescending,
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	series := map[string][]float64{}
+	var latest time.Time
+	for _, r := range result.MetricDataResults {
+		series[aws.ToString(r.Id)] = r.Values
+		if len(r.Timestamps) > 0 && r.Timestamps[0].After(latest) {
+			latest = r.Timestamps[0]
+		}
+	}
+	return series, latest, nil
+}
+
+func maxValue(values []float64) float64 {
+	m := 0.0
+	for _, v := range values {
+		m = math.Max(m, v)
+	}
+	return m
+}
+
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return sum(values) / float64(len(values))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// staleLockAge is how old a lock from another machine, whose process the
+// tool cannot check, has to be before it is taken over.
+const staleLockAge = 12 * time.Hour
+
+// stackLock is the content of a stack's lock file.
+type stackLock struct {
+	Command string    `json:"command"`
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Since   time.Time `json:"since"`
+}
+
+func lockPath(name string) string {
+	return filepath.Join(stateDir(), name+".lock")
+}
+
+func (l stackLock) String() string {
+	return fmt.Sprintf("%s (pid %d on %s, since %s)", l.Command, l.PID, l.Host, l.Since.Local().Format(time.RFC1123))
+}
+
+// stale reports whether the run holding the lock is gone: its process no
+// longer exists on this machine, or the lock is too old to still be held.
+func (l stackLock) stale() bool {
+	host, _ := os.Hostname()
+	if l.Host == host && !processAlive(l.PID) {
+		return true
+	}
+	return time.Since(l.Since) > staleLockAge
+}
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows finding the process already means it exists.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+func readLock(name string) (*stackLock, error) {
+	data, err := ioutil.ReadFile(lockPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return parseLock(name, data)
+}
+
+func parseLock(name string, data []byte) (*stackLock, error) {
+	l := &stackLock{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("reading the lock of stack %s: %w", name, err)
+	}
+	return l, nil
+}
+
+// lockStack keeps other runs of the tool away from the stack until the
+// returned function is called. It returns nil, after saying why, when
+// another run holds the lock. A stale lock is taken over.
+func lockStack(name string, command string) func() {
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		fmt.Println("Got an error locking the stack:")
+		fmt.Println(err)
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	data, _ := json.Marshal(stackLock{Command: command, PID: os.Getpid(), Host: host, Since: time.Now().UTC()})
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lockPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath(name))
+				fmt.Println("Got an error locking the stack:")
+				fmt.Println(err)
+				return nil
+			}
+			return func() { os.Remove(lockPath(name)) }
+		}
+		if !errors.Is(err, os.ErrExist) {
+			fmt.Println("Got an error locking the stack:")
+			fmt.Println(err)
+			return nil
+		}
+
+		raw, err := ioutil.ReadFile(lockPath(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Println("Got an error locking the stack:")
+			fmt.Println(err)
+			return nil
+		}
+		held, err := parseLock(name, raw)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		if !held.stale() {
+			fmt.Printf("Stack %s is locked by %s\n", name, held)
+			fmt.Printf("If that run is gone, remove the lock with aws-wp force-unlock -name %s\n", name)
+			return nil
+		}
+		fmt.Printf("Taking over the stale lock of %s\n", held)
+		if err := removeStaleLock(name, raw); err != nil {
+			fmt.Println("Got an error locking the stack:")
+			fmt.Println(err)
+			return nil
+		}
+	}
+
+	fmt.Printf("Stack %s is being locked by another run\n", name)
+	return nil
+}
+
+// removeStaleLock removes the lock file when it still holds stale. Two runs
+// may both find the same stale lock, and the slower one must not remove the
+// lock the faster one has created since. The file is therefore renamed out
+// of the way first, which only one run can do, and put back when it turns
+// out to be a fresh lock.
+func removeStaleLock(name string, stale []byte) error {
+	aside := fmt.Sprintf("%s.%d-%d", lockPath(name), os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockPath(name), aside); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := ioutil.ReadFile(aside)
+	if err == nil && bytes.Equal(data, stale) {
+		return os.Remove(aside)
+	}
+	// Link rather than rename back, so that a lock created in between is
+	// not replaced.
+	err = os.Link(aside, lockPath(name))
+	os.Remove(aside)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// forceUnlock removes the lock of a run that is gone but still looks alive,
+// e.g. one that was killed on another machine.
+func forceUnlock(args []string) {
+	fs := flag.NewFlagSet("force-unlock", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	held, err := readLock(env.name)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Stack %s is not locked\n", env.name)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	question := fmt.Sprintf("Stack %s is locked by %s. Remove the lock?", env.name, held)
+	if !*yes && !confirm(question) {
+		return
+	}
+	if err := os.Remove(lockPath(env.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Got an error removing the lock:")
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Unlocked stack %s\n", env.name)
+}
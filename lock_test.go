@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeLock(t *testing.T, name string, l stackLock) []byte {
+	t.Helper()
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(lockPath(name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// lockFiles lists what is left in the state directory.
+func lockFiles(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(stateDir(), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestLockStack(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   *stackLock
+		locked bool
+	}{
+		{name: "unlocked", locked: true},
+		{name: "held by a live run", held: &stackLock{Command: "create", PID: os.Getpid(), Host: "elsewhere", Since: time.Now()}},
+		{name: "held too long", held: &stackLock{Command: "create", PID: 1, Host: "elsewhere", Since: time.Now().Add(-staleLockAge - time.Minute)}, locked: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("AWS_WP_HOME", t.TempDir())
+			if test.held != nil {
+				writeLock(t, "blog", *test.held)
+			}
+			unlock := lockStack("blog", "test")
+			if (unlock != nil) != test.locked {
+				t.Fatalf("lockStack locked %t, want %t", unlock != nil, test.locked)
+			}
+			if unlock == nil {
+				return
+			}
+			held, err := readLock("blog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held.PID != os.Getpid() || held.Command != "test" {
+				t.Errorf("the lock is held by %s", held)
+			}
+			if lockStack("blog", "again") != nil {
+				t.Error("locked a stack that is already locked")
+			}
+			unlock()
+			if files := lockFiles(t); len(files) != 0 {
+				t.Errorf("unlock left %v", files)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+	old := stackLock{Command: "create", PID: 1, Host: "elsewhere", Since: time.Now().Add(-24 * time.Hour)}
+	fresh := stackLock{Command: "replace", PID: 2, Host: "elsewhere", Since: time.Now()}
+
+	t.Run("removes the stale lock", func(t *testing.T) {
+		t.Setenv("AWS_WP_HOME", t.TempDir())
+		stale := writeLock(t, "blog", old)
+		if err := removeStaleLock("blog", stale); err != nil {
+			t.Fatal(err)
+		}
+		if files := lockFiles(t); len(files) != 0 {
+			t.Errorf("left %v", files)
+		}
+	})
+
+	t.Run("keeps a lock taken over by another run", func(t *testing.T) {
+		t.Setenv("AWS_WP_HOME", t.TempDir())
+		stale := writeLock(t, "blog", old)
+		current := writeLock(t, "blog", fresh)
+		if err := removeStaleLock("blog", stale); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(lockPath("blog"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(current) {
+			t.Errorf("the lock holds %s, want %s", data, current)
+		}
+		if files := lockFiles(t); len(files) != 1 {
+			t.Errorf("left %v", files)
+		}
+	})
+
+	t.Run("ignores a lock removed by another run", func(t *testing.T) {
+		t.Setenv("AWS_WP_HOME", t.TempDir())
+		stale := writeLock(t, "blog", old)
+		os.Remove(lockPath("blog"))
+		if err := removeStaleLock("blog", stale); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// errorLogGroup is where the web server's error log is expected, next to
+// accessLogGroup. PHP fatal errors end up there both under mod_php and,
+// relayed by proxy_fcgi, under php-fpm.
+func errorLogGroup(stack string) string {
+	return "/aws-wp/" + stack + "/error"
+}
+
+func logMetricsNamespace(stack string) string {
+	return "aws-wp/" + stack
+}
+
+// logMetric is a metric filter over one of the shipped logs and the alarm
+// on its sum over five minutes.
+type logMetric struct {
+	name        string
+	metric      string
+	logGroup    func(stack string) string
+	pattern     string
+	description string
+}
+
+// The access log patterns expect the combined log format, whose bracketed
+// time and quoted request count as single fields. A failed WordPress login
+// shows the form again with a 200, a successful one redirects.
+var logMetrics = []logMetric{
+	{
+		name:        "php-fatal",
+		metric:      "PHPFatalErrors",
+		logGroup:    errorLogGroup,
+		pattern:     `"PHP Fatal error"`,
+		description: "PHP fatal errors",
+	},
+	{
+		name:        "5xx",
+		metric:      "ServerErrors",
+		logGroup:    accessLogGroup,
+		pattern:     `[client, ident, user, time, request, status=5*, bytes, referer, agent]`,
+		description: "5xx responses",
+	},
+	{
+		name:        "failed-logins",
+		metric:      "FailedLogins",
+		logGroup:    accessLogGroup,
+		pattern:     `[client, ident, user, time, request="POST /wp-login.php*", status=200, bytes, referer, agent]`,
+		description: "failed logins",
+	},
+}
+
+func logMetricName(stack string, m logMetric) string {
+	return "aws-wp-" + stack + "-" + m.name
+}
+
+// logmetrics turns the logs a stack ships to CloudWatch Logs into alarms on
+// what goes wrong inside WordPress: "logmetrics enable" creates the metric
+// filters and alarms, "logmetrics disable" deletes them. Shipping the logs
+// is left to the image or a hook, as with the CloudWatch agent.
+func logmetrics(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp logmetrics enable|disable [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "enable":
+		enableLogMetrics(args[1:])
+	case "disable":
+		disableLogMetrics(args[1:])
+	default:
+		fmt.Printf("Unknown logmetrics command %q, expected enable or disable\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func enableLogMetrics(args []string) {
+	fs := flag.NewFlagSet("logmetrics enable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	thresholds := map[string]*int{
+		"php-fatal":     fs.Int("php-fatal", 1, "Alarm at this many PHP fatal errors in 5 minutes"),
+		"5xx":           fs.Int("5xx", 10, "Alarm at this many 5xx responses in 5 minutes"),
+		"failed-logins": fs.Int("failed-logins", 20, "Alarm at this many failed logins in 5 minutes"),
+	}
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for name, threshold := range thresholds {
+		if *threshold < 1 {
+			fmt.Printf("-%s must be at least 1\n", name)
+			return
+		}
+	}
+
+	unlock := lockStack(env.name, "logmetrics enable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+
+	logsClient := cloudwatchlogs.NewFromConfig(env.aws)
+	for _, group := range []string{accessLogGroup(state.Name), errorLogGroup(state.Name)} {
+		_, err := logsClient.CreateLogGroup(context.TODO(), &cloudwatchlogs.CreateLogGroupInput{
+			LogGroupName: aws.String(group),
+			Tags:         map[string]string{stackTag: state.Name},
+		})
+		if err != nil && !isErrorCode(err, "ResourceAlreadyExistsException") {
+			fmt.Println("Got an error creating the log group:")
+			fmt.Println(err)
+			return
+		}
+	}
+
+	actions := notifyTopics(env)
+	if len(actions) == 0 {
+		fmt.Println("The config has no sns notify sink, the alarms will only show in CloudWatch")
+	}
+
+	cwClient := cloudwatch.NewFromConfig(env.aws)
+	var alarms []string
+	for _, m := range logMetrics {
+		name := logMetricName(state.Name, m)
+		_, err := logsClient.PutMetricFilter(context.TODO(), &cloudwatchlogs.PutMetricFilterInput{
+			FilterName:    aws.String(name),
+			FilterPattern: aws.String(m.pattern),
+			LogGroupName:  aws.String(m.logGroup(state.Name)),
+			MetricTransformations: []types.MetricTransformation{{
+				MetricName:      aws.String(m.metric),
+				MetricNamespace: aws.String(logMetricsNamespace(state.Name)),
+				MetricValue:     aws.String("1"),
+				DefaultValue:    aws.Float64(0),
+			}},
+		})
+		if err != nil {
+			fmt.Println("Got an error creating the metric filter:")
+			fmt.Println(err)
+			break
+		}
+
+		_, err = cwClient.PutMetricAlarm(context.TODO(), &cloudwatch.PutMetricAlarmInput{
+			AlarmName:          aws.String(name),
+			AlarmDescription:   aws.String("Too many " + m.description + " on the WordPress site of stack " + state.Name),
+			Namespace:          aws.String(logMetricsNamespace(state.Name)),
+			MetricName:         aws.String(m.metric),
+			Statistic:          cwtypes.StatisticSum,
+			Period:             aws.Int32(300),
+			EvaluationPeriods:  aws.Int32(1),
+			Threshold:          aws.Float64(float64(*thresholds[m.name])),
+			ComparisonOperator: cwtypes.ComparisonOperatorGreaterThanOrEqualToThreshold,
+			TreatMissingData:   aws.String("notBreaching"),
+			AlarmActions:       actions,
+			OKActions:          actions,
+			Tags:               []cwtypes.Tag{{Key: aws.String(stackTag), Value: aws.String(state.Name)}},
+		})
+		if err != nil {
+			fmt.Println("Got an error creating the alarm:")
+			fmt.Println(err)
+			break
+		}
+		alarms = append(alarms, name)
+		fmt.Printf("Alarm %s at %d %s in 5 minutes\n", name, *thresholds[m.name], m.description)
+	}
+
+	// Record what got created even when a later filter failed, so destroy
+	// finds it.
+	state.LogAlarms = alarms
+	saveStackState(state)
+	if len(alarms) == len(logMetrics) {
+		emit(eventLogMetricsEnabled, "namespace", logMetricsNamespace(state.Name))
+		fmt.Printf("Ship the access and error logs to %s and %s\n", accessLogGroup(state.Name), errorLogGroup(state.Name))
+	}
+}
+
+// notifyTopics are the SNS topics of the config's sns notify sinks, which
+// CloudWatch alarms can notify directly.
+func notifyTopics(env *environment) []string {
+	var topics []string
+	for _, c := range env.config.Notify {
+		if c.Type == "sns" {
+			topics = append(topics, c.TopicArn)
+		}
+	}
+	return topics
+}
+
+func disableLogMetrics(args []string) {
+	fs := flag.NewFlagSet("logmetrics disable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "logmetrics disable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if len(state.LogAlarms) == 0 {
+		fmt.Printf("Stack %s has no log metric alarms\n", state.Name)
+		return
+	}
+	if deleteLogMetrics(env, state) {
+		fmt.Println("The log groups and their logs are kept")
+	}
+}
+
+// deleteLogMetrics deletes the stack's metric filters and their alarms. The
+// log groups stay, with whatever was shipped to them.
+func deleteLogMetrics(env *environment, state *stackState) bool {
+	client := cloudwatchlogs.NewFromConfig(env.aws)
+	for _, m := range logMetrics {
+		_, err := client.DeleteMetricFilter(context.TODO(), &cloudwatchlogs.DeleteMetricFilterInput{
+			FilterName:   aws.String(logMetricName(state.Name, m)),
+			LogGroupName: aws.String(m.logGroup(state.Name)),
+		})
+		if err != nil && !isErrorCode(err, "ResourceNotFoundException") {
+			fmt.Println("Got an error deleting the metric filter:")
+			fmt.Println(err)
+			return false
+		}
+	}
+	if !deleteAlarms(cloudwatch.NewFromConfig(env.aws), state.LogAlarms...) {
+		return false
+	}
+	emit(eventLogMetricsDeleted, "namespace", logMetricsNamespace(state.Name))
+	state.LogAlarms = nil
+	saveStackState(state)
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMessages are the English texts of list and status. A catalog at
+// $AWS_WP_HOME/messages/<language>.yaml replaces any of them, keeping the
+// fmt verbs of each text in their order:
+//
+//	status.stack: Stapel
+//	maintenance.scheduled: "%s geplant für %s: %s"
+var defaultMessages = map[string]string{
+	"list.name":     "NAME",
+	"list.region":   "REGION",
+	"list.instance": "INSTANCE",
+	"list.state":    "STATE",
+	"list.url":      "URL",
+	"list.empty":    "No stacks",
+
+	"status.stack":            "Stack",
+	"status.region":           "Region",
+	"status.instance":         "Instance",
+	"status.image":            "Image",
+	"status.url":              "URL",
+	"status.domain":           "Domain",
+	"status.load_balancer":    "Load balancer",
+	"status.login_limit":      "Login rate limit",
+	"status.login_limit_per":  "%d requests per IP and 5 minutes",
+	"status.elastic_ip":       "Elastic IP",
+	"status.elastic_ip_kept":  "yours, kept on destroy",
+	"status.elastic_ip_owned": "allocated by the stack, released on destroy",
+	"status.created":          "Created",
+	"status.expires":          "Expires",
+	"status.schedule":         "Schedule",
+	"status.next_transition":  "Next transition",
+	"status.schedule_start":   "starts %s",
+	"status.schedule_stop":    "stops %s",
+	"status.bootstrap":        "Bootstrap",
+	"status.php":              "PHP",
+	"status.status_page":      "Status page",
+	"status.disk":             "Disk",
+	"status.disk_used":        "%.1f%% of / used",
+	"status.memory":           "Memory",
+	"status.memory_used":      "%.1f%% used",
+	"status.inodes":           "Inodes",
+	"status.inodes_used":      "%.1f%% of / used (%.0f of %.0f)",
+	"status.disk_alarm":       "Disk alarm",
+	"status.disk_alarm_at":    "%s at %d%%",
+	"status.log_alarms":       "Log alarms",
+	"status.maintenance":      "Maintenance",
+	"status.move_before":      "Run aws-wp replace -name %s to move the stack before %s.",
+
+	"maintenance.scheduled":        "Scheduled %s on %s: %s",
+	"maintenance.image_gone":       "Image %s is no longer available",
+	"maintenance.image_deprecates": "Image %s will be deprecated on %s",
+	"maintenance.image_deprecated": "Image %s was deprecated on %s",
+
+	"state.unknown": "unknown",
+}
+
+// messages are the texts in use, the defaults until a catalog is loaded.
+var messages = defaultMessages
+
+// msg formats the text of key with args.
+func msg(key string, args ...interface{}) string {
+	text, ok := messages[key]
+	if !ok {
+		text = defaultMessages[key]
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+func catalogPath(language string) string {
+	return filepath.Join(homeDir(), "messages", language+".yaml")
+}
+
+// loadMessages loads the catalog of language, as set in the config file or
+// $AWS_WP_LANG. Without either the language comes from $LANG, de_DE.UTF-8
+// trying de_DE and then de, and English is used when there is no catalog
+// for it.
+func loadMessages(language string) error {
+	messages = defaultMessages
+
+	explicit := language != "" || os.Getenv("AWS_WP_LANG") != ""
+	var candidates []string
+	switch {
+	case language != "":
+		candidates = []string{language}
+	case os.Getenv("AWS_WP_LANG") != "":
+		candidates = []string{os.Getenv("AWS_WP_LANG")}
+	default:
+		locale := os.Getenv("LANG")
+		if i := strings.IndexAny(locale, ".@"); i >= 0 {
+			locale = locale[:i]
+		}
+		if locale == "" || locale == "C" || locale == "POSIX" {
+			return nil
+		}
+		candidates = []string{locale}
+		if i := strings.Index(locale, "_"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+	}
+
+	for _, candidate := range candidates {
+		data, err := ioutil.ReadFile(catalogPath(candidate))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading the message catalog: %w", err)
+		}
+		catalog := map[string]string{}
+		if err := yaml.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("parsing %s: %w", catalogPath(candidate), err)
+		}
+		return useCatalog(catalogPath(candidate), catalog)
+	}
+
+	if explicit {
+		return fmt.Errorf("no message catalog for language %q at %s", candidates[0], catalogPath(candidates[0]))
+	}
+	return nil
+}
+
+// useCatalog puts the catalog's texts over the defaults. Unknown keys are
+// refused, so a misspelt key does not silently keep the English text.
+func useCatalog(path string, catalog map[string]string) error {
+	var unknown []string
+	merged := map[string]string{}
+	for k, v := range defaultMessages {
+		merged[k] = v
+	}
+	for k, v := range catalog {
+		if _, ok := defaultMessages[k]; !ok {
+			unknown = append(unknown, k)
+			continue
+		}
+		merged[k] = v
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown messages %s", path, strings.Join(unknown, ", "))
+	}
+	messages = merged
+	return nil
+}
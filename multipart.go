@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// syncExportDir is where the source keeps the export until the target
+	// imported it, and syncImportDir where the target keeps the downloads.
+	// Both survive a reboot, unlike /tmp on some images.
+	syncExportDir = "/var/tmp/aws-wp-sync"
+	syncImportDir = "/var/tmp/aws-wp-sync-import"
+
+	// syncPartSize is the size of the parts the export is uploaded in. S3
+	// allows 10,000 parts, so an archive can be up to 625 GiB.
+	syncPartSize = 64 << 20
+	syncMaxParts = 10000
+
+	// syncExportMaxAge is how long an interrupted export can be resumed,
+	// short of the day after which its bucket expires it.
+	syncExportMaxAge = 20 * time.Hour
+
+	// syncMaxTimeout is the longest SSM lets a command run.
+	syncMaxTimeout = 48 * time.Hour
+)
+
+// siteExport is the export of a sync, kept in the source stack's state until
+// the target imported it, so that running the sync again after an
+// interruption picks up the multipart uploads where they stopped.
+type siteExport struct {
+	Target    string       `json:"target"`
+	Bucket    string       `json:"bucket"`
+	Files     []exportFile `json:"files"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// exportFile is one archive of the export and its multipart upload.
+type exportFile struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	UploadId string `json:"upload_id"`
+	Uploaded bool   `json:"uploaded,omitempty"`
+}
+
+func (f exportFile) parts() int32 {
+	if f.Size == 0 {
+		return 1
+	}
+	return int32((f.Size + syncPartSize - 1) / syncPartSize)
+}
+
+// uploadParams are the values sync-upload.sh is rendered with.
+type uploadParams struct {
+	Dir         string
+	PartSize    int64
+	Concurrency int
+	RateLimit   string
+	Files       []exportFile
+	Parts       []uploadPart
+}
+
+type uploadPart struct {
+	Key    string
+	Number int32
+	URL    string
+}
+
+// syncTransfer holds how fast a sync may move the site: how many parts the
+// source uploads at once and the bytes per second, 0 for no limit, that
+// the uploads share and the downloads get.
+type syncTransfer struct {
+	client      *s3.Client
+	concurrency int
+	bandwidth   int64
+}
+
+// timeout is how long moving size bytes may take: twice what the bandwidth
+// limit allows, and at least syncTimeout. It bounds the command doing it and
+// the URLs it uses.
+func (t *syncTransfer) timeout(size int64) time.Duration {
+	timeout := syncTimeout
+	if t.bandwidth > 0 {
+		if d := 2 * time.Duration(size/t.bandwidth) * time.Second; d > timeout {
+			timeout = d
+		}
+	}
+	if timeout > syncMaxTimeout {
+		timeout = syncMaxTimeout
+	}
+	return timeout
+}
+
+// rateLimit is the curl --limit-rate of each of n transfers at once.
+func (t *syncTransfer) rateLimit(n int) string {
+	if t.bandwidth == 0 {
+		return ""
+	}
+	rate := t.bandwidth / int64(n)
+	if rate < 1 {
+		rate = 1
+	}
+	return strconv.FormatInt(rate, 10)
+}
+
+// startUploads reads the archives sync-export.sh printed into the export and
+// starts their multipart uploads.
+func (t *syncTransfer) startUploads(export *siteExport, output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		var f exportFile
+		if n, _ := fmt.Sscanf(line, "Exported %s %d bytes sha256 %s", &f.Key, &f.Size, &f.SHA256); n == 3 {
+			export.Files = append(export.Files, f)
+		}
+	}
+	if len(export.Files) != 2 {
+		fmt.Println("Got an error: the export did not list its archives")
+		return false
+	}
+
+	for i := range export.Files {
+		f := &export.Files[i]
+		if f.parts() > syncMaxParts {
+			fmt.Printf("Got an error: %s is %d bytes, more than S3 takes in %d parts of %d\n", f.Key, f.Size, syncMaxParts, syncPartSize)
+			return false
+		}
+		result, err := t.client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(export.Bucket),
+			Key:    aws.String(f.Key),
+		})
+		if err != nil {
+			fmt.Println("Got an error starting the multipart upload:")
+			fmt.Println(err)
+			return false
+		}
+		f.UploadId = aws.ToString(result.UploadId)
+	}
+	return true
+}
+
+// upload has the source upload the parts of each archive that S3 does not
+// have yet, in rounds of a few parts per concurrent upload, each with URLs
+// of its own, and completes the upload once S3 has them all. The parts S3
+// keeps are checked against the MD5s the source computed.
+func (t *syncTransfer) upload(cfg aws.Config, source *stackState) bool {
+	export := source.Export
+	for i := range export.Files {
+		f := &export.Files[i]
+		if f.Uploaded {
+			continue
+		}
+
+		checksums := map[int32]string{}
+		for {
+			parts := t.listParts(export.Bucket, *f)
+			if parts == nil {
+				return false
+			}
+			for number, checksum := range checksums {
+				if etag := strings.Trim(aws.ToString(parts[number].ETag), `"`); etag != checksum {
+					fmt.Printf("Got an error: S3 has part %d of %s with MD5 %s, the source sent %s\n", number, f.Key, etag, checksum)
+					return false
+				}
+			}
+
+			var missing []int32
+			for number := int32(1); number <= f.parts(); number++ {
+				if _, ok := parts[number]; !ok {
+					missing = append(missing, number)
+				}
+			}
+			if len(missing) == 0 {
+				break
+			}
+			fmt.Printf("Uploading %s: %d of %d parts done\n", f.Key, int(f.parts())-len(missing), f.parts())
+
+			if len(missing) > 4*t.concurrency {
+				missing = missing[:4*t.concurrency]
+			}
+			timeout := t.timeout(int64(len(missing)) * syncPartSize)
+			presign := s3.NewPresignClient(t.client, s3.WithPresignExpires(timeout))
+			params := uploadParams{
+				Dir:         syncExportDir,
+				PartSize:    syncPartSize,
+				Concurrency: t.concurrency,
+				RateLimit:   t.rateLimit(t.concurrency),
+				Files:       export.Files,
+			}
+			for _, number := range missing {
+				put, err := presign.PresignUploadPart(context.TODO(), &s3.UploadPartInput{
+					Bucket:     aws.String(export.Bucket),
+					Key:        aws.String(f.Key),
+					UploadId:   aws.String(f.UploadId),
+					PartNumber: number,
+				})
+				if err != nil {
+					fmt.Println("Got an error presigning the upload:")
+					fmt.Println(err)
+					return false
+				}
+				params.Parts = append(params.Parts, uploadPart{Key: f.Key, Number: number, URL: put.URL})
+			}
+
+			output, err := runSyncScript(cfg, source.InstanceId, "sync-upload.sh", params, timeout)
+			for _, line := range strings.Split(output, "\n") {
+				var key, checksum string
+				var number int32
+				if n, _ := fmt.Sscanf(line, "Uploaded %s part %d md5 %s", &key, &number, &checksum); n == 3 && key == f.Key {
+					checksums[number] = checksum
+				}
+			}
+			if err != nil {
+				fmt.Println("Got an error uploading the export, run sync again to resume:")
+				fmt.Println(err)
+				return false
+			}
+		}
+
+		if !t.completeUpload(export.Bucket, *f) {
+			return false
+		}
+		f.Uploaded = true
+		saveStackState(source)
+	}
+	return true
+}
+
+// listParts returns the parts S3 has of the file's upload by number, nil
+// when it cannot tell.
+func (t *syncTransfer) listParts(bucket string, f exportFile) map[int32]types.Part {
+	paginator := s3.NewListPartsPaginator(t.client, &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(f.Key),
+		UploadId: aws.String(f.UploadId),
+	})
+
+	parts := map[int32]types.Part{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			fmt.Println("Got an error listing the uploaded parts:")
+			fmt.Println(err)
+			return nil
+		}
+		for _, p := range page.Parts {
+			parts[p.PartNumber] = p
+		}
+	}
+	return parts
+}
+
+func (t *syncTransfer) completeUpload(bucket string, f exportFile) bool {
+	parts := t.listParts(bucket, f)
+	if parts == nil {
+		return false
+	}
+	var completed []types.CompletedPart
+	for number, p := range parts {
+		completed = append(completed, types.CompletedPart{ETag: p.ETag, PartNumber: number})
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+
+	_, err := t.client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(f.Key),
+		UploadId:        aws.String(f.UploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		fmt.Println("Got an error completing the multipart upload:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// parseBandwidth parses a -bandwidth value: bytes per second, with an
+// optional K, M or G suffix.
+func parseBandwidth(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	number, multiplier := value, int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid -bandwidth %q, expected bytes per second like 20M", value)
+	}
+	return n * multiplier, nil
+}
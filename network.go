@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// caBundleEnv is the AWS-standard variable pointing at a PEM file with
+// additional certificate authorities.
+const caBundleEnv = "AWS_CA_BUNDLE"
+
+// readCABundle returns the PEM contents of the CA bundle given with
+// -ca-bundle, falling back to AWS_CA_BUNDLE. It returns nil when neither is set.
+func readCABundle(path string) ([]byte, error) {
+	if path == "" {
+		path = os.Getenv(caBundleEnv)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+	return pem, nil
+}
+
+// loadConfig loads the shared AWS configuration. Requests go through the
+// proxies named by HTTPS_PROXY, HTTP_PROXY and NO_PROXY. When caBundle is
+// set, AWS endpoints are verified against it alone, the same way the AWS CLI
+// treats --ca-bundle.
+func loadConfig(caBundle []byte) aws.Config {
+	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = http.ProxyFromEnvironment
+	})
+
+	options := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(httpClient),
+	}
+	if caBundle != nil {
+		options = append(options, config.WithCustomCABundle(bytes.NewReader(caBundle)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		panic("Configuration error, " + err.Error())
+	}
+	return cfg
+}
+
+// newHTTPClient returns the client used to probe the site itself. It honors
+// the same proxy variables as the SDK and trusts caBundle on top of the
+// system roots, since the site may be reached directly or through a
+// TLS-intercepting proxy.
+func newHTTPClient(caBundle []byte) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if caBundle != nil {
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}, nil
+}
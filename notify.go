@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// notifyTimeout bounds each delivery, so a slow endpoint cannot hold up
+// the command.
+const notifyTimeout = 10 * time.Second
+
+// defaultNotifyEvents are sent to a sink that does not list its own.
+var defaultNotifyEvents = []string{
+	eventHealthOK,
+	eventHealthFailed,
+	eventHookFailed,
+	eventInstanceReplaced,
+	eventInstanceTerminated,
+	eventTrafficRolledBack,
+	eventVolumeRestored,
+}
+
+// notification is an event about a stack, as sinks deliver it.
+type notification struct {
+	Stack string            `json:"stack"`
+	Time  time.Time         `json:"time"`
+	Event string            `json:"event"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+func (n notification) subject() string {
+	return fmt.Sprintf("aws-wp %s: %s", n.Stack, n.Event)
+}
+
+// text is the notification as one line: the subject and the data sorted by
+// key.
+func (n notification) text() string {
+	keys := make([]string, 0, len(n.Data))
+	for k := range n.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(n.subject())
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, n.Data[k])
+	}
+	return b.String()
+}
+
+// notifier delivers notifications to one channel.
+type notifier interface {
+	notify(ctx context.Context, n notification) error
+}
+
+// notifyConfig is an entry under notify in the config file. Which fields
+// apply depends on the type.
+type notifyConfig struct {
+	Type     string   `yaml:"type"`
+	Events   []string `yaml:"events"`
+	TopicArn string   `yaml:"topic_arn"`
+	URL      string   `yaml:"url"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// notifierTypes builds the notifier of each type. A new channel only needs
+// an entry here.
+var notifierTypes = map[string]struct {
+	validate func(c notifyConfig) error
+	build    func(env *environment, c notifyConfig) notifier
+}{
+	"sns": {
+		validate: func(c notifyConfig) error { return requireField(c, "topic_arn", c.TopicArn) },
+		build: func(env *environment, c notifyConfig) notifier {
+			return snsNotifier{client: sns.NewFromConfig(env.aws), topicArn: c.TopicArn}
+		},
+	},
+	"slack": {
+		validate: func(c notifyConfig) error { return requireField(c, "url", c.URL) },
+		build: func(env *environment, c notifyConfig) notifier {
+			return slackNotifier{client: env.http, url: c.URL}
+		},
+	},
+	"webhook": {
+		validate: func(c notifyConfig) error { return requireField(c, "url", c.URL) },
+		build: func(env *environment, c notifyConfig) notifier {
+			return webhookNotifier{client: env.http, url: c.URL}
+		},
+	},
+	"ses": {
+		validate: func(c notifyConfig) error {
+			if len(c.To) == 0 {
+				return requireField(c, "to", "")
+			}
+			return requireField(c, "from", c.From)
+		},
+		build: func(env *environment, c notifyConfig) notifier {
+			return sesNotifier{client: ses.NewFromConfig(env.aws), from: c.From, to: c.To}
+		},
+	},
+}
+
+func requireField(c notifyConfig, field string, value string) error {
+	if value == "" {
+		return fmt.Errorf("notify %s needs %s", c.Type, field)
+	}
+	return nil
+}
+
+func validateNotify(configs []notifyConfig) error {
+	for _, c := range configs {
+		t, ok := notifierTypes[c.Type]
+		if !ok {
+			return fmt.Errorf("unknown notify type %q, expected sns, slack, webhook or ses", c.Type)
+		}
+		if err := t.validate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sink is a configured notifier and the events it gets.
+type sink struct {
+	name     string
+	notifier notifier
+	events   map[string]bool
+}
+
+func (s sink) wants(event string) bool {
+	return s.events["*"] || s.events[event]
+}
+
+// sinks are set up from the config file when a command loads its options.
+var (
+	sinks       []sink
+	notifyStack string
+)
+
+// setupNotifiers replaces the sinks with those of the config. Nothing is
+// sent in read-only mode, where publishing would be refused anyway.
+func setupNotifiers(env *environment) {
+	sinks = nil
+	notifyStack = env.name
+	if readOnly {
+		return
+	}
+	for _, c := range env.config.Notify {
+		events := c.Events
+		if len(events) == 0 {
+			events = defaultNotifyEvents
+		}
+		s := sink{name: c.Type, notifier: notifierTypes[c.Type].build(env, c), events: map[string]bool{}}
+		for _, e := range events {
+			s.events[e] = true
+		}
+		sinks = append(sinks, s)
+	}
+}
+
+// notify delivers the event to every sink that wants it. Delivery problems
+// are reported and otherwise ignored, the operation itself went ahead.
+func notify(e event) {
+	n := notification{Stack: notifyStack, Time: e.Time, Event: e.Event, Data: e.Data}
+	for _, s := range sinks {
+		if !s.wants(e.Event) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err := s.notifier.notify(ctx, n)
+		cancel()
+		if err != nil {
+			fmt.Printf("Got an error sending a notification through %s:\n", s.name)
+			fmt.Println(err)
+		}
+	}
+}
+
+type snsNotifier struct {
+	client   *sns.Client
+	topicArn string
+}
+
+func (s snsNotifier) notify(ctx context.Context, n notification) error {
+	_, err := s.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicArn),
+		Subject:  aws.String(n.subject()),
+		Message:  aws.String(n.text()),
+	})
+	return err
+}
+
+type sesNotifier struct {
+	client *ses.Client
+	from   string
+	to     []string
+}
+
+func (s sesNotifier) notify(ctx context.Context, n notification) error {
+	_, err := s.client.SendEmail(ctx, &ses.SendEmailInput{
+		Source:      aws.String(s.from),
+		Destination: &sestypes.Destination{ToAddresses: s.to},
+		Message: &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String(n.subject())},
+			Body:    &sestypes.Body{Text: &sestypes.Content{Data: aws.String(n.text())}},
+		},
+	})
+	return err
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (s slackNotifier) notify(ctx context.Context, n notification) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": n.text()})
+}
+
+// webhookNotifier posts the notification as JSON.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (w webhookNotifier) notify(ctx context.Context, n notification) error {
+	return postJSON(ctx, w.client, w.url, n)
+}
+
+// postJSON leaves the endpoint out of its errors: webhook URLs, Slack's in
+// particular, carry their credential.
+func postJSON(ctx context.Context, client *http.Client, endpoint string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid notification URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the endpoint answered %s", resp.Status)
+	}
+	return nil
+}
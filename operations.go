@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Tags on the snapshots taken before an operation.
+const (
+	operationTag = "aws-wp:operation"
+	deviceTag    = "aws-wp:device"
+)
+
+// newOperationId names one run of a command that changes a stack, e.g.
+// op-20261014-153000-1a2b3c.
+func newOperationId() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return fmt.Sprintf("op-%s-%s", time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(suffix))
+}
+
+// launchToken is the RunInstances client token for the stack's launch in an
+// operation. Retries of the call then return the instance already launched
+// instead of starting another one.
+func launchToken(stack string, operationId string) string {
+	return stack + "-" + operationId
+}
+
+// interruptedLaunch finds the instance of a launch that was cut off before
+// its id made it into the state, by the client token recorded beforehand.
+// Such an instance has no tags yet, so nothing else would find it.
+func interruptedLaunch(client *ec2.Client, state *stackState) (string, bool) {
+	if state.LaunchToken == "" {
+		return "", true
+	}
+	result, err := client.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("client-token"), Values: []string{state.LaunchToken}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error looking for an interrupted launch:")
+		fmt.Println(err)
+		return "", false
+	}
+	for _, r := range result.Reservations {
+		for _, i := range r.Instances {
+			if id := aws.ToString(i.InstanceId); id != state.InstanceId {
+				return id, true
+			}
+		}
+	}
+	return "", true
+}
+
+// addSnapshotFlag registers -snapshot-before on a command that changes the
+// instance. It defaults to on for commands that are hard to undo otherwise.
+func addSnapshotFlag(fs *flag.FlagSet, defaultOn bool) *bool {
+	return fs.Bool("snapshot-before", defaultOn, "Snapshot the instance's volumes first, so aws-wp rollback can undo the operation")
+}
+
+// snapshotBefore snapshots all volumes of the stack's instance at once and
+// tags them with the operation. It does not wait for the snapshots to
+// complete; their content is fixed when they start.
+func snapshotBefore(client *ec2.Client, state *stackState, operationId string, command string) bool {
+	instance := describeInstance(client, state.InstanceId)
+	if instance == nil {
+		return false
+	}
+
+	devices := map[string]string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil {
+			devices[aws.ToString(mapping.Ebs.VolumeId)] = aws.ToString(mapping.DeviceName)
+		}
+	}
+
+	result, err := client.CreateSnapshots(context.TODO(), &ec2.CreateSnapshotsInput{
+		InstanceSpecification: &types.InstanceSpecification{
+			InstanceId: aws.String(state.InstanceId),
+		},
+		Description: aws.String(fmt.Sprintf("aws-wp %s of stack %s (%s)", command, state.Name, operationId)),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags: []types.Tag{
+					stackTagFor(state.Name),
+					{Key: aws.String(operationTag), Value: aws.String(operationId)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error snapshotting the instance volumes:")
+		fmt.Println(err)
+		return false
+	}
+
+	for _, snapshot := range result.Snapshots {
+		_, err := client.CreateTags(context.TODO(), &ec2.CreateTagsInput{
+			Resources: []string{aws.ToString(snapshot.SnapshotId)},
+			Tags: []types.Tag{
+				{Key: aws.String(deviceTag), Value: aws.String(devices[aws.ToString(snapshot.VolumeId)])},
+			},
+		})
+		if err != nil {
+			fmt.Println("Got an error tagging a snapshot:")
+			fmt.Println(err)
+			return false
+		}
+		emit(eventSnapshotStarted, "operation_id", operationId, "snapshot_id", aws.ToString(snapshot.SnapshotId))
+	}
+
+	fmt.Printf("Operation %s: snapshots taken, undo with aws-wp rollback -name %s %s\n", operationId, state.Name, operationId)
+	return true
+}
+
+// operationSnapshots returns the snapshots taken before the operation, or
+// before any operation on the stack when operationId is empty.
+func operationSnapshots(client *ec2.Client, stack string, operationId string) ([]types.Snapshot, error) {
+	filters := []types.Filter{
+		{Name: aws.String("tag:" + stackTag), Values: []string{stack}},
+		{Name: aws.String("tag-key"), Values: []string{operationTag}},
+	}
+	if operationId != "" {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + operationTag), Values: []string{operationId}})
+	}
+
+	var snapshots []types.Snapshot
+	paginator := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters:  filters,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+	}
+	return snapshots, nil
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
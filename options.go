@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// defaultStackName keeps the security group name, wordpress-sg, that
+// earlier versions of the tool used.
+const defaultStackName = "wordpress"
+
+// stackNamePattern keeps names short enough for the load balancer and target
+// group names derived from them, which AWS limits to 32 characters.
+var stackNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,23}$`)
+
+// globalOptions are the flags every command accepts.
+type globalOptions struct {
+	name         string
+	configPath   string
+	caBundlePath string
+	output       string
+	ci           bool
+	readOnly     bool
+	debugAWS     bool
+}
+
+func addGlobalFlags(fs *flag.FlagSet) *globalOptions {
+	o := &globalOptions{}
+	fs.StringVar(&o.name, "name", defaultStackName, "The stack name")
+	fs.StringVar(&o.configPath, "config", "", "Config file (defaults to "+defaultConfigFile+" when present)")
+	fs.StringVar(&o.caBundlePath, "ca-bundle", "", "PEM file with extra CA certificates (defaults to $AWS_CA_BUNDLE)")
+	fs.StringVar(&o.output, "output", "text", "Progress output: text or events (newline-delimited JSON)")
+	fs.BoolVar(&o.readOnly, "read-only", false, "Refuse every AWS call that would change something, for read-only credentials")
+	fs.BoolVar(&o.debugAWS, "debug-aws", false, "Log every AWS call with its duration, retries and request IDs, e.g. for a support case")
+	fs.BoolVar(&o.ci, "ci", false, "Non-interactive mode for CI: no prompts or browser, events output, outputs to $GITHUB_OUTPUT")
+	return o
+}
+
+// environment holds everything a command needs once its flags are parsed.
+type environment struct {
+	name   string
+	aws    aws.Config
+	http   *http.Client
+	config *fileConfig
+}
+
+func (o *globalOptions) load() (*environment, error) {
+	if o.ci {
+		ciMode = true
+		o.output = "events"
+	}
+	if err := setOutput(o.output); err != nil {
+		return nil, err
+	}
+	readOnly = o.readOnly
+
+	if !stackNamePattern.MatchString(o.name) {
+		return nil, fmt.Errorf("invalid stack name %q: use up to 24 lowercase letters, digits and dashes", o.name)
+	}
+
+	fileConfig, err := loadFileConfig(o.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadMessages(fileConfig.Language); err != nil {
+		return nil, err
+	}
+
+	caBundle, err := readCABundle(o.caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newHTTPClient(caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := loadConfig(caBundle)
+	cfg.APIOptions = append(cfg.APIOptions, addPermissionMiddleware)
+	if o.debugAWS {
+		cfg.APIOptions = append(cfg.APIOptions, addDebugMiddleware)
+	}
+
+	env := &environment{
+		name:   o.name,
+		aws:    cfg,
+		http:   httpClient,
+		config: fileConfig,
+	}
+	setupNotifiers(env)
+	return env, nil
+}
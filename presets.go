@@ -0,0 +1,156 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinPresets ship with the tool. Files in presetDir with the same name
+// take precedence.
+//
+//go:embed templates/*.yaml
+var builtinPresets embed.FS
+
+// preset bundles create flags under a name, so -preset blog-small stands in
+// for -instance-type, -volume-size, -ingress, -auto-recovery and -plugins.
+// Flags given explicitly still win over the preset.
+type preset struct {
+	Name         string        `yaml:"-"`
+	Description  string        `yaml:"description"`
+	InstanceType string        `yaml:"instance_type"`
+	VolumeSize   int32         `yaml:"volume_size"`
+	Ingress      []ingressRule `yaml:"ingress"`
+	HA           struct {
+		AutoRecovery bool `yaml:"auto_recovery"`
+	} `yaml:"ha"`
+	Plugins []string `yaml:"plugins"`
+}
+
+// presetDir holds user-defined presets, one <name>.yaml file each.
+func presetDir() string {
+	return filepath.Join(homeDir(), "templates")
+}
+
+// loadPresets returns the built-in presets merged with the user's.
+func loadPresets() (map[string]*preset, error) {
+	presets := map[string]*preset{}
+
+	builtin, _ := builtinPresets.ReadDir("templates")
+	for _, entry := range builtin {
+		data, err := builtinPresets.ReadFile(path.Join("templates", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := addPreset(presets, entry.Name(), data); err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := ioutil.ReadDir(presetDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range user {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(presetDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := addPreset(presets, entry.Name(), data); err != nil {
+			return nil, err
+		}
+	}
+
+	return presets, nil
+}
+
+func addPreset(presets map[string]*preset, file string, data []byte) error {
+	p := &preset{Name: strings.TrimSuffix(file, ".yaml")}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return fmt.Errorf("parsing preset %s: %w", file, err)
+	}
+	presets[p.Name] = p
+	return nil
+}
+
+// flagValues renders the preset as create flag values.
+func (p *preset) flagValues() map[string]string {
+	values := map[string]string{}
+	if p.InstanceType != "" {
+		values["instance-type"] = p.InstanceType
+	}
+	if p.VolumeSize != 0 {
+		values["volume-size"] = strconv.Itoa(int(p.VolumeSize))
+	}
+	if len(p.Ingress) > 0 {
+		values["ingress"] = formatIngress(p.Ingress)
+	}
+	if p.HA.AutoRecovery {
+		values["auto-recovery"] = "true"
+	}
+	if len(p.Plugins) > 0 {
+		values["plugins"] = strings.Join(p.Plugins, ",")
+	}
+	return values
+}
+
+// applyPreset sets every flag the preset defines unless it was given on the
+// command line.
+func applyPreset(fs *flag.FlagSet, name string) error {
+	presets, err := loadPresets()
+	if err != nil {
+		return err
+	}
+	p, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q, see aws-wp presets", name)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for flagName, value := range p.flagValues() {
+		if explicit[flagName] {
+			continue
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return fmt.Errorf("preset %s: -%s: %w", name, flagName, err)
+		}
+	}
+	return nil
+}
+
+func listPresets(args []string) {
+	fs := flag.NewFlagSet("presets", flag.ExitOnError)
+	fs.Parse(args)
+
+	presets, err := loadPresets()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%-16s %s\n", name, presets[name].Description)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// progressTimeout is how long waitBootstrapped waits for the first report
+// before falling back to HTTP checks alone, e.g. on images without the AWS
+// CLI.
+const progressTimeout = 3 * time.Minute
+
+func progressParameterName(stack string) string {
+	return "/aws-wp/" + stack + "/bootstrap"
+}
+
+// bootstrapProgress is what the bootstrap script writes to the progress
+// parameter.
+type bootstrapProgress struct {
+	InstanceId string `json:"instance_id"`
+	Percent    int    `json:"percent"`
+	Status     string `json:"status"`
+	Message    string `json:"message"`
+}
+
+// waitBootstrapped follows the progress reported by the instance until the
+// bootstrap is done. It returns false only when the bootstrap reported a
+// failure; silence is not an error, the HTTP checks that follow decide.
+func waitBootstrapped(client *ssm.Client, stack string, instanceId string) bool {
+	name := progressParameterName(stack)
+	start := time.Now()
+	last := bootstrapProgress{}
+
+	for time.Since(start) < healthTimeout {
+		progress, err := readProgress(client, name)
+		if err != nil && !isErrorCode(err, "ParameterNotFound") {
+			fmt.Println("Got an error reading bootstrap progress:")
+			fmt.Println(err)
+			return true
+		}
+
+		// The parameter may still hold the report of a previous instance.
+		if progress == nil || progress.InstanceId != instanceId {
+			if last.Status == "" && time.Since(start) > progressTimeout {
+				log.Printf("The instance reports no progress, waiting for the web server instead")
+				return true
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if *progress != last {
+			log.Printf("Bootstrap %d%%: %s", progress.Percent, progress.Message)
+			emit(eventBootstrapProgress, "instance_id", instanceId,
+				"percent", strconv.Itoa(progress.Percent), "status", progress.Status, "message", progress.Message)
+			last = *progress
+		}
+
+		switch progress.Status {
+		case "done":
+			return true
+		case "failed":
+			fmt.Println("Got an error bootstrapping the instance:")
+			fmt.Println(progress.Message)
+			return false
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return true
+}
+
+func readProgress(client *ssm.Client, name string) (*bootstrapProgress, error) {
+	result, err := client.GetParameter(context.TODO(), &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &bootstrapProgress{}
+	if err := json.Unmarshal([]byte(aws.ToString(result.Parameter.Value)), progress); err != nil {
+		return nil, nil
+	}
+	return progress, nil
+}
+
+func deleteProgressParameter(client *ssm.Client, stack string) bool {
+	_, err := client.DeleteParameter(context.TODO(), &ssm.DeleteParameterInput{
+		Name: aws.String(progressParameterName(stack)),
+	})
+	if err != nil && !isErrorCode(err, "ParameterNotFound") {
+		fmt.Println("Got an error deleting the bootstrap progress parameter:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
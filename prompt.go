@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// confirm asks a yes/no question on the terminal and defaults to no. In -ci
+// mode there is nobody to answer, so the answer is no.
+func confirm(question string) bool {
+	if ciMode {
+		fmt.Printf("%s Refusing in -ci mode, pass -yes\n", question)
+		return false
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
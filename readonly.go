@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// readOnly is set by -read-only. AWS calls that change anything are then
+// refused before they are sent, so describe-only commands such as status,
+// list and cost run with read-only credentials and the others stop at the
+// first call that would need more.
+var readOnly bool
+
+// readOperationPrefixes are the AWS operations that only read.
+var readOperationPrefixes = []string{"Describe", "Get", "List", "Lookup", "Search"}
+
+// readOperations are reads not named like one. Logs Insights queries only
+// read the logs.
+var readOperations = map[string]bool{
+	"StartQuery": true,
+}
+
+func isReadOperation(operation string) bool {
+	if readOperations[operation] {
+		return true
+	}
+	for _, prefix := range readOperationPrefixes {
+		if strings.HasPrefix(operation, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRefusedError is returned in place of a call -read-only refused.
+type writeRefusedError struct {
+	service   string
+	operation string
+}
+
+func (e *writeRefusedError) Error() string {
+	return fmt.Sprintf("read-only mode: %s:%s needs write permissions", e.service, e.operation)
+}
+
+// permissionError names the operation the credentials were not allowed to
+// call, which the service's own message often leaves out.
+type permissionError struct {
+	service   string
+	operation string
+	err       error
+}
+
+func (e *permissionError) Error() string {
+	return fmt.Sprintf("%s:%s is not allowed for these credentials: %v", e.service, e.operation, e.err)
+}
+
+func (e *permissionError) Unwrap() error {
+	return e.err
+}
+
+var permissionErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	"UnauthorizedOperation": true,
+}
+
+// addPermissionMiddleware refuses write calls in -read-only mode and points
+// out the operation when a call is denied. It runs after the SDK has
+// recorded which operation is being called.
+func addPermissionMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("aws-wp:permissions", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		service := awsmiddleware.GetServiceID(ctx)
+		operation := awsmiddleware.GetOperationName(ctx)
+
+		if readOnly && !isReadOperation(operation) {
+			emit(eventWriteRefused, "service", service, "operation", operation)
+			return middleware.InitializeOutput{}, middleware.Metadata{}, &writeRefusedError{service: service, operation: operation}
+		}
+
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && permissionErrorCodes[apiErr.ErrorCode()] {
+			err = &permissionError{service: service, operation: operation, err: err}
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func recoveryAlarmName(stack string) string {
+	return "aws-wp-" + stack + "-recover"
+}
+
+// createRecoveryAlarm moves the instance to healthy hardware when the system
+// status check fails for two minutes in a row.
+func createRecoveryAlarm(client *cloudwatch.Client, region string, stack string, instanceId string) string {
+	alarmName := recoveryAlarmName(stack)
+
+	alarmInput := &cloudwatch.PutMetricAlarmInput{
+		AlarmName:        aws.String(alarmName),
+		AlarmDescription: aws.String("Recover the WordPress instance of stack " + stack),
+		Namespace:        aws.String("AWS/EC2"),
+		MetricName:       aws.String("StatusCheckFailed_System"),
+		Dimensions: []types.Dimension{
+			{
+				Name:  aws.String("InstanceId"),
+				Value: aws.String(instanceId),
+			},
+		},
+		Statistic:          types.StatisticMinimum,
+		Period:             aws.Int32(60),
+		EvaluationPeriods:  aws.Int32(2),
+		Threshold:          aws.Float64(0),
+		ComparisonOperator: types.ComparisonOperatorGreaterThanThreshold,
+		AlarmActions:       []string{"arn:aws:automate:" + region + ":ec2:recover"},
+		Tags: []types.Tag{
+			{
+				Key:   aws.String(stackTag),
+				Value: aws.String(stack),
+			},
+		},
+	}
+
+	_, err := client.PutMetricAlarm(context.TODO(), alarmInput)
+	if err != nil {
+		fmt.Println("Got an error creating the recovery alarm:")
+		fmt.Println(err)
+		return ""
+	}
+
+	return alarmName
+}
+
+func deleteAlarms(client *cloudwatch.Client, alarmNames ...string) bool {
+	_, err := client.DeleteAlarms(context.TODO(), &cloudwatch.DeleteAlarmsInput{
+		AlarmNames: alarmNames,
+	})
+	if err != nil {
+		fmt.Println("Got an error deleting alarms:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
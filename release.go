@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// version is the release of the tool, set when building one with
+// -ldflags "-X main.version=v1.4.0".
+var version = "dev"
+
+// bootstrapCurrent as -bootstrap-version means the bootstrap scripts built
+// into the running tool.
+const bootstrapCurrent = "current"
+
+var releaseVersionPattern = regexp.MustCompile(`^v?[0-9][0-9A-Za-z.+-]*$`)
+
+// Releases are published under a base URL, set as releases in the config
+// file or $AWS_WP_RELEASES:
+//
+//	<base>/latest                    the newest version, e.g. v1.4.0
+//	<base>/v1.4.0/SHA256SUMS         sha256sum output for the files below
+//	<base>/v1.4.0/aws-wp-linux-amd64 the tool, per GOOS and GOARCH
+//	<base>/v1.4.0/bootstrap/*.sh     the bootstrap scripts of the release
+func releaseBase(env *environment) (string, error) {
+	base := env.config.Releases
+	if base == "" {
+		base = os.Getenv("AWS_WP_RELEASES")
+	}
+	if base == "" {
+		return "", fmt.Errorf("set releases in the config file or $AWS_WP_RELEASES to the URL aws-wp releases are published at")
+	}
+	if !strings.HasPrefix(base, "https://") {
+		return "", fmt.Errorf("the releases URL %s is not https", base)
+	}
+	return strings.TrimSuffix(base, "/"), nil
+}
+
+func fetchRelease(env *environment, base string, path string) ([]byte, error) {
+	resp, err := env.http.Get(base + "/" + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %s", path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseChecksums reads sha256sum output into a map from file to digest.
+func parseChecksums(data []byte) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid SHA256SUMS line %q", scanner.Text())
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+func verifyChecksum(name string, data []byte, sums map[string]string) error {
+	want, ok := sums[name]
+	if !ok {
+		return fmt.Errorf("%s is not in SHA256SUMS", name)
+	}
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != want {
+		return fmt.Errorf("checksum mismatch for %s", name)
+	}
+	return nil
+}
+
+// resolveBootstrapVersion turns -bootstrap-version into what the stack is
+// pinned to. Development builds have no release to fetch later, so their
+// scripts leave the stack unpinned.
+func resolveBootstrapVersion(value string) (string, error) {
+	if value == bootstrapCurrent {
+		if version == "dev" {
+			return "", nil
+		}
+		return version, nil
+	}
+	if !releaseVersionPattern.MatchString(value) {
+		return "", fmt.Errorf("invalid -bootstrap-version %q, expected a release like v1.4.0 or current", value)
+	}
+	return value, nil
+}
+
+// useBootstrap selects the bootstrap scripts of a release for the user data
+// of the instances launched next. Unpinned stacks and those pinned to the
+// running release use the built-in scripts.
+func useBootstrap(env *environment, pinned string) error {
+	if pinned == "" || pinned == version {
+		bootstrapTemplates = builtinBootstrapTemplates
+		return nil
+	}
+	scripts, err := bootstrapAssets(env, pinned)
+	if err != nil {
+		return fmt.Errorf("getting the bootstrap scripts of %s: %w", pinned, err)
+	}
+	t := template.New("")
+	for name, script := range scripts {
+		if _, err := t.New(name).Parse(script); err != nil {
+			return fmt.Errorf("parsing %s of %s: %w", name, pinned, err)
+		}
+	}
+	if t.Lookup("customize.sh") == nil {
+		return fmt.Errorf("release %s has no bootstrap/customize.sh", pinned)
+	}
+	bootstrapTemplates = t
+	return nil
+}
+
+// bootstrapAssets returns the verified bootstrap scripts of a release. They
+// are kept under $AWS_WP_HOME/bootstrap/<version> once fetched, so later
+// launches do not depend on the release bucket and get the same scripts.
+func bootstrapAssets(env *environment, v string) (map[string]string, error) {
+	dir := filepath.Join(homeDir(), "bootstrap", v)
+	sumsData, err := ioutil.ReadFile(filepath.Join(dir, "SHA256SUMS"))
+	cached := err == nil
+
+	var base string
+	if !cached {
+		if base, err = releaseBase(env); err != nil {
+			return nil, err
+		}
+		if sumsData, err = fetchRelease(env, base, v+"/SHA256SUMS"); err != nil {
+			return nil, err
+		}
+	}
+	sums, err := parseChecksums(sumsData)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := map[string]string{}
+	for file := range sums {
+		if !strings.HasPrefix(file, "bootstrap/") || !strings.HasSuffix(file, ".sh") {
+			continue
+		}
+		var data []byte
+		if cached {
+			data, err = ioutil.ReadFile(filepath.Join(dir, filepath.Base(file)))
+		} else {
+			data, err = fetchRelease(env, base, v+"/"+file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyChecksum(file, data, sums); err != nil {
+			return nil, err
+		}
+		scripts[filepath.Base(file)] = string(data)
+	}
+
+	if !cached {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		for name, script := range scripts {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0600); err != nil {
+				return nil, err
+			}
+		}
+		// Written last: a cache without it is fetched again.
+		if err := ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), sumsData, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return scripts, nil
+}
+
+func printVersion(args []string) {
+	fmt.Printf("aws-wp %s %s/%s\n", version, runtime.GOOS, runtime.GOARCH)
+}
+
+// selfUpdate replaces the running binary with a release after checking it
+// against the release's checksums. Stacks stay pinned to the bootstrap
+// scripts they were created with.
+func selfUpdate(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	target := fs.String("version", "", "Release to install, the latest by default")
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	base, err := releaseBase(env)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *target == "" {
+		latest, err := fetchRelease(env, base, "latest")
+		if err != nil {
+			fmt.Println("Got an error finding the latest release:")
+			fmt.Println(err)
+			return
+		}
+		*target = strings.TrimSpace(string(latest))
+	}
+	if !releaseVersionPattern.MatchString(*target) {
+		fmt.Printf("Invalid release %q\n", *target)
+		return
+	}
+	if *target == version {
+		fmt.Printf("aws-wp %s is up to date\n", version)
+		return
+	}
+	if *check {
+		fmt.Printf("aws-wp %s is available, this is %s\n", *target, version)
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Update aws-wp from %s to %s?", version, *target)) {
+		return
+	}
+
+	binary := fmt.Sprintf("aws-wp-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	sumsData, err := fetchRelease(env, base, *target+"/SHA256SUMS")
+	if err != nil {
+		fmt.Println("Got an error retrieving the release checksums:")
+		fmt.Println(err)
+		return
+	}
+	sums, err := parseChecksums(sumsData)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	data, err := fetchRelease(env, base, *target+"/"+binary)
+	if err == nil {
+		err = verifyChecksum(binary, data, sums)
+	}
+	if err != nil {
+		fmt.Println("Got an error downloading the release:")
+		fmt.Println(err)
+		return
+	}
+
+	if err := replaceExecutable(data); err != nil {
+		fmt.Println("Got an error installing the release:")
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Updated aws-wp from %s to %s\n", version, *target)
+	fmt.Println("Existing stacks keep their bootstrap scripts; replace -bootstrap-version current moves a stack to the new ones.")
+}
+
+// replaceExecutable writes the new binary next to the running one and
+// renames it into place. Windows cannot overwrite a running executable but
+// can rename it, so the old one is moved aside first.
+func replaceExecutable(data []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+
+	tmp := exe + ".new"
+	if err := ioutil.WriteFile(tmp, data, info.Mode().Perm()|0700); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
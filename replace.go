@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// replace moves the stack onto a new instance: the current one ("blue") is
+// imaged, a "green" instance is launched from the image and checked, and
+// only then does blue go away. The stack's Elastic IP, if any, moves to green
+// at that point so the address stays the same. Behind a load balancer traffic
+// moves to green step by step (see shiftTraffic), or at once with -canary "".
+// With -ami the green instance starts from a fresh image instead and the site
+// content is not carried over.
+func replace(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("replace", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	imageId := fs.String("ami", "", "Launch from this image instead of a copy of the current instance")
+	noReboot := fs.Bool("no-reboot", false, "Image the current instance without rebooting it first")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	bootstrapVersion := fs.String("bootstrap-version", "", "Pin the stack to this release's bootstrap scripts, current for this one's, instead of keeping its own")
+	snapshot := addSnapshotFlag(fs, true)
+	canarySteps := fs.String("canary", defaultCanarySteps, "With a load balancer, percentages of traffic to shift to the new instance step by step, empty to switch at once")
+	canaryInterval := fs.Duration("canary-interval", 2*time.Minute, "Time to watch each canary step before the next")
+	canaryMaxErrors := fs.Float64("canary-max-errors", 5, "Percentage of 5XX responses from the new instance that rolls the shift back")
+	fs.Parse(args)
+
+	steps, err := parseCanarySteps(*canarySteps)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	canary := canaryOptions{steps: steps, interval: *canaryInterval, maxErrors: *canaryMaxErrors}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "replace")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	spec := state.launchSpec
+	if spec.hasStaticAddresses() {
+		fmt.Println("The stack uses static private IPs, which the old and new instance cannot hold at the same time")
+		return
+	}
+
+	if *bootstrapVersion != "" {
+		if spec.BootstrapVersion, err = resolveBootstrapVersion(*bootstrapVersion); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if err := useBootstrap(env, spec.BootstrapVersion); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// A green instance left behind by an interrupted replace goes first.
+	leftover, ok := interruptedLaunch(client, state)
+	if !ok {
+		return
+	}
+	if leftover != "" {
+		log.Printf("Terminating %s, launched by an interrupted run", leftover)
+		if !terminateInstance(client, leftover) {
+			return
+		}
+	}
+
+	operationId := newOperationId()
+	if *snapshot && !snapshotBefore(client, state, operationId, "replace") {
+		return
+	}
+
+	if *imageId != "" {
+		if !*yes && !confirm(fmt.Sprintf("The new instance starts from %s without the current site content. Continue?", *imageId)) {
+			return
+		}
+		spec.ImageId = *imageId
+	} else {
+		spec.ImageId = createStackImage(client, state, !*noReboot)
+		if spec.ImageId == "" {
+			return
+		}
+		// WordPress and its plugins are already installed in the copy.
+		spec.Plugins = nil
+		spec.OS = ""
+	}
+	spec.Baked = false
+	if env.config.WPConfig != nil {
+		spec.WPConfig = env.config.WPConfig
+	}
+
+	blueId := state.InstanceId
+	state.LaunchToken = launchToken(state.Name, operationId)
+	saveStackState(state)
+	greenId := createInstance(client, state.Name, state.SecurityGroupId, spec, state.LaunchToken)
+	if greenId == "" {
+		return
+	}
+
+	publicDnsName, ok := waitRunning(client, greenId)
+	if !ok || (spec.ReportProgress && !waitBootstrapped(ssm.NewFromConfig(env.aws), state.Name, greenId)) {
+		rollBack(client, blueId, greenId)
+		return
+	}
+
+	// Green is checked on its own address before the cutover. Without one,
+	// as with several network interfaces, it can only be checked through the
+	// Elastic IP, which goes back to blue if the check fails.
+	greenURL := state.instanceURL(publicDnsName)
+	cutOver := false
+	if publicDnsName == "" {
+		if state.ElasticIp == nil || !attachElasticIp(client, state, greenId) {
+			rollBack(client, blueId, greenId)
+			return
+		}
+		greenURL = state.URL
+		cutOver = true
+	}
+
+	if !waitHealthy(env.http, greenURL, healthCheckAuth(env, state.HealthCheck)) {
+		emit(eventHealthFailed, "instance_id", greenId)
+		if cutOver {
+			state.ElasticIp.associate(client, blueId)
+		}
+		rollBack(client, blueId, greenId)
+		return
+	}
+	emit(eventHealthOK, "url", greenURL)
+
+	if !cutOver {
+		state.PublicDnsName = publicDnsName
+		state.URL = greenURL
+		if state.ElasticIp != nil && !attachElasticIp(client, state, greenId) {
+			rollBack(client, blueId, greenId)
+			return
+		}
+	}
+
+	if lb := state.LoadBalancer; lb != nil {
+		elbClient := elb.NewFromConfig(env.aws)
+		if len(canary.steps) > 0 {
+			if !shiftTraffic(elbClient, cloudwatch.NewFromConfig(env.aws), state, greenId, canary) {
+				rollBack(client, blueId, greenId)
+				return
+			}
+		} else {
+			if !registerTarget(elbClient, lb.TargetGroupArn, greenId) {
+				deregisterTarget(elbClient, lb.TargetGroupArn, greenId)
+				rollBack(client, blueId, greenId)
+				return
+			}
+			deregisterTarget(elbClient, lb.TargetGroupArn, blueId)
+		}
+		state.URL = state.siteURL(lb.url())
+	}
+
+	state.InstanceId = greenId
+	state.LaunchToken = ""
+	state.ImageId = spec.ImageId
+	state.BootstrapVersion = spec.BootstrapVersion
+	state.WPConfig = spec.WPConfig
+	updateSiteRecord(env, state)
+	updateUptimeCheck(env, state)
+	if state.AutoRecovery {
+		state.RecoveryAlarm = createRecoveryAlarm(cloudwatch.NewFromConfig(env.aws), state.Region, state.Name, greenId)
+	}
+	if state.AlarmDisk > 0 {
+		// The old alarm watches blue's metric, so it is replaced or goes.
+		cwClient := cloudwatch.NewFromConfig(env.aws)
+		if alarm := createDiskAlarm(cwClient, state.Name, greenId, state.AlarmDisk, notifyTopics(env)); alarm != "" {
+			state.DiskAlarm = alarm
+		} else if state.DiskAlarm != "" && deleteAlarms(cwClient, state.DiskAlarm) {
+			state.DiskAlarm = ""
+		}
+	}
+	saveStackState(state)
+	emit(eventInstanceReplaced, "old_instance_id", blueId, "instance_id", greenId)
+
+	if !terminateInstance(client, blueId) {
+		return
+	}
+
+	if err := runHooks(env.aws, env.config.Hooks, hookAfterReady, state.vars()); err != nil {
+		fmt.Println("Got an error running hooks:")
+		fmt.Println(err)
+	}
+
+	fmt.Printf("Stack %s now runs on %s at %s\n", state.Name, greenId, state.URL)
+	writeOutputs(state)
+}
+
+// createStackImage images the stack's instance and waits until the image can
+// be launched. Rebooting first gives a consistent copy of the file system.
+func createStackImage(client *ec2.Client, state *stackState, reboot bool) string {
+	name := fmt.Sprintf("aws-wp-%s-%s", state.Name, time.Now().UTC().Format("20060102-150405"))
+
+	imageInput := &ec2.CreateImageInput{
+		InstanceId:  aws.String(state.InstanceId),
+		Name:        aws.String(name),
+		Description: aws.String("Copy of the WordPress instance of stack " + state.Name),
+		NoReboot:    aws.Bool(!reboot),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeImage,
+				Tags:         append([]types.Tag{stackTagFor(state.Name)}, state.userTags()...),
+			},
+		},
+	}
+
+	image, err := client.CreateImage(context.TODO(), imageInput)
+	if err != nil {
+		fmt.Println("Got an error creating an image:")
+		fmt.Println(err)
+		return ""
+	}
+	imageId := aws.ToString(image.ImageId)
+	if !waitImageAvailable(client, imageId) {
+		return ""
+	}
+	emit(eventImageCreated, "image_id", imageId)
+	return imageId
+}
+
+func rollBack(client *ec2.Client, blueId string, greenId string) {
+	log.Printf("Removing the new instance, the stack stays on %s", blueId)
+	terminateInstance(client, greenId)
+}
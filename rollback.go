@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// rollback restores the instance's volumes from the snapshots taken before
+// an operation. The instance is stopped, each volume is swapped for one
+// created from its snapshot, and the instance is started again. The
+// replaced volumes are kept.
+func rollback(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: aws-wp rollback [flags] [operation-id]")
+		fmt.Fprintln(fs.Output(), "Without an operation id, lists the operations that can be rolled back.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "rollback")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	operationId := fs.Arg(0)
+	snapshots, err := operationSnapshots(client, state.Name, operationId)
+	if err != nil {
+		fmt.Println("Got an error retrieving snapshots:")
+		fmt.Println(err)
+		return
+	}
+
+	if operationId == "" {
+		listOperations(snapshots)
+		return
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("No snapshots of stack %s for operation %s\n", state.Name, operationId)
+		return
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Stop %s and restore its volumes to before %s?", state.InstanceId, operationId)) {
+		return
+	}
+
+	if !waitSnapshotsCompleted(client, snapshots) {
+		return
+	}
+
+	instance := describeInstance(client, state.InstanceId)
+	if instance == nil {
+		return
+	}
+	zone := aws.ToString(instance.Placement.AvailabilityZone)
+	current := map[string]string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil {
+			current[aws.ToString(mapping.DeviceName)] = aws.ToString(mapping.Ebs.VolumeId)
+		}
+	}
+
+	if !stopInstance(client, state.InstanceId) {
+		return
+	}
+
+	for _, snapshot := range snapshots {
+		device := tagValue(snapshot.Tags, deviceTag)
+		oldVolumeId, ok := current[device]
+		if !ok {
+			log.Printf("Skipping snapshot %s, the instance has nothing at %s", aws.ToString(snapshot.SnapshotId), device)
+			continue
+		}
+		if !restoreVolume(client, state, snapshot, zone, device, oldVolumeId) {
+			return
+		}
+		fmt.Printf("Restored %s from %s, the previous volume %s was kept\n", device, aws.ToString(snapshot.SnapshotId), oldVolumeId)
+	}
+
+	if !startInstance(client, state) || !updateSiteRecord(env, state) {
+		return
+	}
+	updateUptimeCheck(env, state)
+
+	if waitHealthy(env.http, state.URL, healthCheckAuth(env, state.HealthCheck)) {
+		emit(eventHealthOK, "url", state.URL)
+	} else {
+		emit(eventHealthFailed, "url", state.URL)
+	}
+}
+
+func listOperations(snapshots []types.Snapshot) {
+	type operation struct {
+		id        string
+		started   time.Time
+		snapshots int
+		pending   int
+	}
+
+	byId := map[string]*operation{}
+	for _, s := range snapshots {
+		id := tagValue(s.Tags, operationTag)
+		o, ok := byId[id]
+		if !ok {
+			o = &operation{id: id, started: aws.ToTime(s.StartTime)}
+			byId[id] = o
+		}
+		o.snapshots++
+		if s.State != types.SnapshotStateCompleted {
+			o.pending++
+		}
+	}
+
+	operations := make([]*operation, 0, len(byId))
+	for _, o := range byId {
+		operations = append(operations, o)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].started.After(operations[j].started)
+	})
+
+	if len(operations) == 0 {
+		fmt.Println("No operations to roll back")
+	}
+	for _, o := range operations {
+		note := ""
+		if o.pending > 0 {
+			note = fmt.Sprintf(", %d still in progress", o.pending)
+		}
+		fmt.Printf("%s  %s  %d snapshot(s)%s\n", o.id, o.started.Local().Format(time.RFC1123), o.snapshots, note)
+	}
+}
+
+func waitSnapshotsCompleted(client *ec2.Client, snapshots []types.Snapshot) bool {
+	ids := make([]string, len(snapshots))
+	for i, s := range snapshots {
+		ids[i] = aws.ToString(s.SnapshotId)
+	}
+
+	for {
+		result, err := client.DescribeSnapshots(context.TODO(), &ec2.DescribeSnapshotsInput{
+			SnapshotIds: ids,
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving snapshots:")
+			fmt.Println(err)
+			return false
+		}
+
+		pending := 0
+		for _, s := range result.Snapshots {
+			switch s.State {
+			case types.SnapshotStateError:
+				fmt.Printf("Got an error: snapshot %s failed\n", aws.ToString(s.SnapshotId))
+				return false
+			case types.SnapshotStatePending:
+				pending++
+			}
+		}
+		if pending == 0 {
+			return true
+		}
+		log.Printf("Waiting for %d snapshot(s) to complete...", pending)
+		time.Sleep(15 * time.Second)
+	}
+}
+
+// restoreVolume swaps the volume at device for a new one made from the
+// snapshot, keeping the old volume's type.
+func restoreVolume(client *ec2.Client, state *stackState, snapshot types.Snapshot, zone string, device string, oldVolumeId string) bool {
+	old, err := client.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{
+		VolumeIds: []string{oldVolumeId},
+	})
+	if err != nil || len(old.Volumes) == 0 {
+		fmt.Println("Got an error retrieving information about the volume:")
+		fmt.Println(oldVolumeId, err)
+		return false
+	}
+
+	volumeInput := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		SnapshotId:       snapshot.SnapshotId,
+		VolumeType:       old.Volumes[0].VolumeType,
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeVolume,
+				Tags:         []types.Tag{stackTagFor(state.Name)},
+			},
+		},
+	}
+	switch old.Volumes[0].VolumeType {
+	case types.VolumeTypeIo1, types.VolumeTypeIo2:
+		volumeInput.Iops = old.Volumes[0].Iops
+	case types.VolumeTypeGp3:
+		volumeInput.Iops = old.Volumes[0].Iops
+		volumeInput.Throughput = old.Volumes[0].Throughput
+	}
+
+	volume, err := client.CreateVolume(context.TODO(), volumeInput)
+	if err != nil {
+		fmt.Println("Got an error creating a volume from the snapshot:")
+		fmt.Println(err)
+		return false
+	}
+	newVolumeId := aws.ToString(volume.VolumeId)
+	if !waitVolume(client, newVolumeId, types.VolumeStateAvailable) {
+		return false
+	}
+
+	_, err = client.DetachVolume(context.TODO(), &ec2.DetachVolumeInput{
+		VolumeId: aws.String(oldVolumeId),
+	})
+	if err != nil {
+		fmt.Println("Got an error detaching the volume:")
+		fmt.Println(err)
+		fmt.Printf("Volume %s restored from the snapshot is left unattached\n", newVolumeId)
+		return false
+	}
+	if !waitVolume(client, oldVolumeId, types.VolumeStateAvailable) {
+		reattachVolume(client, state, device, oldVolumeId, newVolumeId)
+		return false
+	}
+
+	_, err = client.AttachVolume(context.TODO(), &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(newVolumeId),
+		InstanceId: aws.String(state.InstanceId),
+		Device:     aws.String(device),
+	})
+	if err != nil {
+		fmt.Println("Got an error attaching the restored volume:")
+		fmt.Println(err)
+		reattachVolume(client, state, device, oldVolumeId, newVolumeId)
+		return false
+	}
+	if !waitVolume(client, newVolumeId, types.VolumeStateInUse) {
+		fmt.Printf("Restored volume %s may not be attached to %s of instance %s, whose volume %s was detached\n",
+			newVolumeId, device, state.InstanceId, oldVolumeId)
+		fmt.Printf("Check with aws ec2 describe-volumes --volume-ids %s %s before starting the instance\n", oldVolumeId, newVolumeId)
+		return false
+	}
+
+	// Restored volumes go with the instance like the originals did.
+	_, err = client.ModifyInstanceAttribute(context.TODO(), &ec2.ModifyInstanceAttributeInput{
+		InstanceId: aws.String(state.InstanceId),
+		BlockDeviceMappings: []types.InstanceBlockDeviceMappingSpecification{
+			{
+				DeviceName: aws.String(device),
+				Ebs: &types.EbsInstanceBlockDeviceSpecification{
+					VolumeId:            aws.String(newVolumeId),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error updating the volume attachment:")
+		fmt.Println(err)
+	}
+
+	emit(eventVolumeRestored, "device", device, "volume_id", newVolumeId, "snapshot_id", aws.ToString(snapshot.SnapshotId))
+	return true
+}
+
+// reattachVolume puts the detached volume back after the restored one could
+// not take its place, so that the stopped instance is left as it was. When
+// that fails too, it says how to do it by hand.
+func reattachVolume(client *ec2.Client, state *stackState, device string, oldVolumeId string, newVolumeId string) {
+	_, err := client.AttachVolume(context.TODO(), &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(oldVolumeId),
+		InstanceId: aws.String(state.InstanceId),
+		Device:     aws.String(device),
+	})
+	if err == nil && waitVolume(client, oldVolumeId, types.VolumeStateInUse) {
+		fmt.Printf("Reattached the original volume %s, the restored volume %s is left unattached\n", oldVolumeId, newVolumeId)
+		return
+	}
+	if err != nil {
+		fmt.Println("Got an error reattaching the original volume:")
+		fmt.Println(err)
+	}
+	fmt.Printf("Instance %s is stopped and its volume %s at %s is detached. Restored volume %s is unattached.\n",
+		state.InstanceId, oldVolumeId, device, newVolumeId)
+	fmt.Println("To put the original volume back, once it is available, run:")
+	fmt.Printf("  aws ec2 attach-volume --volume-id %s --instance-id %s --device %s --region %s\n", oldVolumeId, state.InstanceId, device, state.Region)
+}
+
+func waitVolume(client *ec2.Client, volumeId string, want types.VolumeState) bool {
+	for {
+		result, err := client.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{
+			VolumeIds: []string{volumeId},
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving information about the volume:")
+			fmt.Println(err)
+			return false
+		}
+		if len(result.Volumes) > 0 {
+			switch result.Volumes[0].State {
+			case want:
+				return true
+			case types.VolumeStateError:
+				fmt.Printf("Got an error: volume %s is in state error\n", volumeId)
+				return false
+			}
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+func stopInstance(client *ec2.Client, instanceId string) bool {
+	_, err := client.StopInstances(context.TODO(), &ec2.StopInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		fmt.Println("Got an error stopping the instance:")
+		fmt.Println(err)
+		return false
+	}
+
+	for {
+		instance := describeInstance(client, instanceId)
+		if instance == nil {
+			return false
+		}
+		// stopped
+		if *instance.State.Code == 80 {
+			emit(eventInstanceStopped, "instance_id", instanceId)
+			return true
+		}
+		log.Printf("Still stopping...")
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// startInstance starts the stack's instance and updates the stack URL, which
+// changes on every start unless an Elastic IP or load balancer fronts it.
+func startInstance(client *ec2.Client, state *stackState) bool {
+	_, err := client.StartInstances(context.TODO(), &ec2.StartInstancesInput{
+		InstanceIds: []string{state.InstanceId},
+	})
+	if err != nil {
+		fmt.Println("Got an error starting the instance:")
+		fmt.Println(err)
+		return false
+	}
+
+	publicDnsName, ok := waitRunning(client, state.InstanceId)
+	if !ok {
+		return false
+	}
+	if state.ElasticIp == nil && state.LoadBalancer == nil && publicDnsName != "" {
+		state.PublicDnsName = publicDnsName
+		state.URL = state.instanceURL(publicDnsName)
+		saveStackState(state)
+	}
+	return true
+}
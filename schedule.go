@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// scheduleHorizon is how far ahead status looks for the next start or stop.
+const scheduleHorizon = 14 * 24 * time.Hour
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// officeHours keeps a stack running during office hours only. Outside
+// the hours, on the days left out and while the Change Calendar is CLOSED,
+// the instance is stopped.
+type officeHours struct {
+	Start    string `json:"start"`
+	Stop     string `json:"stop"`
+	Days     string `json:"days"`
+	Timezone string `json:"timezone"`
+	Calendar string `json:"calendar,omitempty"`
+}
+
+func (s *officeHours) String() string {
+	text := fmt.Sprintf("%s-%s %s (%s)", s.Start, s.Stop, s.Days, s.Timezone)
+	if s.Calendar != "" {
+		text += ", calendar " + s.Calendar
+	}
+	return text
+}
+
+// scheduleRules is an officeHours parsed, with the times in minutes after
+// midnight.
+type scheduleRules struct {
+	start    int
+	stop     int
+	days     [7]bool
+	location *time.Location
+}
+
+func parseSchedule(s *officeHours) (*scheduleRules, error) {
+	rules := &scheduleRules{}
+	var err error
+	if rules.start, err = parseClock(s.Start); err != nil {
+		return nil, err
+	}
+	if rules.stop, err = parseClock(s.Stop); err != nil {
+		return nil, err
+	}
+	if rules.start >= rules.stop {
+		return nil, fmt.Errorf("the stack must start before it stops, %s-%s spans midnight", s.Start, s.Stop)
+	}
+	if rules.days, err = parseDays(s.Days); err != nil {
+		return nil, err
+	}
+	if rules.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return nil, fmt.Errorf("unknown -timezone %q: %w", s.Timezone, err)
+	}
+	return rules, nil
+}
+
+// parseClock parses a time of day like 07:30.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected hh:mm", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseDays parses days like mon-fri or sat,sun, or daily.
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	if value == "daily" {
+		value = "sun-sat"
+	}
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, last := weekdayIndex(bounds[0]), weekdayIndex(bounds[len(bounds)-1])
+		if first < 0 || last < 0 {
+			return days, fmt.Errorf("invalid days %q, expected e.g. mon-fri, sat,sun or daily", value)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func weekdayIndex(name string) int {
+	for i, weekday := range weekdayNames {
+		if weekday == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// within reports whether the hours and days have the stack running at t.
+func (r *scheduleRules) within(t time.Time) bool {
+	local := t.In(r.location)
+	clock := local.Hour()*60 + local.Minute()
+	return r.days[local.Weekday()] && clock >= r.start && clock < r.stop
+}
+
+// nextBoundary is the first start or stop time of the hours after t.
+func (r *scheduleRules) nextBoundary(t time.Time) time.Time {
+	local := t.In(r.location)
+	for offset := 0; offset <= 7; offset++ {
+		for _, minutes := range []int{r.start, r.stop} {
+			b := time.Date(local.Year(), local.Month(), local.Day()+offset, minutes/60, minutes%60, 0, 0, r.location)
+			if b.After(t) && r.days[b.Weekday()] {
+				return b
+			}
+		}
+	}
+	return t.Add(scheduleHorizon)
+}
+
+// calendarStateAPI is the part of the SSM client that changeCalendar uses.
+type calendarStateAPI interface {
+	GetCalendarState(ctx context.Context, params *ssm.GetCalendarStateInput, optFns ...func(*ssm.Options)) (*ssm.GetCalendarStateOutput, error)
+}
+
+// changeCalendar follows the state of an SSM Change Calendar forward in
+// time. The stack may only run while it is OPEN, so a DEFAULT_OPEN calendar
+// with an event per holiday keeps the stack stopped on each.
+type changeCalendar struct {
+	client calendarStateAPI
+	name   string
+	open   bool
+	// until is when open flips, zero when the calendar has no more events.
+	until time.Time
+}
+
+func (c *changeCalendar) fetch(at time.Time) error {
+	result, err := c.client.GetCalendarState(context.TODO(), &ssm.GetCalendarStateInput{
+		CalendarNames: []string{c.name},
+		AtTime:        aws.String(at.UTC().Format(time.RFC3339)),
+	})
+	if err != nil {
+		return err
+	}
+	c.open = result.State == ssmtypes.CalendarStateOpen
+	c.until = time.Time{}
+	if next := aws.ToString(result.NextTransitionTime); next != "" {
+		until, err := time.Parse(time.RFC3339, next)
+		if err != nil {
+			return fmt.Errorf("parsing the next transition of calendar %s: %w", c.name, err)
+		}
+		if until.After(at) {
+			c.until = until
+		}
+	}
+	return nil
+}
+
+// openAt reports the calendar's state at t, which must not be before the
+// last time asked for.
+func (c *changeCalendar) openAt(t time.Time) (bool, error) {
+	for !c.until.IsZero() && !t.Before(c.until) {
+		if err := c.fetch(c.until); err != nil {
+			return false, err
+		}
+	}
+	return c.open, nil
+}
+
+// scheduler decides when a scheduled stack runs.
+type scheduler struct {
+	rules    *scheduleRules
+	calendar *changeCalendar
+}
+
+// newScheduler prints the reason and returns nil when the schedule is
+// invalid or its calendar cannot be read.
+func newScheduler(env *environment, schedule *officeHours, now time.Time) *scheduler {
+	rules, err := parseSchedule(schedule)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	s := &scheduler{rules: rules}
+	if schedule.Calendar != "" {
+		s.calendar = &changeCalendar{client: ssm.NewFromConfig(env.aws), name: schedule.Calendar}
+		if err := s.calendar.fetch(now); err != nil {
+			fmt.Println("Got an error reading the change calendar:")
+			fmt.Println(err)
+			return nil
+		}
+	}
+	return s
+}
+
+// running reports whether the stack should run at t. Times must be asked
+// for in order. The calendar is followed up to t even outside the hours,
+// so that its next transition is always after t.
+func (s *scheduler) running(t time.Time) (bool, error) {
+	open := true
+	if s.calendar != nil {
+		var err error
+		if open, err = s.calendar.openAt(t); err != nil {
+			return false, err
+		}
+	}
+	return open && s.rules.within(t), nil
+}
+
+// scheduleTransition is the next start or stop of a scheduled stack.
+type scheduleTransition struct {
+	At    time.Time
+	Start bool
+}
+
+// next finds the first start or stop after now, nil when there is none
+// within scheduleHorizon.
+func (s *scheduler) next(now time.Time) (*scheduleTransition, error) {
+	running, err := s.running(now)
+	if err != nil {
+		return nil, err
+	}
+	horizon := now.Add(scheduleHorizon)
+	for t := now; t.Before(horizon); {
+		next := s.rules.nextBoundary(t)
+		if c := s.calendar; c != nil && c.until.After(t) && c.until.Before(next) {
+			next = c.until
+		}
+		if !next.After(t) {
+			break
+		}
+		t = next
+		r, err := s.running(t)
+		if err != nil {
+			return nil, err
+		}
+		if r != running {
+			if !t.Before(horizon) {
+				break
+			}
+			return &scheduleTransition{At: t, Start: r}, nil
+		}
+	}
+	return nil, nil
+}
+
+// schedule stops stacks outside office hours: "schedule set" gives a stack
+// its hours, "schedule clear" removes them and "schedule run" starts and
+// stops the scheduled stacks. Nothing runs it on its own; run it from cron
+// or CI every few minutes, like gc.
+func schedule(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp schedule set|clear|run [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "set":
+		setSchedule(args[1:])
+	case "clear":
+		clearSchedule(args[1:])
+	case "run":
+		runSchedules(args[1:])
+	default:
+		fmt.Printf("Unknown schedule command %q, expected set, clear or run\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func setSchedule(args []string) {
+	fs := flag.NewFlagSet("schedule set", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	hours := fs.String("hours", "", "When the stack runs, as start-stop like 07:00-19:00")
+	days := fs.String("days", "mon-fri", "The days it runs, like mon-fri, sat,sun or daily")
+	timezone := fs.String("timezone", "UTC", "Time zone of -hours, like Europe/Berlin")
+	calendar := fs.String("calendar", "", "SSM Change Calendar that keeps the stack stopped while CLOSED, e.g. on holidays")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bounds := strings.SplitN(*hours, "-", 2)
+	if len(bounds) != 2 {
+		fmt.Println("-hours is required, like 07:00-19:00")
+		return
+	}
+	s := &officeHours{Start: bounds[0], Stop: bounds[1], Days: *days, Timezone: *timezone, Calendar: *calendar}
+
+	unlock := lockStack(env.name, "schedule set")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	now := time.Now()
+	sched := newScheduler(env, s, now)
+	if sched == nil {
+		return
+	}
+	state.Schedule = s
+	saveStackState(state)
+	fmt.Printf("Stack %s runs %s\n", state.Name, s)
+
+	if transition, err := sched.next(now); err != nil {
+		fmt.Println("Got an error reading the change calendar:")
+		fmt.Println(err)
+	} else if transition != nil {
+		fmt.Println(describeTransition(transition))
+	}
+}
+
+func clearSchedule(args []string) {
+	fs := flag.NewFlagSet("schedule clear", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "schedule clear")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil || state.Schedule == nil {
+		return
+	}
+	state.Schedule = nil
+	saveStackState(state)
+	fmt.Printf("Stack %s is no longer started and stopped on a schedule\n", state.Name)
+}
+
+func describeTransition(transition *scheduleTransition) string {
+	if transition.Start {
+		return msg("status.schedule_start", transition.At.Local().Format(time.RFC1123))
+	}
+	return msg("status.schedule_stop", transition.At.Local().Format(time.RFC1123))
+}
+
+// runSchedules starts the scheduled stacks that should be running and
+// stops the ones that should not. Stacks that are neither running nor
+// stopped, or locked by another command, are left for the next run.
+func runSchedules(args []string) {
+	fs := flag.NewFlagSet("schedule run", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Only list the stacks that would be started or stopped")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	states, err := listStates()
+	if err != nil {
+		fmt.Println("Got an error reading the stacks:")
+		fmt.Println(err)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range states {
+		if s.Schedule == nil {
+			continue
+		}
+		stackEnv := *env
+		stackEnv.name = s.Name
+		applySchedule(&stackEnv, now, *dryRun)
+	}
+}
+
+func applySchedule(env *environment, now time.Time, dryRun bool) {
+	unlock := lockStack(env.name, "schedule run")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil || state.Schedule == nil {
+		return
+	}
+	sched := newScheduler(env, state.Schedule, now)
+	if sched == nil {
+		return
+	}
+	want, err := sched.running(now)
+	if err != nil {
+		fmt.Println("Got an error reading the change calendar:")
+		fmt.Println(err)
+		return
+	}
+
+	client := ec2.NewFromConfig(env.aws)
+	instance := describeInstance(client, state.InstanceId)
+	if instance == nil {
+		return
+	}
+	switch {
+	case instance.State.Name == types.InstanceStateNameRunning && !want:
+		fmt.Printf("Stopping stack %s\n", state.Name)
+		if !dryRun {
+			stopInstance(client, state.InstanceId)
+		}
+	case instance.State.Name == types.InstanceStateNameStopped && want:
+		fmt.Printf("Starting stack %s\n", state.Name)
+		if !dryRun && startInstance(client, state) && updateSiteRecord(env, state) {
+			updateUptimeCheck(env, state)
+		}
+	case instance.State.Name != types.InstanceStateNameRunning && instance.State.Name != types.InstanceStateNameStopped:
+		log.Printf("Stack %s is %s, leaving it for the next run", state.Name, instance.State.Name)
+	}
+}
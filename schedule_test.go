@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// fakeCalendar is a Change Calendar that starts OPEN or CLOSED and flips at
+// each of its transitions.
+type fakeCalendar struct {
+	open        bool
+	transitions []time.Time
+	calls       int
+}
+
+func (c *fakeCalendar) GetCalendarState(ctx context.Context, params *ssm.GetCalendarStateInput, optFns ...func(*ssm.Options)) (*ssm.GetCalendarStateOutput, error) {
+	if c.calls++; c.calls > 1000 {
+		return nil, errors.New("calendar read too often")
+	}
+	at, err := time.Parse(time.RFC3339, aws.ToString(params.AtTime))
+	if err != nil {
+		return nil, err
+	}
+	open := c.open
+	output := &ssm.GetCalendarStateOutput{}
+	for _, transition := range c.transitions {
+		if transition.After(at) {
+			output.NextTransitionTime = aws.String(transition.Format(time.RFC3339))
+			break
+		}
+		open = !open
+	}
+	output.State = ssmtypes.CalendarStateClosed
+	if open {
+		output.State = ssmtypes.CalendarStateOpen
+	}
+	return output, nil
+}
+
+// at is a time in the week of Monday 12 October 2026, UTC.
+func at(day time.Weekday, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2026, 10, 11+int(day), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestSchedulerNext(t *testing.T) {
+	hours := &officeHours{Start: "07:00", Stop: "19:00", Days: "mon-fri", Timezone: "UTC"}
+	nextWeek := func(day time.Weekday, clock string) time.Time { return at(day, clock).AddDate(0, 0, 7) }
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		calendar *fakeCalendar
+		want     *scheduleTransition
+	}{
+		{
+			name: "stops at the end of the day",
+			now:  at(time.Wednesday, "12:00"),
+			want: &scheduleTransition{At: at(time.Wednesday, "19:00")},
+		},
+		{
+			name: "starts the next morning",
+			now:  at(time.Wednesday, "20:00"),
+			want: &scheduleTransition{At: at(time.Thursday, "07:00"), Start: true},
+		},
+		{
+			name: "starts on monday after the weekend",
+			now:  at(time.Friday, "19:00"),
+			want: &scheduleTransition{At: nextWeek(time.Monday, "07:00"), Start: true},
+		},
+		{
+			name:     "skips a holiday that starts outside the hours",
+			now:      at(time.Thursday, "20:00"),
+			calendar: &fakeCalendar{open: true, transitions: []time.Time{at(time.Friday, "00:00"), at(time.Saturday, "00:00")}},
+			want:     &scheduleTransition{At: nextWeek(time.Monday, "07:00"), Start: true},
+		},
+		{
+			name:     "skips a holiday that ends outside the hours",
+			now:      at(time.Thursday, "20:00"),
+			calendar: &fakeCalendar{open: true, transitions: []time.Time{at(time.Thursday, "21:00"), at(time.Friday, "20:00")}},
+			want:     &scheduleTransition{At: nextWeek(time.Monday, "07:00"), Start: true},
+		},
+		{
+			name:     "starts when a closure ends at the start of the hours",
+			now:      at(time.Thursday, "20:00"),
+			calendar: &fakeCalendar{open: true, transitions: []time.Time{at(time.Thursday, "19:00"), at(time.Friday, "07:00")}},
+			want:     &scheduleTransition{At: at(time.Friday, "07:00"), Start: true},
+		},
+		{
+			name:     "stops when the calendar closes during the hours",
+			now:      at(time.Wednesday, "10:00"),
+			calendar: &fakeCalendar{open: true, transitions: []time.Time{at(time.Wednesday, "12:00"), at(time.Wednesday, "14:00")}},
+			want:     &scheduleTransition{At: at(time.Wednesday, "12:00")},
+		},
+		{
+			name:     "starts when the calendar opens during the hours",
+			now:      at(time.Wednesday, "13:00"),
+			calendar: &fakeCalendar{open: true, transitions: []time.Time{at(time.Wednesday, "12:00"), at(time.Wednesday, "14:00")}},
+			want:     &scheduleTransition{At: at(time.Wednesday, "14:00"), Start: true},
+		},
+		{
+			name:     "gives up at the horizon",
+			now:      at(time.Wednesday, "20:00"),
+			calendar: &fakeCalendar{open: false},
+		},
+		{
+			name:     "gives up when the calendar opens after the horizon",
+			now:      at(time.Wednesday, "20:00"),
+			calendar: &fakeCalendar{open: false, transitions: []time.Time{at(time.Wednesday, "20:00").Add(scheduleHorizon + time.Hour)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseSchedule(hours)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &scheduler{rules: rules}
+			if test.calendar != nil {
+				s.calendar = &changeCalendar{client: test.calendar, name: "holidays"}
+				if err := s.calendar.fetch(test.now); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := s.next(test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case got == nil && test.want == nil:
+			case got == nil || test.want == nil:
+				t.Errorf("next(%v) = %v, want %v", test.now, got, test.want)
+			case !got.At.Equal(test.want.At) || got.Start != test.want.Start:
+				t.Errorf("next(%v) = %v start %t, want %v start %t", test.now, got.At, got.Start, test.want.At, test.want.Start)
+			}
+		})
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{value: "mon-fri", want: "-MTWTF-"},
+		{value: "sat,sun", want: "S-----S"},
+		{value: "fri-mon", want: "SM---FS"},
+		{value: "daily", want: "SMTWTFS"},
+		{value: "Wed", want: "---W---"},
+		{value: "mon-xyz", err: true},
+	}
+	for _, test := range tests {
+		days, err := parseDays(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDays(%q) succeeded, want an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDays(%q): %v", test.value, err)
+			continue
+		}
+		got := []byte("-------")
+		for i, on := range days {
+			if on {
+				got[i] = "SMTWTFS"[i]
+			}
+		}
+		if string(got) != test.want {
+			t.Errorf("parseDays(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
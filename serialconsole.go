@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"golang.org/x/crypto/ssh"
+)
+
+// serialConsoleHost is the EC2 serial console endpoint for a region. The
+// user name selects the instance and serial port.
+func serialConsoleHost(region string) string {
+	return "serial-console.ec2-instance-connect." + region + ".aws"
+}
+
+// serialConsole connects to the instance's serial console over SSH. It works
+// when the instance is unreachable over the network or bootstrap broke SSH,
+// but logging in still needs an OS user with a password. The key it pushes
+// is generated for this session and is only accepted for 60 seconds.
+func serialConsole(args []string) {
+	fs := flag.NewFlagSet("serial-console", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	yes := fs.Bool("yes", false, "Enable serial console access for the account without asking")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		fmt.Println("The serial console needs an ssh client on the PATH")
+		return
+	}
+
+	if !enableSerialConsole(client, *yes) {
+		return
+	}
+
+	keyFile, publicKey := ephemeralKey()
+	if keyFile == "" {
+		return
+	}
+	defer os.Remove(keyFile)
+
+	connect := ec2instanceconnect.NewFromConfig(env.aws)
+	_, err = connect.SendSerialConsoleSSHPublicKey(context.TODO(), &ec2instanceconnect.SendSerialConsoleSSHPublicKeyInput{
+		InstanceId:   aws.String(state.InstanceId),
+		SSHPublicKey: aws.String(publicKey),
+	})
+	if err != nil {
+		fmt.Println("Got an error sending the serial console key:")
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println("Connecting to the serial console of", state.InstanceId)
+	fmt.Println("Press Enter for a login prompt; type ~. to disconnect")
+
+	cmd := exec.Command(sshPath,
+		"-i", keyFile,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=accept-new",
+		state.InstanceId+".port0@"+serialConsoleHost(env.aws.Region))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Println("Got an error running ssh:")
+			fmt.Println(err)
+		}
+	}
+}
+
+// enableSerialConsole turns on serial console access for the account in the
+// current region when it is off. It is an account-wide setting, so it asks
+// first unless yes is set.
+func enableSerialConsole(client *ec2.Client, yes bool) bool {
+	status, err := client.GetSerialConsoleAccessStatus(context.TODO(), &ec2.GetSerialConsoleAccessStatusInput{})
+	if err != nil {
+		fmt.Println("Got an error checking serial console access:")
+		fmt.Println(err)
+		return false
+	}
+	if aws.ToBool(status.SerialConsoleAccessEnabled) {
+		return true
+	}
+
+	if !yes && !confirm("Serial console access is disabled for this account and region. Enable it?") {
+		return false
+	}
+
+	_, err = client.EnableSerialConsoleAccess(context.TODO(), &ec2.EnableSerialConsoleAccessInput{})
+	if err != nil {
+		fmt.Println("Got an error enabling serial console access:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventSerialConsoleEnabled)
+	return true
+}
+
+// ephemeralKey writes a new ed25519 private key to a temporary file and
+// returns the file name and the public key in authorized_keys format.
+func ephemeralKey() (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println("Got an error generating a key:")
+		fmt.Println(err)
+		return "", ""
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		fmt.Println("Got an error encoding the public key:")
+		fmt.Println(err)
+		return "", ""
+	}
+	block, err := ssh.MarshalPrivateKey(private, "aws-wp "+time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		fmt.Println("Got an error encoding the private key:")
+		fmt.Println(err)
+		return "", ""
+	}
+
+	file, err := os.CreateTemp("", "aws-wp-serial-*")
+	if err != nil {
+		fmt.Println("Got an error writing the key:")
+		fmt.Println(err)
+		return "", ""
+	}
+	defer file.Close()
+
+	// CreateTemp already uses mode 0600, which ssh requires.
+	if err := pem.Encode(file, block); err != nil {
+		os.Remove(file.Name())
+		fmt.Println("Got an error writing the key:")
+		fmt.Println(err)
+		return "", ""
+	}
+
+	return file.Name(), string(ssh.MarshalAuthorizedKey(sshPublic))
+}
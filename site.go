@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// defaultPort is where Apache serves the site unless -port moves it.
+const defaultPort = 80
+
+var sitePathPattern = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// validateSitePath accepts a path like /blog or /sites/blog, without a
+// trailing slash, for -site-path.
+func validateSitePath(path string) error {
+	if path != "" && !sitePathPattern.MatchString(path) {
+		return fmt.Errorf("invalid -site-path %q, expected a path like /blog", path)
+	}
+	return nil
+}
+
+// port is the port the instance serves the site on.
+func (spec launchSpec) port() int32 {
+	if spec.Port == 0 {
+		return defaultPort
+	}
+	return spec.Port
+}
+
+// instanceURL is the site on the instance at host.
+func (spec launchSpec) instanceURL(host string) string {
+	if spec.port() != defaultPort {
+		host += ":" + strconv.Itoa(int(spec.port()))
+	}
+	return "http://" + host + spec.SitePath
+}
+
+// siteURL is the site behind base, such as the load balancer's URL.
+func (spec launchSpec) siteURL(base string) string {
+	return base + spec.SitePath
+}
+
+// origin strips the path from a site URL, leaving what health check paths
+// are relative to.
+func origin(siteURL string) string {
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return siteURL
+	}
+	return u.Scheme + "://" + u.Host
+}
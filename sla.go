@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// Route 53 health checks report their metrics in us-east-1 only.
+const healthCheckMetricsRegion = "us-east-1"
+
+// sla tracks the stack's availability: "sla enable" has Route 53 check the
+// site, "sla report" sums up a month of those checks, or of a CloudWatch
+// Synthetics canary, for a client's SLA.
+func sla(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp sla enable|disable|report [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "enable":
+		enableUptimeCheck(args[1:])
+	case "disable":
+		disableUptimeCheck(args[1:])
+	case "report":
+		slaReport(args[1:])
+	default:
+		fmt.Printf("Unknown sla command %q, expected enable, disable or report\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// uptimeTarget is what Route 53 checks: the stack's domain if it has one,
+// which stays put when the instance changes, else the host of its URL.
+func uptimeTarget(state *stackState) (*url.URL, error) {
+	target, err := url.Parse(state.URL)
+	if err != nil {
+		return nil, err
+	}
+	if state.Domain != "" {
+		target.Host = state.Domain
+	}
+	return target, nil
+}
+
+func uptimeCheckConfig(state *stackState, target *url.URL) *types.HealthCheckConfig {
+	config := &types.HealthCheckConfig{
+		Type:                     types.HealthCheckTypeHttp,
+		FullyQualifiedDomainName: aws.String(target.Hostname()),
+		ResourcePath:             aws.String(state.HealthCheck.path()),
+		RequestInterval:          aws.Int32(30),
+		FailureThreshold:         aws.Int32(3),
+		// Response times feed the status page. It cannot be turned on
+		// later.
+		MeasureLatency: aws.Bool(true),
+	}
+	if target.Scheme == "https" {
+		config.Type = types.HealthCheckTypeHttps
+		config.EnableSNI = aws.Bool(true)
+	}
+	if state.HealthCheck.Match != "" {
+		config.SearchString = aws.String(state.HealthCheck.Match)
+		config.Type = types.HealthCheckTypeHttpStrMatch
+		if target.Scheme == "https" {
+			config.Type = types.HealthCheckTypeHttpsStrMatch
+		}
+	}
+	if port := target.Port(); port != "" {
+		n, _ := strconv.Atoi(port)
+		config.Port = aws.Int32(int32(n))
+	}
+	return config
+}
+
+func enableUptimeCheck(args []string) {
+	fs := flag.NewFlagSet("sla enable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "sla enable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if state.UptimeCheck != "" {
+		fmt.Printf("Stack %s already has Route 53 health check %s\n", state.Name, state.UptimeCheck)
+		return
+	}
+	// Route 53 cannot log in, every check would fail.
+	if state.Htpasswd != "" || state.HealthCheck.hasAuth() {
+		fmt.Println("The site is behind basic authentication, which Route 53 health checks cannot pass; report from a Synthetics canary with sla report -canary instead")
+		return
+	}
+	target, err := uptimeTarget(state)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	client := route53.NewFromConfig(env.aws)
+	result, err := client.CreateHealthCheck(context.TODO(), &route53.CreateHealthCheckInput{
+		CallerReference:   aws.String(state.Name + "-" + newOperationId()),
+		HealthCheckConfig: uptimeCheckConfig(state, target),
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the Route 53 health check:")
+		fmt.Println(err)
+		return
+	}
+	id := aws.ToString(result.HealthCheck.Id)
+	state.UptimeCheck = id
+	saveStackState(state)
+
+	_, err = client.ChangeTagsForResource(context.TODO(), &route53.ChangeTagsForResourceInput{
+		ResourceId:   aws.String(id),
+		ResourceType: types.TagResourceTypeHealthcheck,
+		AddTags: []types.Tag{
+			{Key: aws.String("Name"), Value: aws.String(state.Name)},
+			{Key: aws.String(stackTag), Value: aws.String(state.Name)},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error tagging the Route 53 health check:")
+		fmt.Println(err)
+	}
+	emit(eventUptimeCheckCreated, "health_check_id", id, "target", target.String())
+	fmt.Printf("Route 53 checks %s every 30 seconds, health check %s\n", target, id)
+}
+
+func disableUptimeCheck(args []string) {
+	fs := flag.NewFlagSet("sla disable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "sla disable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if state.UptimeCheck == "" {
+		fmt.Printf("Stack %s has no Route 53 health check\n", state.Name)
+		return
+	}
+	if deleteUptimeCheck(env, state) {
+		fmt.Println("The health check's metrics stay in CloudWatch for 15 months")
+	}
+}
+
+// deleteUptimeCheck deletes the stack's health check. Its metrics remain,
+// so months it ran can still be reported.
+func deleteUptimeCheck(env *environment, state *stackState) bool {
+	_, err := route53.NewFromConfig(env.aws).DeleteHealthCheck(context.TODO(), &route53.DeleteHealthCheckInput{
+		HealthCheckId: aws.String(state.UptimeCheck),
+	})
+	if err != nil && !isErrorCode(err, "NoSuchHealthCheck") {
+		fmt.Println("Got an error deleting the Route 53 health check:")
+		fmt.Println(err)
+		return false
+	}
+	emit(eventUptimeCheckDeleted, "health_check_id", state.UptimeCheck)
+	state.UptimeCheck = ""
+	saveStackState(state)
+	return true
+}
+
+// updateUptimeCheck points the health check at the stack's current address
+// after the instance changed. Checks of a domain need no update.
+func updateUptimeCheck(env *environment, state *stackState) bool {
+	if state.UptimeCheck == "" || state.Domain != "" {
+		return true
+	}
+	target, err := uptimeTarget(state)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	config := uptimeCheckConfig(state, target)
+	_, err = route53.NewFromConfig(env.aws).UpdateHealthCheck(context.TODO(), &route53.UpdateHealthCheckInput{
+		HealthCheckId:            aws.String(state.UptimeCheck),
+		FullyQualifiedDomainName: config.FullyQualifiedDomainName,
+		Port:                     config.Port,
+	})
+	if err != nil {
+		fmt.Println("Got an error updating the Route 53 health check:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// slaIncident is a stretch of consecutive periods with failed checks.
+// Downtime is the failed share of them, which with coarser periods of
+// older months is less than the stretch.
+type slaIncident struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DowntimeSeconds int64     `json:"downtime_seconds"`
+}
+
+type slaSummary struct {
+	Stack           string        `json:"stack"`
+	Month           string        `json:"month"`
+	Source          string        `json:"source"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	UptimePercent   float64       `json:"uptime_percent"`
+	DowntimeSeconds int64         `json:"downtime_seconds"`
+	NoDataSeconds   int64         `json:"no_data_seconds"`
+	Incidents       []slaIncident `json:"incidents"`
+}
+
+func slaReport(args []string) {
+	fs := flag.NewFlagSet("sla report", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	month := fs.String("month", "", "Month to report as YYYY-MM, the last full month by default")
+	canary := fs.String("canary", "", "Report from this CloudWatch Synthetics canary in the stack's region instead of the Route 53 health check")
+	all := fs.Bool("all", false, "Report every stack with a Route 53 health check")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	asCSV := fs.Bool("csv", false, "Print one CSV line per stack, -incidents for one per incident")
+	incidents := fs.Bool("incidents", false, "With -csv, list the incidents instead")
+	fs.Parse(args)
+
+	start, end, err := reportMonth(*month, time.Now().UTC())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *all && *canary != "" {
+		fmt.Println("-canary reports a single stack, pass -name instead of -all")
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var states []*stackState
+	if *all {
+		if states, err = listStates(); err != nil {
+			fmt.Println("Got an error reading the stacks:")
+			fmt.Println(err)
+			return
+		}
+	} else {
+		state := loadStack(env)
+		if state == nil {
+			return
+		}
+		states = []*stackState{state}
+	}
+
+	var reports []slaSummary
+	for _, state := range states {
+		query, source := uptimeQuery(state, *canary)
+		if query == nil {
+			if !*all {
+				fmt.Printf("Stack %s has no Route 53 health check, run aws-wp sla enable -name %s or pass -canary\n", state.Name, state.Name)
+				return
+			}
+			continue
+		}
+		region := healthCheckMetricsRegion
+		if *canary != "" {
+			region = state.Region
+		}
+		cfg := env.aws.Copy()
+		cfg.Region = region
+
+		report, err := uptimeReport(cloudwatch.NewFromConfig(cfg), query, start, end)
+		if err != nil {
+			fmt.Printf("Got an error retrieving the availability of %s:\n", state.Name)
+			fmt.Println(err)
+			continue
+		}
+		report.Stack = state.Name
+		report.Month = start.Format("2006-01")
+		report.Source = source
+		reports = append(reports, report)
+	}
+
+	switch {
+	case *asJSON:
+		data, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(data))
+	case *asCSV:
+		printSLACSV(reports, *incidents)
+	default:
+		for i, r := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			printSLAReport(r)
+		}
+	}
+}
+
+// reportMonth returns the bounds of month, a YYYY-MM, or of the month
+// before now. The current month ends now.
+func reportMonth(month string, now time.Time) (time.Time, time.Time, error) {
+	var start time.Time
+	if month == "" {
+		start = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	} else {
+		var err error
+		if start, err = time.Parse("2006-01", month); err != nil {
+			return start, start, fmt.Errorf("invalid -month %q, expected YYYY-MM", month)
+		}
+	}
+	end := start.AddDate(0, 1, 0)
+	if end.After(now) {
+		end = now.Truncate(time.Minute)
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("-month %s has not started yet", month)
+	}
+	return start, end, nil
+}
+
+// uptimeQuery is the metric that says whether the site was up, as a share
+// of 1: the health check's status, or the canary's success percentage.
+func uptimeQuery(state *stackState, canary string) (*cwtypes.Metric, string) {
+	if canary != "" {
+		return &cwtypes.Metric{
+			Namespace:  aws.String("CloudWatchSynthetics"),
+			MetricName: aws.String("SuccessPercent"),
+			Dimensions: []cwtypes.Dimension{{Name: aws.String("CanaryName"), Value: aws.String(canary)}},
+		}, "Synthetics canary " + canary
+	}
+	if state.UptimeCheck == "" {
+		return nil, ""
+	}
+	return &cwtypes.Metric{
+		Namespace:  aws.String("AWS/Route53"),
+		MetricName: aws.String("HealthCheckStatus"),
+		Dimensions: []cwtypes.Dimension{{Name: aws.String("HealthCheckId"), Value: aws.String(state.UptimeCheck)}},
+	}, "Route 53 health check " + state.UptimeCheck
+}
+
+// reportPeriod is the finest period CloudWatch still keeps for data from
+// start: one minute for 15 days, five minutes for 63 days, then an hour.
+// Canaries run every few minutes at most, so they get five minutes.
+func reportPeriod(start time.Time, metric *cwtypes.Metric) time.Duration {
+	age := time.Since(start)
+	switch {
+	case age > 63*24*time.Hour:
+		return time.Hour
+	case age > 15*24*time.Hour || aws.ToString(metric.Namespace) == "CloudWatchSynthetics":
+		return 5 * time.Minute
+	}
+	return time.Minute
+}
+
+func uptimeReport(client *cloudwatch.Client, metric *cwtypes.Metric, start time.Time, end time.Time) (slaSummary, error) {
+	report := slaSummary{Start: start, End: end, Incidents: []slaIncident{}}
+	period := reportPeriod(start, metric)
+	scale := 1.0
+	if aws.ToString(metric.Namespace) == "CloudWatchSynthetics" {
+		scale = 100
+	}
+
+	values := map[time.Time]float64{}
+	input := &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: []cwtypes.MetricDataQuery{{
+			Id:         aws.String("up"),
+			MetricStat: &cwtypes.MetricStat{Metric: metric, Period: aws.Int32(int32(period.Seconds())), Stat: aws.String("Average")},
+		}},
+		StartTime: aws.Time(start),
+		EndTime:   aws.Time(end),
+	}
+	for {
+		result, err := client.GetMetricData(context.TODO(), input)
+		if err != nil {
+			return report, err
+		}
+		for _, r := range result.MetricDataResults {
+			for i, t := range r.Timestamps {
+				values[t.UTC()] = r.Values[i] / scale
+			}
+		}
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+
+	var covered, down float64
+	var current *slaIncident
+	for t := start; t.Before(end); t = t.Add(period) {
+		up, ok := values[t]
+		if !ok {
+			report.NoDataSeconds += int64(period.Seconds())
+			continue
+		}
+		covered += period.Seconds()
+		lost := (1 - up) * period.Seconds()
+		if lost <= 0 {
+			current = nil
+			continue
+		}
+		down += lost
+		if current == nil {
+			report.Incidents = append(report.Incidents, slaIncident{Start: t})
+			current = &report.Incidents[len(report.Incidents)-1]
+		}
+		current.End = t.Add(period)
+		current.DowntimeSeconds += int64(lost)
+	}
+
+	report.DowntimeSeconds = int64(down)
+	if covered > 0 {
+		report.UptimePercent = 100 * (covered - down) / covered
+	}
+	return report, nil
+}
+
+func printSLAReport(r slaSummary) {
+	fmt.Printf("Stack:     %s\n", r.Stack)
+	fmt.Printf("Month:     %s, from %s\n", r.Month, r.Source)
+	fmt.Printf("Uptime:    %.3f%%\n", r.UptimePercent)
+	fmt.Printf("Downtime:  %s in %d incidents\n", seconds(r.DowntimeSeconds), len(r.Incidents))
+	if r.NoDataSeconds > 0 {
+		fmt.Printf("No data:   %s, not counted\n", seconds(r.NoDataSeconds))
+	}
+	for _, i := range r.Incidents {
+		fmt.Printf("  %s to %s  %s down\n", i.Start.Format("2006-01-02 15:04"), i.End.Format("15:04 MST"), seconds(i.DowntimeSeconds))
+	}
+}
+
+func seconds(s int64) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+func printSLACSV(reports []slaSummary, incidents bool) {
+	w := csv.NewWriter(os.Stdout)
+	if incidents {
+		w.Write([]string{"stack", "month", "start", "end", "downtime_seconds"})
+		for _, r := range reports {
+			for _, i := range r.Incidents {
+				w.Write([]string{r.Stack, r.Month, i.Start.Format(time.RFC3339), i.End.Format(time.RFC3339), strconv.FormatInt(i.DowntimeSeconds, 10)})
+			}
+		}
+	} else {
+		w.Write([]string{"stack", "month", "source", "uptime_percent", "downtime_seconds", "incidents", "no_data_seconds"})
+		for _, r := range reports {
+			w.Write([]string{
+				r.Stack, r.Month, r.Source,
+				strconv.FormatFloat(r.UptimePercent, 'f', 3, 64),
+				strconv.FormatInt(r.DowntimeSeconds, 10),
+				strconv.Itoa(len(r.Incidents)),
+				strconv.FormatInt(r.NoDataSeconds, 10),
+			})
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// commandDeliveryTimeout is how long a command may wait for the
+	// instance's SSM agent to pick it up.
+	commandDeliveryTimeout = 5 * time.Minute
+	// commandExecutionTimeout is the executionTimeout of AWS-RunShellScript
+	// when the command does not set one.
+	commandExecutionTimeout = time.Hour
+)
+
+// runShellScript runs script on the instance with the AWS-RunShellScript
+// document and returns its standard output. The instance needs the SSM agent
+// and an instance profile that allows Systems Manager.
+func runShellScript(client *ssm.Client, instanceId string, script string) (string, error) {
+	return runCommand(client, instanceId, &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		Parameters: map[string][]string{
+			"commands": {script},
+		},
+	})
+}
+
+// runCommand sends the command to the instance, waits for it to finish and
+// returns its standard output. A command the agent does not pick up within
+// commandDeliveryTimeout, or that runs past its executionTimeout, is
+// cancelled, so that a dead agent does not keep the tool waiting.
+func runCommand(client *ssm.Client, instanceId string, sendCommandInput *ssm.SendCommandInput) (string, error) {
+	sendCommandInput.InstanceIds = []string{instanceId}
+	if sendCommandInput.TimeoutSeconds == 0 {
+		sendCommandInput.TimeoutSeconds = int32(commandDeliveryTimeout.Seconds())
+	}
+	execution := commandExecutionTimeout
+	if value := sendCommandInput.Parameters["executionTimeout"]; len(value) == 1 {
+		if seconds, err := strconv.Atoi(value[0]); err == nil {
+			execution = time.Duration(seconds) * time.Second
+		}
+	}
+
+	command, err := client.SendCommand(context.TODO(), sendCommandInput)
+	if err != nil {
+		return "", err
+	}
+	commandId := aws.ToString(command.Command.CommandId)
+	sent := time.Now()
+	delivered := sent.Add(commandDeliveryTimeout)
+	deadline := delivered.Add(execution + time.Minute)
+
+	invocationInput := &ssm.GetCommandInvocationInput{
+		CommandId:  command.Command.CommandId,
+		InstanceId: aws.String(instanceId),
+	}
+
+	for {
+		time.Sleep(2 * time.Second)
+
+		if time.Now().After(deadline) {
+			cancelCommand(client, commandId)
+			return "", fmt.Errorf("command %s did not finish within %s, cancelled it", commandId, time.Since(sent).Round(time.Second))
+		}
+
+		invocation, err := client.GetCommandInvocation(context.TODO(), invocationInput)
+		if err != nil {
+			// The invocation shows up shortly after SendCommand returns.
+			var ae smithy.APIError
+			if errors.As(err, &ae) && ae.ErrorCode() == "InvocationDoesNotExist" {
+				continue
+			}
+			return "", err
+		}
+
+		switch invocation.Status {
+		case types.CommandInvocationStatusPending, types.CommandInvocationStatusDelayed:
+			if time.Now().After(delivered) {
+				cancelCommand(client, commandId)
+				return "", fmt.Errorf("the SSM agent on %s did not pick up command %s within %s, check that it is running; cancelled the command",
+					instanceId, commandId, commandDeliveryTimeout)
+			}
+		case types.CommandInvocationStatusSuccess:
+			return aws.ToString(invocation.StandardOutputContent), nil
+		case types.CommandInvocationStatusFailed,
+			types.CommandInvocationStatusCancelled,
+			types.CommandInvocationStatusTimedOut:
+			return aws.ToString(invocation.StandardOutputContent),
+				fmt.Errorf("command %s: %s", invocation.Status, aws.ToString(invocation.StandardErrorContent))
+		}
+	}
+}
+
+// cancelCommand cancels a command that is given up on. A command that
+// cannot be cancelled times out on its own.
+func cancelCommand(client *ssm.Client, commandId string) {
+	_, err := client.CancelCommand(context.TODO(), &ssm.CancelCommandInput{CommandId: aws.String(commandId)})
+	if err != nil {
+		fmt.Println("Got an error cancelling the command:")
+		fmt.Println(err)
+	}
+}
+
+// waitManaged waits until a new instance's SSM agent has registered, before
+// which commands cannot be sent to it.
+func waitManaged(client *ssm.Client, instanceId string) bool {
+	for start := time.Now(); time.Since(start) < healthTimeout; time.Sleep(10 * time.Second) {
+		result, err := client.DescribeInstanceInformation(context.TODO(), &ssm.DescribeInstanceInformationInput{
+			Filters: []types.InstanceInformationStringFilter{{Key: aws.String("InstanceIds"), Values: []string{instanceId}}},
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving the instance's Systems Manager status:")
+			fmt.Println(err)
+			return false
+		}
+		if len(result.InstanceInformationList) > 0 && result.InstanceInformationList[0].PingStatus == types.PingStatusOnline {
+			return true
+		}
+	}
+	fmt.Printf("Got an error: %s did not register with Systems Manager, check that its instance profile allows it\n", instanceId)
+	return false
+}
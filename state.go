@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stackTag marks every resource the tool creates with the owning stack name.
+const stackTag = "aws-wp:stack"
+
+// stackState is what the tool remembers about a stack between runs. It is
+// stored as JSON under stateDir.
+type stackState struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	launchSpec
+	VpcId           string        `json:"vpc_id,omitempty"`
+	InstanceId      string        `json:"instance_id"`
+	LaunchToken     string        `json:"launch_token,omitempty"`
+	SecurityGroupId string        `json:"security_group_id"`
+	RecoveryAlarm   string        `json:"recovery_alarm,omitempty"`
+	DiskAlarm       string        `json:"disk_alarm,omitempty"`
+	LogAlarms       []string      `json:"log_alarms,omitempty"`
+	UptimeCheck     string        `json:"uptime_check,omitempty"`
+	StatusPage      *statusPage   `json:"status_page,omitempty"`
+	Schedule        *officeHours  `json:"schedule,omitempty"`
+	Export          *siteExport   `json:"export,omitempty"`
+	BasicAuthSecret string        `json:"basic_auth_secret,omitempty"`
+	Domain          string        `json:"domain,omitempty"`
+	DNSProvider     string        `json:"dns_provider,omitempty"`
+	DNSRecords      []dnsRecord   `json:"dns_records,omitempty"`
+	CertificateArn  string        `json:"certificate_arn,omitempty"`
+	ElasticIp       *elasticIp    `json:"elastic_ip,omitempty"`
+	LoadBalancer    *loadBalancer `json:"load_balancer,omitempty"`
+	PublicDnsName   string        `json:"public_dns_name,omitempty"`
+	URL             string        `json:"url,omitempty"`
+	CreatedAt       time.Time     `json:"created_at"`
+}
+
+// homeDir is where the tool keeps its files: $AWS_WP_HOME, defaulting to
+// ~/.aws-wp.
+func homeDir() string {
+	if home := os.Getenv("AWS_WP_HOME"); home != "" {
+		return home
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		userHome = "."
+	}
+	return filepath.Join(userHome, ".aws-wp")
+}
+
+func stateDir() string {
+	return filepath.Join(homeDir(), "stacks")
+}
+
+func statePath(name string) string {
+	return filepath.Join(stateDir(), name+".json")
+}
+
+// loadState reads the state of the named stack. The error wraps
+// os.ErrNotExist when the stack is unknown.
+func loadState(name string) (*stackState, error) {
+	data, err := ioutil.ReadFile(statePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stackState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing state of stack %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// loadStack loads the state of env's stack and points env at the region the
+// stack lives in. It prints the reason and returns nil when that fails.
+func loadStack(env *environment) *stackState {
+	state, err := loadState(env.name)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No stack named %s\n", env.name)
+		return nil
+	}
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	if state.Region != "" {
+		env.aws.Region = state.Region
+	}
+	return state
+}
+
+// listStates reads the state of every known stack, ordered by name.
+func listStates() ([]*stackState, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*stackState, 0, len(paths))
+	for _, path := range paths {
+		state, err := loadState(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (s *stackState) save() error {
+	if readOnly {
+		return fmt.Errorf("read-only mode: the state of stack %s is not written", s.Name)
+	}
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write and rename so an interrupted run never leaves half a file.
+	tmp := statePath(s.Name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath(s.Name))
+}
+
+func removeState(name string) error {
+	err := os.Remove(statePath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// vars returns the stack variables handed to hooks.
+func (s *stackState) vars() map[string]string {
+	return map[string]string{
+		"AWS_WP_STACK":             s.Name,
+		"AWS_WP_REGION":            s.Region,
+		"AWS_WP_IMAGE_ID":          s.ImageId,
+		"AWS_WP_INSTANCE_TYPE":     s.InstanceType,
+		"AWS_WP_INSTANCE_ID":       s.InstanceId,
+		"AWS_WP_SECURITY_GROUP_ID": s.SecurityGroupId,
+		"AWS_WP_PUBLIC_DNS":        s.PublicDnsName,
+		"AWS_WP_URL":               s.URL,
+		"AWS_WP_PUBLIC_IP":         s.publicIp(),
+		"AWS_WP_DOMAIN":            s.Domain,
+	}
+}
+
+func (s *stackState) publicIp() string {
+	if s.ElasticIp == nil {
+		return ""
+	}
+	return s.ElasticIp.PublicIp
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// list shows every stack the tool knows about with its instance's state.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	format := fs.String("format", "", "Go template for the output, inline or @file")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	t, err := outputFormat(env, "list", *format)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	states, err := listStates()
+	if err != nil {
+		fmt.Println("Got an error reading the stacks:")
+		fmt.Println(err)
+		return
+	}
+	// A custom format decides itself how to show no stacks.
+	if len(states) == 0 && *format == "" && env.config.Formats["list"] == "" {
+		fmt.Println(msg("list.empty"))
+		return
+	}
+
+	// One describe call per region for all of its stacks' instances.
+	byRegion := map[string][]string{}
+	for _, s := range states {
+		if s.InstanceId != "" {
+			byRegion[s.Region] = append(byRegion[s.Region], s.InstanceId)
+		}
+	}
+	instanceStates := map[string]string{}
+	for region, ids := range byRegion {
+		cfg := env.aws.Copy()
+		cfg.Region = region
+		result, err := ec2.NewFromConfig(cfg).DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{{Name: aws.String("instance-id"), Values: ids}},
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving information about the instances in " + region + ":")
+			fmt.Println(err)
+			continue
+		}
+		for _, r := range result.Reservations {
+			for _, i := range r.Instances {
+				instanceStates[aws.ToString(i.InstanceId)] = string(i.State.Name)
+			}
+		}
+	}
+
+	items := make([]listItem, len(states))
+	for i, s := range states {
+		state := instanceStates[s.InstanceId]
+		if state == "" {
+			state = msg("state.unknown")
+		}
+		items[i] = listItem{stackState: s, InstanceState: state}
+	}
+	if err := render(t, items); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// listItem is a stack as list formats see it.
+type listItem struct {
+	*stackState
+	InstanceState string
+}
+
+// statusView is the stack as status formats see it.
+type statusView struct {
+	*stackState
+	InstanceState string
+	Usage         agentUsage
+	Maintenance   []maintenanceNotice
+	Transition    *scheduleTransition
+}
+
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	alarmDisk := fs.Int("alarm-disk", 0, "Also create or update the alarm for the root filesystem at this percent full")
+	format := fs.String("format", "", "Go template for the output, inline or @file")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	t, err := outputFormat(env, "status", *format)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *alarmDisk < 0 || *alarmDisk > 100 {
+		fmt.Println("-alarm-disk is a percentage between 1 and 100")
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	view := statusView{stackState: state, InstanceState: msg("state.unknown")}
+	if instance := describeInstance(client, state.InstanceId); instance != nil {
+		view.InstanceState = string(instance.State.Name)
+	}
+
+	cwClient := cloudwatch.NewFromConfig(env.aws)
+	view.Usage = latestAgentUsage(cwClient, state.InstanceId)
+	if *alarmDisk > 0 {
+		if alarm := createDiskAlarm(cwClient, state.Name, state.InstanceId, *alarmDisk, notifyTopics(env)); alarm != "" {
+			state.AlarmDisk = *alarmDisk
+			state.DiskAlarm = alarm
+			saveStackState(state)
+		}
+	}
+	view.Maintenance = maintenanceNotices(client, state)
+	if state.Schedule != nil {
+		now := time.Now()
+		if sched := newScheduler(env, state.Schedule, now); sched != nil {
+			view.Transition, err = sched.next(now)
+			if err != nil {
+				fmt.Println("Got an error reading the change calendar:")
+				fmt.Println(err)
+			}
+		}
+	}
+
+	if err := render(t, view); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func describeInstance(client *ec2.Client, instanceId string) *types.Instance {
+	result, err := client.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving information about your Amazon EC2 instances:")
+		fmt.Println(err)
+		return nil
+	}
+
+	for _, r := range result.Reservations {
+		for _, i := range r.Instances {
+			return &i
+		}
+	}
+	return nil
+}
+
+// maintenanceNotice is something AWS will do to the stack on its own.
+type maintenanceNotice struct {
+	Text     string
+	Deadline time.Time
+}
+
+// maintenanceNotices lists pending scheduled events of the instance and the
+// deprecation of its image, earliest deadline first.
+func maintenanceNotices(client *ec2.Client, state *stackState) []maintenanceNotice {
+	var notices []maintenanceNotice
+
+	statusResult, err := client.DescribeInstanceStatus(context.TODO(), &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         []string{state.InstanceId},
+		IncludeAllInstances: aws.Bool(true),
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the instance status:")
+		fmt.Println(err)
+	} else {
+		for _, s := range statusResult.InstanceStatuses {
+			for _, e := range s.Events {
+				description := aws.ToString(e.Description)
+				// Past events stay listed for a while with a prefix.
+				if strings.HasPrefix(description, "[Completed]") || strings.HasPrefix(description, "[Canceled]") {
+					continue
+				}
+				deadline := aws.ToTime(e.NotBefore)
+				notices = append(notices, maintenanceNotice{
+					Text:     msg("maintenance.scheduled", e.Code, deadline.Local().Format(time.RFC1123), description),
+					Deadline: deadline,
+				})
+			}
+		}
+	}
+
+	imageResult, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{
+		ImageIds: []string{state.ImageId},
+	})
+	switch {
+	case isErrorCode(err, "InvalidAMIID.NotFound") || (err == nil && len(imageResult.Images) == 0):
+		notices = append(notices, maintenanceNotice{
+			Text:     msg("maintenance.image_gone", state.ImageId),
+			Deadline: time.Now(),
+		})
+	case err != nil:
+		fmt.Println("Got an error retrieving information about the image:")
+		fmt.Println(err)
+	default:
+		if deprecation := aws.ToString(imageResult.Images[0].DeprecationTime); deprecation != "" {
+			deadline, err := time.Parse(time.RFC3339, deprecation)
+			if err == nil {
+				key := "maintenance.image_deprecates"
+				if deadline.Before(time.Now()) {
+					key = "maintenance.image_deprecated"
+				}
+				notices = append(notices, maintenanceNotice{
+					Text:     msg(key, state.ImageId, deadline.Local().Format(time.RFC1123)),
+					Deadline: deadline,
+				})
+			}
+		}
+	}
+
+	sort.Slice(notices, func(i, j int) bool {
+		return notices[i].Deadline.Before(notices[j].Deadline)
+	})
+	return notices
+}
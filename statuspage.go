@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// statusPageMaxAge is how long CloudFront and browsers keep the page before
+// fetching it again.
+const statusPageMaxAge = 60
+
+// cachingOptimizedPolicy is CloudFront's managed CachingOptimized cache
+// policy, which follows the objects' Cache-Control.
+const cachingOptimizedPolicy = "658327ea-f89d-4fab-a63d-7e88639e58f6"
+
+// statusPage is a public page with the stack's health, served by CloudFront
+// from a private bucket only its origin access identity can read.
+type statusPage struct {
+	Bucket         string `json:"bucket"`
+	OriginAccessId string `json:"origin_access_identity,omitempty"`
+	DistributionId string `json:"distribution_id,omitempty"`
+	DomainName     string `json:"domain_name,omitempty"`
+}
+
+func (p *statusPage) URL() string {
+	return "https://" + p.DomainName
+}
+
+func statusPageBucketName(stack string) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "aws-wp-" + stack + "-status-" + hex.EncodeToString(suffix)
+}
+
+// statuspage publishes the stack's Route 53 health check for people without
+// AWS access: "statuspage enable" sets up the page, "statuspage publish"
+// updates it and "statuspage disable" removes it. Nothing updates the page
+// on its own, publish runs from cron or CI like gc, or keeps going with
+// -every.
+func statuspage(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp statuspage enable|publish|disable [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "enable":
+		enableStatusPage(args[1:])
+	case "publish":
+		publishStatusPage(args[1:])
+	case "disable":
+		disableStatusPage(args[1:])
+	default:
+		fmt.Printf("Unknown statuspage command %q, expected enable, publish or disable\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func enableStatusPage(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("statuspage enable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "statuspage enable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if state.StatusPage != nil && state.StatusPage.DistributionId != "" {
+		fmt.Println("Status page: " + state.StatusPage.URL())
+		return
+	}
+	if state.UptimeCheck == "" {
+		fmt.Printf("The status page shows the stack's Route 53 health check, run aws-wp sla enable -name %s first\n", state.Name)
+		return
+	}
+
+	s3Client := s3.NewFromConfig(env.aws)
+	page := state.StatusPage
+	if page == nil {
+		page = &statusPage{Bucket: statusPageBucketName(state.Name)}
+		if !createStackBucket(s3Client, page.Bucket, state.Region, state.Name, "", 0) {
+			return
+		}
+		state.StatusPage = page
+		saveStackState(state)
+	}
+
+	client := cloudfront.NewFromConfig(env.aws)
+	if page.OriginAccessId == "" {
+		result, err := client.CreateCloudFrontOriginAccessIdentity(context.TODO(), &cloudfront.CreateCloudFrontOriginAccessIdentityInput{
+			CloudFrontOriginAccessIdentityConfig: &cftypes.CloudFrontOriginAccessIdentityConfig{
+				CallerReference: aws.String(page.Bucket),
+				Comment:         aws.String("aws-wp status page of " + state.Name),
+			},
+		})
+		if err != nil {
+			fmt.Println("Got an error creating the CloudFront origin access identity:")
+			fmt.Println(err)
+			return
+		}
+		page.OriginAccessId = aws.ToString(result.CloudFrontOriginAccessIdentity.Id)
+		saveStackState(state)
+	}
+
+	if !allowOriginAccess(s3Client, page) || !publish(env, state) {
+		return
+	}
+
+	result, err := client.CreateDistributionWithTags(context.TODO(), &cloudfront.CreateDistributionWithTagsInput{
+		DistributionConfigWithTags: &cftypes.DistributionConfigWithTags{
+			DistributionConfig: &cftypes.DistributionConfig{
+				CallerReference:   aws.String(page.Bucket),
+				Comment:           aws.String("aws-wp status page of " + state.Name),
+				Enabled:           aws.Bool(true),
+				DefaultRootObject: aws.String("index.html"),
+				PriceClass:        cftypes.PriceClassPriceClass100,
+				Origins: &cftypes.Origins{
+					Quantity: aws.Int32(1),
+					Items: []cftypes.Origin{{
+						Id:         aws.String("status"),
+						DomainName: aws.String(page.Bucket + ".s3." + state.Region + ".amazonaws.com"),
+						S3OriginConfig: &cftypes.S3OriginConfig{
+							OriginAccessIdentity: aws.String("origin-access-identity/cloudfront/" + page.OriginAccessId),
+						},
+					}},
+				},
+				DefaultCacheBehavior: &cftypes.DefaultCacheBehavior{
+					TargetOriginId:       aws.String("status"),
+					ViewerProtocolPolicy: cftypes.ViewerProtocolPolicyRedirectToHttps,
+					CachePolicyId:        aws.String(cachingOptimizedPolicy),
+					Compress:             aws.Bool(true),
+				},
+			},
+			Tags: &cftypes.Tags{Items: []cftypes.Tag{{Key: aws.String(stackTag), Value: aws.String(state.Name)}}},
+		},
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the CloudFront distribution:")
+		fmt.Println(err)
+		return
+	}
+	page.DistributionId = aws.ToString(result.Distribution.Id)
+	page.DomainName = aws.ToString(result.Distribution.DomainName)
+	saveStackState(state)
+	emit(eventStatusPageCreated, "distribution_id", page.DistributionId, "url", page.URL())
+
+	fmt.Println("Status page: " + page.URL())
+	fmt.Printf("CloudFront takes a few minutes to serve it. Keep it current with aws-wp statuspage publish -name %s from cron, or -every 5m.\n", state.Name)
+}
+
+// allowOriginAccess lets the origin access identity read the bucket. The
+// bucket stays private: a policy for a single principal is not public. A
+// new identity takes a moment before S3 accepts it as a principal.
+func allowOriginAccess(client *s3.Client, page *statusPage) bool {
+	policy, _ := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":    "Allow",
+			"Principal": map[string]string{"AWS": "arn:aws:iam::cloudfront:user/CloudFront Origin Access Identity " + page.OriginAccessId},
+			"Action":    "s3:GetObject",
+			"Resource":  "arn:aws:s3:::" + page.Bucket + "/*",
+		}},
+	})
+	var err error
+	for attempt := 0; attempt < 6; attempt++ {
+		_, err = client.PutBucketPolicy(context.TODO(), &s3.PutBucketPolicyInput{
+			Bucket: aws.String(page.Bucket),
+			Policy: aws.String(string(policy)),
+		})
+		if !isErrorCode(err, "MalformedPolicy") {
+			break
+		}
+		time.Sleep(5 * time.Second)
+	}
+	if err != nil {
+		fmt.Println("Got an error granting CloudFront access to the bucket:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+func publishStatusPage(args []string) {
+	fs := flag.NewFlagSet("statuspage publish", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	every := fs.Duration("every", 0, "Keep publishing at this interval instead of once")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if state.StatusPage == nil || state.UptimeCheck == "" {
+		fmt.Printf("Stack %s has no status page, run aws-wp statuspage enable -name %s\n", state.Name, state.Name)
+		return
+	}
+
+	for {
+		if publish(env, state) {
+			log.Printf("Published %s", state.StatusPage.URL())
+		}
+		if *every <= 0 {
+			return
+		}
+		time.Sleep(*every)
+	}
+}
+
+// statusPageData is what the page shows, and status.json next to it holds.
+type statusPageData struct {
+	Title      string        `json:"title"`
+	Status     string        `json:"status"`
+	CheckedAt  *time.Time    `json:"checked_at,omitempty"`
+	Uptime     float64       `json:"uptime_30d_percent"`
+	AvgLatency int64         `json:"avg_response_ms,omitempty"`
+	MaxLatency int64         `json:"max_response_ms,omitempty"`
+	Incidents  []slaIncident `json:"incidents"`
+	Updated    time.Time     `json:"updated"`
+
+	// Points is the 24 hour response time graph as SVG polyline points.
+	Points string `json:"-"`
+}
+
+// publish renders the page from the health check's metrics and uploads it.
+func publish(env *environment, state *stackState) bool {
+	cfg := env.aws.Copy()
+	cfg.Region = healthCheckMetricsRegion
+	client := cloudwatch.NewFromConfig(cfg)
+
+	now := time.Now().UTC()
+	data := statusPageData{Title: state.Name, Status: "unknown", Updated: now}
+	if state.Domain != "" {
+		data.Title = state.Domain
+	}
+
+	metric, _ := uptimeQuery(state, "")
+	report, err := uptimeReport(client, metric, now.Add(-30*24*time.Hour).Truncate(time.Hour), now.Truncate(time.Minute))
+	if err != nil {
+		fmt.Println("Got an error retrieving the availability:")
+		fmt.Println(err)
+		return false
+	}
+	data.Uptime = report.UptimePercent
+	data.Incidents = report.Incidents
+	// Newest first, at most ten.
+	for i, j := 0, len(data.Incidents)-1; i < j; i, j = i+1, j-1 {
+		data.Incidents[i], data.Incidents[j] = data.Incidents[j], data.Incidents[i]
+	}
+	if len(data.Incidents) > 10 {
+		data.Incidents = data.Incidents[:10]
+	}
+
+	latency := &cwtypes.Metric{
+		Namespace:  aws.String("AWS/Route53"),
+		MetricName: aws.String("TimeToFirstByte"),
+		Dimensions: metric.Dimensions,
+	}
+	result, err := client.GetMetricData(context.TODO(), &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: []cwtypes.MetricDataQuery{
+			{Id: aws.String("current"), MetricStat: &cwtypes.MetricStat{Metric: metric, Period: aws.Int32(60), Stat: aws.String("Minimum")}},
+			{Id: aws.String("latency"), MetricStat: &cwtypes.MetricStat{Metric: latency, Period: aws.Int32(300), Stat: aws.String("Average")}},
+		},
+		StartTime: aws.Time(now.Add(-24 * time.Hour)),
+		EndTime:   aws.Time(now),
+		ScanBy:    cwtypes.ScanByTimestampAscending,
+	})
+	if err != nil {
+		fmt.Println("Got an error retrieving the health check metrics:")
+		fmt.Println(err)
+		return false
+	}
+	for _, r := range result.MetricDataResults {
+		switch aws.ToString(r.Id) {
+		case "current":
+			if n := len(r.Values); n > 0 && now.Sub(r.Timestamps[n-1]) < 10*time.Minute {
+				data.Status = "down"
+				if r.Values[n-1] >= 1 {
+					data.Status = "up"
+				}
+				checked := r.Timestamps[n-1].UTC()
+				data.CheckedAt = &checked
+			}
+		case "latency":
+			data.Points, data.AvgLatency, data.MaxLatency = latencyGraph(r.Timestamps, r.Values, now)
+		}
+	}
+
+	var page bytes.Buffer
+	if err := statusPageTemplate.Execute(&page, data); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	status, _ := json.MarshalIndent(data, "", "  ")
+
+	s3Client := s3.NewFromConfig(env.aws)
+	for key, object := range map[string]struct {
+		body        []byte
+		contentType string
+	}{
+		"index.html":  {page.Bytes(), "text/html; charset=utf-8"},
+		"status.json": {status, "application/json"},
+	} {
+		_, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:       aws.String(state.StatusPage.Bucket),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader(object.body),
+			ContentType:  aws.String(object.contentType),
+			CacheControl: aws.String(fmt.Sprintf("max-age=%d", statusPageMaxAge)),
+		})
+		if err != nil {
+			fmt.Println("Got an error uploading the status page:")
+			fmt.Println(err)
+			return false
+		}
+	}
+	return true
+}
+
+// latencyGraph scales the response times of the last day into a 600x120
+// SVG viewBox and returns their average and maximum in milliseconds.
+func latencyGraph(timestamps []time.Time, values []float64, now time.Time) (string, int64, int64) {
+	if len(values) == 0 {
+		return "", 0, 0
+	}
+	peak := maxValue(values)
+	if peak == 0 {
+		peak = 1
+	}
+	start := now.Add(-24 * time.Hour)
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := 600 * timestamps[i].Sub(start).Seconds() / (24 * time.Hour).Seconds()
+		y := 115 - 110*v/peak
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return strings.Join(points, " "), int64(average(values)), int64(peak)
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{"seconds": seconds}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>{{.Title}} status</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:40rem;margin:2rem auto;padding:0 1rem;color:#222}
+.status{padding:1rem;border-radius:.5rem;color:#fff;font-size:1.25rem}
+.up{background:#2e7d32}.down{background:#c62828}.unknown{background:#757575}
+svg{width:100%;height:8rem;background:#f5f5f5}
+td{padding:.25rem 1rem .25rem 0}
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="status {{.Status}}">{{if eq .Status "up"}}Operational{{else if eq .Status "down"}}Down{{else}}Not checked recently{{end}}</p>
+<p>Uptime over the last 30 days: {{printf "%.3f" .Uptime}}%</p>
+<h2>Response time, last 24 hours</h2>
+{{if .Points}}<svg viewBox="0 0 600 120" preserveAspectRatio="none"><polyline fill="none" stroke="#1565c0" stroke-width="2" points="{{.Points}}"/></svg>
+<p>{{.AvgLatency}} ms on average, at most {{.MaxLatency}} ms.</p>
+{{else}}<p>No response times measured.</p>
+{{end}}<h2>Incidents</h2>
+{{if .Incidents}}<table>
+{{range .Incidents}}<tr><td>{{.Start.Format "2006-01-02 15:04 MST"}}</td><td>{{seconds .DowntimeSeconds}} down</td></tr>
+{{end}}</table>
+{{else}}<p>No incidents in the last 30 days.</p>
+{{end}}<p><small>Updated {{.Updated.Format "2006-01-02 15:04 MST"}}{{with .CheckedAt}}, last checked {{.Format "15:04 MST"}}{{end}}</small></p>
+</body>
+</html>
+`))
+
+func disableStatusPage(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("statuspage disable", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "statuspage disable")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	if state.StatusPage == nil {
+		fmt.Printf("Stack %s has no status page\n", state.Name)
+		return
+	}
+	deleteStatusPage(env, state)
+}
+
+// deleteStatusPage removes the distribution, the origin access identity and
+// the bucket. CloudFront only deletes a disabled distribution once the
+// change has spread to its edge locations, which takes several minutes.
+func deleteStatusPage(env *environment, state *stackState) bool {
+	page := state.StatusPage
+	client := cloudfront.NewFromConfig(env.aws)
+
+	if page.DistributionId != "" {
+		log.Printf("Disabling CloudFront distribution %s, this takes a while", page.DistributionId)
+		if !deleteDistribution(client, page.DistributionId) {
+			return false
+		}
+		emit(eventStatusPageDeleted, "distribution_id", page.DistributionId)
+		page.DistributionId = ""
+		saveStackState(state)
+	}
+
+	if page.OriginAccessId != "" {
+		var err error
+		for attempt := 0; attempt < 12; attempt++ {
+			var identity *cloudfront.GetCloudFrontOriginAccessIdentityOutput
+			identity, err = client.GetCloudFrontOriginAccessIdentity(context.TODO(), &cloudfront.GetCloudFrontOriginAccessIdentityInput{
+				Id: aws.String(page.OriginAccessId),
+			})
+			if err == nil {
+				_, err = client.DeleteCloudFrontOriginAccessIdentity(context.TODO(), &cloudfront.DeleteCloudFrontOriginAccessIdentityInput{
+					Id:      aws.String(page.OriginAccessId),
+					IfMatch: identity.ETag,
+				})
+			}
+			if !isErrorCode(err, "CloudFrontOriginAccessIdentityInUse") {
+				break
+			}
+			time.Sleep(10 * time.Second)
+		}
+		if err != nil && !isErrorCode(err, "NoSuchCloudFrontOriginAccessIdentity") {
+			fmt.Println("Got an error deleting the CloudFront origin access identity:")
+			fmt.Println(err)
+			return false
+		}
+		page.OriginAccessId = ""
+		saveStackState(state)
+	}
+
+	if !deleteBucket(s3.NewFromConfig(env.aws), page.Bucket) {
+		return false
+	}
+	state.StatusPage = nil
+	saveStackState(state)
+	return true
+}
+
+func deleteDistribution(client *cloudfront.Client, id string) bool {
+	current, err := client.GetDistributionConfig(context.TODO(), &cloudfront.GetDistributionConfigInput{Id: aws.String(id)})
+	if isErrorCode(err, "NoSuchDistribution") {
+		return true
+	}
+	if err != nil {
+		fmt.Println("Got an error retrieving the CloudFront distribution:")
+		fmt.Println(err)
+		return false
+	}
+
+	if aws.ToBool(current.DistributionConfig.Enabled) {
+		current.DistributionConfig.Enabled = aws.Bool(false)
+		_, err = client.UpdateDistribution(context.TODO(), &cloudfront.UpdateDistributionInput{
+			Id:                 aws.String(id),
+			IfMatch:            current.ETag,
+			DistributionConfig: current.DistributionConfig,
+		})
+		if err != nil {
+			fmt.Println("Got an error disabling the CloudFront distribution:")
+			fmt.Println(err)
+			return false
+		}
+	}
+
+	waiter := cloudfront.NewDistributionDeployedWaiter(client)
+	if err := waiter.Wait(context.TODO(), &cloudfront.GetDistributionInput{Id: aws.String(id)}, 45*time.Minute); err != nil {
+		fmt.Println("Got an error waiting for the CloudFront distribution to be disabled:")
+		fmt.Println(err)
+		return false
+	}
+
+	disabled, err := client.GetDistribution(context.TODO(), &cloudfront.GetDistributionInput{Id: aws.String(id)})
+	if err == nil {
+		_, err = client.DeleteDistribution(context.TODO(), &cloudfront.DeleteDistributionInput{
+			Id:      aws.String(id),
+			IfMatch: disabled.ETag,
+		})
+	}
+	if err != nil && !isErrorCode(err, "NoSuchDistribution") {
+		fmt.Println("Got an error deleting the CloudFront distribution:")
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
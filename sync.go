@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// syncTimeout bounds each command of a sync and how long the presigned URLs
+// it uses work, unless a -bandwidth limit needs longer. The export, which
+// only compresses, gets syncExportTimeout.
+const (
+	syncTimeout       = time.Hour
+	syncExportTimeout = 3 * time.Hour
+)
+
+// syncParams are the values sync-import.sh is rendered with.
+type syncParams struct {
+	Dir            string
+	DatabaseURL    string
+	DatabaseSHA256 string
+	ContentURL     string
+	ContentSHA256  string
+	RateLimit      string
+	Noindex        bool
+}
+
+// syncStacks copies the site of one stack onto another: the source exports
+// its database and wp-content to a temporary bucket, the target imports them
+// and rewrites the source's URLs to its own. Both instances need the SSM
+// agent and an instance profile that allows Systems Manager. The copy is of
+// the content only, so the stacks can run on different images and
+// architectures.
+//
+// The archives are uploaded in parts, -concurrency at a time and sharing
+// -bandwidth, which also limits the download. S3 checks each part against
+// its MD5 and the import checks the archives against the SHA-256 of the
+// export. The export and its uploads are kept in the source's state until
+// the import succeeded: running the same sync again after an interruption
+// uploads only the missing parts, or only imports, for up to
+// syncExportMaxAge.
+func syncStacks(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	from := fs.String("from", "", "Stack to copy the site from")
+	to := fs.String("to", "", "Stack whose site is overwritten")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	concurrency := fs.Int("concurrency", 4, "How many parts to upload at once")
+	bandwidth := fs.String("bandwidth", "", "Bytes per second the transfers may use, like 20M")
+	restart := fs.Bool("restart", false, "Export again rather than resume an interrupted sync")
+	snapshot := addSnapshotFlag(fs, true)
+	fs.Parse(args)
+
+	if *from == "" || *to == "" || *from == *to {
+		fmt.Println("Pass two different stacks with -from and -to")
+		os.Exit(2)
+	}
+
+	rate, err := parseBandwidth(*bandwidth)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		fmt.Println("-concurrency must be at least 1")
+		os.Exit(2)
+	}
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The source is locked too, a replace under the export would lose it.
+	for _, name := range []string{*from, *to} {
+		unlock := lockStack(name, "sync")
+		if unlock == nil {
+			return
+		}
+		defer unlock()
+	}
+
+	source := loadSyncStack(*from)
+	target := loadSyncStack(*to)
+	if source == nil || target == nil {
+		return
+	}
+	sourceConfig := env.aws.Copy()
+	sourceConfig.Region = source.Region
+	targetConfig := env.aws.Copy()
+	targetConfig.Region = target.Region
+
+	environment := target.Environment
+	if environment == "" {
+		environment = environmentProduction
+	}
+	question := fmt.Sprintf("Overwrite the content and database of %s (%s) with those of %s?", target.Name, environment, source.Name)
+	if !*yes && !confirm(question) {
+		return
+	}
+
+	if *snapshot && !snapshotBefore(ec2.NewFromConfig(targetConfig), target, newOperationId(), "sync") {
+		return
+	}
+
+	transfer := &syncTransfer{client: s3.NewFromConfig(sourceConfig), concurrency: *concurrency, bandwidth: rate}
+	if export := source.Export; export != nil {
+		if *restart || export.Target != target.Name || time.Since(export.CreatedAt) > syncExportMaxAge {
+			fmt.Printf("Discarding the export of %s from %s\n", source.Name, export.CreatedAt.Local().Format(time.RFC1123))
+			if !dropExport(sourceConfig, source) {
+				return
+			}
+		} else {
+			fmt.Printf("Resuming the export of %s from %s\n", source.Name, export.CreatedAt.Local().Format(time.RFC1123))
+		}
+	}
+	if source.Export == nil && !exportSite(sourceConfig, transfer, source, target.Name) {
+		return
+	}
+	if !transfer.upload(sourceConfig, source) {
+		return
+	}
+
+	export := source.Export
+	timeout := transfer.timeout(export.Files[0].Size + export.Files[1].Size)
+	presign := s3.NewPresignClient(transfer.client, s3.WithPresignExpires(timeout))
+	restore := syncParams{Dir: syncImportDir, RateLimit: transfer.rateLimit(1), Noindex: target.noindex()}
+	for _, f := range export.Files {
+		get, err := presign.PresignGetObject(context.TODO(), &s3.GetObjectInput{Bucket: aws.String(export.Bucket), Key: aws.String(f.Key)})
+		if err != nil {
+			fmt.Println("Got an error presigning the download:")
+			fmt.Println(err)
+			return
+		}
+		switch f.Key {
+		case "database.sql.gz":
+			restore.DatabaseURL, restore.DatabaseSHA256 = get.URL, f.SHA256
+		case "wp-content.tar.gz":
+			restore.ContentURL, restore.ContentSHA256 = get.URL, f.SHA256
+		}
+	}
+
+	fmt.Printf("Importing it into %s\n", target.Name)
+	_, err = runSyncScript(targetConfig, target.InstanceId, "sync-import.sh", restore, timeout)
+	if err != nil {
+		fmt.Println("Got an error importing the site, run sync again to resume:")
+		fmt.Println(err)
+		return
+	}
+
+	dropExport(sourceConfig, source)
+	emit(eventStackSynced, "from", source.Name, "to", target.Name)
+}
+
+func loadSyncStack(name string) *stackState {
+	state, err := loadState(name)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No stack named %s\n", name)
+		return nil
+	}
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return state
+}
+
+func syncBucketName(stack string) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "aws-wp-" + stack + "-sync-" + hex.EncodeToString(suffix)
+}
+
+// exportSite has the source export its site into syncExportDir, then
+// creates the bucket the archives are uploaded to and starts the uploads,
+// which it records in the source's state.
+func exportSite(cfg aws.Config, transfer *syncTransfer, source *stackState, target string) bool {
+	fmt.Printf("Exporting the site of %s\n", source.Name)
+	output, err := runSyncScript(cfg, source.InstanceId, "sync-export.sh", syncParams{Dir: syncExportDir}, syncExportTimeout)
+	if err != nil {
+		fmt.Println("Got an error exporting the site:")
+		fmt.Println(err)
+		return false
+	}
+
+	export := &siteExport{Target: target, Bucket: syncBucketName(source.Name), CreatedAt: time.Now()}
+	if !createStackBucket(transfer.client, export.Bucket, source.Region, source.Name, "expire-sync", 1) {
+		return false
+	}
+	if !transfer.startUploads(export, output) {
+		deleteBucket(transfer.client, export.Bucket)
+		return false
+	}
+	source.Export = export
+	saveStackState(source)
+	return true
+}
+
+// dropExport deletes the export's bucket, with its unfinished uploads, and
+// the archives on the source, and forgets it.
+func dropExport(cfg aws.Config, source *stackState) bool {
+	if !deleteBucket(s3.NewFromConfig(cfg), source.Export.Bucket) {
+		return false
+	}
+	if _, err := runShellScript(ssm.NewFromConfig(cfg), source.InstanceId, "rm -rf "+syncExportDir); err != nil {
+		fmt.Println("Got an error removing the export from the instance:")
+		fmt.Println(err)
+	}
+	source.Export = nil
+	saveStackState(source)
+	return true
+}
+
+// runSyncScript renders the script and runs it on the instance, giving up
+// after timeout. It prints the script's output and returns it.
+func runSyncScript(cfg aws.Config, instanceId string, name string, params interface{}, timeout time.Duration) (string, error) {
+	var script strings.Builder
+	if err := bootstrapTemplates.ExecuteTemplate(&script, name, params); err != nil {
+		return "", err
+	}
+	output, err := runCommand(ssm.NewFromConfig(cfg), instanceId, &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		Parameters: map[string][]string{
+			"commands":         {script.String()},
+			"executionTimeout": {strconv.Itoa(int(timeout.Seconds()))},
+		},
+	})
+	fmt.Print(output)
+	return output, err
+}
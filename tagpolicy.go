@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	tagging "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	taggingtypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+)
+
+// tagsFlag collects repeated -tag key=value values.
+type tagsFlag map[string]string
+
+func (f tagsFlag) String() string {
+	items := make([]string, 0, len(f))
+	for _, key := range sortedKeys(f) {
+		items = append(items, key+"="+f[key])
+	}
+	return strings.Join(items, ",")
+}
+
+func (f tagsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid tag %q, expected key=value", value)
+	}
+	if strings.HasPrefix(parts[0], "aws:") || strings.HasPrefix(parts[0], "aws-wp:") {
+		return fmt.Errorf("tag %s is reserved", parts[0])
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// missingTags returns the required tags that have no value in tags.
+func missingTags(required []string, tags map[string]string) []string {
+	var missing []string
+	for _, key := range required {
+		if tags[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// checkRequiredTags refuses a stack without the tags the config requires.
+func checkRequiredTags(config *fileConfig, tags map[string]string) error {
+	if missing := missingTags(config.RequiredTags, tags); len(missing) > 0 {
+		return fmt.Errorf("the config requires tags %s, pass them with -tag key=value", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// userTags are the -tag tags as EC2 tags.
+func (spec launchSpec) userTags() []types.Tag {
+	var tags []types.Tag
+	for _, key := range sortedKeys(spec.Tags) {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(spec.Tags[key])})
+	}
+	return tags
+}
+
+// tagStackResources puts the stack's -tag tags on everything tagged with
+// the stack in its region, so resources created along the way, such as
+// the load balancer, buckets and images, carry them like the instance. The
+// Resource Groups Tagging API does not reach global resources like health
+// checks and CloudFront distributions from other regions.
+func tagStackResources(env *environment, state *stackState) bool {
+	if len(state.Tags) == 0 {
+		return true
+	}
+	client := tagging.NewFromConfig(env.aws)
+
+	var untagged []string
+	paginator := tagging.NewGetResourcesPaginator(client, &tagging.GetResourcesInput{
+		TagFilters: []taggingtypes.TagFilter{{Key: aws.String(stackTag), Values: []string{state.Name}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			fmt.Println("Got an error listing the stack's resources:")
+			fmt.Println(err)
+			return false
+		}
+		for _, resource := range page.ResourceTagMappingList {
+			tags := resourceTags(resource)
+			for key, value := range state.Tags {
+				if tags[key] != value {
+					untagged = append(untagged, aws.ToString(resource.ResourceARN))
+					break
+				}
+			}
+		}
+	}
+	return tagResources(client, untagged, state.Tags)
+}
+
+// tagResources tags the resources in batches of the 20 the API takes.
+func tagResources(client *tagging.Client, arns []string, tags map[string]string) bool {
+	for len(arns) > 0 {
+		batch := arns
+		if len(batch) > 20 {
+			batch = batch[:20]
+		}
+		arns = arns[len(batch):]
+
+		result, err := client.TagResources(context.TODO(), &tagging.TagResourcesInput{
+			ResourceARNList: batch,
+			Tags:            tags,
+		})
+		if err != nil {
+			fmt.Println("Got an error tagging the stack's resources:")
+			fmt.Println(err)
+			return false
+		}
+		for arn, failure := range result.FailedResourcesMap {
+			fmt.Printf("Could not tag %s: %s\n", arn, aws.ToString(failure.ErrorMessage))
+		}
+		if len(result.FailedResourcesMap) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func resourceTags(resource taggingtypes.ResourceTagMapping) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range resource.Tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags
+}
+
+// audit lists the resources the tool created in the region, of every
+// stack, that lack a tag the config requires, and exits with status 1 when
+// there are any, for CI. -fix tags them with the values recorded for their
+// stack, or given with -tag, and records those for the stack.
+func audit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	fix := fs.Bool("fix", false, "Tag the non-compliant resources")
+	fixTags := tagsFlag{}
+	fs.Var(fixTags, "tag", "With -fix, the value for a required tag a stack has none for, as key=value (repeatable)")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	required := env.config.RequiredTags
+	if len(required) == 0 {
+		fmt.Println("The config requires no tags, list them under required_tags")
+		return
+	}
+
+	client := tagging.NewFromConfig(env.aws)
+	byStack := map[string][]string{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tRESOURCE\tMISSING")
+	total, failing := 0, 0
+	paginator := tagging.NewGetResourcesPaginator(client, &tagging.GetResourcesInput{
+		TagFilters: []taggingtypes.TagFilter{{Key: aws.String(stackTag)}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			fmt.Println("Got an error listing the tool's resources:")
+			fmt.Println(err)
+			return
+		}
+		for _, resource := range page.ResourceTagMappingList {
+			total++
+			tags := resourceTags(resource)
+			missing := missingTags(required, tags)
+			if len(missing) == 0 {
+				continue
+			}
+			failing++
+			arn := aws.ToString(resource.ResourceARN)
+			byStack[tags[stackTag]] = append(byStack[tags[stackTag]], arn)
+			fmt.Fprintf(w, "%s\t%s\t%s\n", tags[stackTag], arn, strings.Join(missing, ", "))
+		}
+	}
+	if failing == 0 {
+		fmt.Printf("All %d resources have the required tags\n", total)
+		return
+	}
+	w.Flush()
+	fmt.Printf("%d of %d resources lack required tags\n", failing, total)
+
+	if *fix {
+		for _, stack := range sortedStacks(byStack) {
+			state, err := loadState(stack)
+			if err != nil {
+				fmt.Printf("Skipping stack %s, which has no state here\n", stack)
+				continue
+			}
+			if state.Tags == nil {
+				state.Tags = map[string]string{}
+			}
+			for key, value := range fixTags {
+				if state.Tags[key] == "" {
+					state.Tags[key] = value
+				}
+			}
+			if missing := missingTags(required, state.Tags); len(missing) > 0 {
+				fmt.Printf("Skipping stack %s, pass %s with -tag\n", stack, strings.Join(missing, ", "))
+				continue
+			}
+			saveStackState(state)
+			if tagResources(client, byStack[stack], state.Tags) {
+				failing -= len(byStack[stack])
+				fmt.Printf("Tagged the %d resources of stack %s\n", len(byStack[stack]), stack)
+			}
+		}
+	}
+	if failing > 0 {
+		os.Exit(1)
+	}
+}
+
+func sortedStacks(byStack map[string][]string) []string {
+	stacks := make([]string, 0, len(byStack))
+	for stack := range byStack {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	return stacks
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// expiresTag holds when a stack created with -ttl may be destroyed, as an
+// RFC 3339 time.
+const expiresTag = "aws-wp:expires-at"
+
+// expired reports whether the stack has an expiry that has passed.
+func (spec launchSpec) expired(now time.Time) bool {
+	return spec.ExpiresAt != nil && !now.Before(*spec.ExpiresAt)
+}
+
+func (spec launchSpec) expiryTags() []types.Tag {
+	if spec.ExpiresAt == nil {
+		return nil
+	}
+	return []types.Tag{{Key: aws.String(expiresTag), Value: aws.String(spec.ExpiresAt.Format(time.RFC3339))}}
+}
+
+// gc destroys the stacks whose -ttl has run out. Nothing runs it on its own;
+// schedule it with cron or a CI job to enforce the expiry.
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Only list the expired stacks")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	states, err := listStates()
+	if err != nil {
+		fmt.Println("Got an error reading the stacks:")
+		fmt.Println(err)
+		return
+	}
+
+	// Stacks that predate a tag requirement are only pointed out, audit
+	// finds their resources and tags them.
+	if config, err := loadFileConfig(options.configPath); err == nil {
+		for _, s := range states {
+			if missing := missingTags(config.RequiredTags, s.Tags); len(missing) > 0 {
+				fmt.Printf("Stack %s lacks required tags %s, see aws-wp audit\n", s.Name, strings.Join(missing, ", "))
+			}
+		}
+	}
+
+	now := time.Now()
+	var expired []*stackState
+	for _, s := range states {
+		if s.expired(now) {
+			expired = append(expired, s)
+		}
+	}
+	if len(expired) == 0 {
+		fmt.Println("No expired stacks")
+		return
+	}
+
+	for _, s := range expired {
+		fmt.Printf("%s expired %s ago\n", s.Name, now.Sub(*s.ExpiresAt).Round(time.Minute))
+	}
+	if *dryRun {
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Destroy %d expired stacks?", len(expired))) {
+		return
+	}
+
+	// Each stack is destroyed as by "destroy -name", from a copy of the
+	// environment: loading the options again per stack would set up the
+	// output again.
+	for _, s := range expired {
+		stackEnv := *env
+		stackEnv.name = s.Name
+		destroyStack(&stackEnv, false)
+		if _, err := os.Stat(statePath(s.Name)); err == nil {
+			fmt.Printf("Stack %s was not fully destroyed, see above\n", s.Name)
+		}
+	}
+}
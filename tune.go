@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// tuneDocumentName is the SSM document tune runs, shared by the stacks of
+// an account and region. Names starting with aws or amazon are reserved.
+const tuneDocumentName = "WordPress-TunePHP"
+
+// phpSizePattern is a PHP size like 256M, also what the document allows.
+const phpSizePattern = `^[0-9]+[KMG]?$`
+
+var phpSize = regexp.MustCompile(phpSizePattern)
+
+// phpSettings are the PHP settings tune changed, empty where PHP's default
+// applies. Instances get them at boot too, so replace keeps them.
+type phpSettings struct {
+	MemoryLimit       string `json:"memory_limit,omitempty"`
+	UploadMaxFilesize string `json:"upload_max_filesize,omitempty"`
+	OPcache           string `json:"opcache,omitempty"`
+}
+
+func (p phpSettings) validate() error {
+	for flag, value := range map[string]string{"-memory-limit": p.MemoryLimit, "-upload-max-filesize": p.UploadMaxFilesize} {
+		if value != "" && !phpSize.MatchString(value) {
+			return fmt.Errorf("invalid %s %q, expected a size like 256M", flag, value)
+		}
+	}
+	if p.OPcache != "" && p.OPcache != "On" && p.OPcache != "Off" {
+		return fmt.Errorf("invalid -opcache %q, expected on or off", p.OPcache)
+	}
+	return nil
+}
+
+func (p phpSettings) String() string {
+	var items []string
+	if p.MemoryLimit != "" {
+		items = append(items, "memory_limit "+p.MemoryLimit)
+	}
+	if p.UploadMaxFilesize != "" {
+		items = append(items, "upload_max_filesize "+p.UploadMaxFilesize)
+	}
+	if p.OPcache != "" {
+		items = append(items, "opcache "+p.OPcache)
+	}
+	if len(items) == 0 {
+		return "PHP defaults"
+	}
+	return strings.Join(items, ", ")
+}
+
+type documentParameter struct {
+	Type           string `json:"type"`
+	Description    string `json:"description"`
+	Default        string `json:"default"`
+	AllowedPattern string `json:"allowedPattern"`
+}
+
+type documentStep struct {
+	Action string              `json:"action"`
+	Name   string              `json:"name"`
+	Inputs map[string][]string `json:"inputs"`
+}
+
+type commandDocument struct {
+	SchemaVersion string                       `json:"schemaVersion"`
+	Description   string                       `json:"description"`
+	Parameters    map[string]documentParameter `json:"parameters"`
+	MainSteps     []documentStep               `json:"mainSteps"`
+}
+
+// tuneDocument is the SSM document: tune-php.sh, with the settings as
+// parameters that SSM validates before running it.
+func tuneDocument() (string, error) {
+	var script strings.Builder
+	placeholders := phpSettings{MemoryLimit: "{{ memoryLimit }}", UploadMaxFilesize: "{{ uploadMaxFilesize }}", OPcache: "{{ opcache }}"}
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "tune-php.sh", placeholders); err != nil {
+		return "", err
+	}
+
+	size := strings.TrimSuffix(strings.TrimPrefix(phpSizePattern, "^"), "$")
+	data, err := json.Marshal(commandDocument{
+		SchemaVersion: "2.2",
+		Description:   "Change the PHP settings of an aws-wp WordPress instance and reload PHP and Apache gracefully",
+		Parameters: map[string]documentParameter{
+			"memoryLimit":       {Type: "String", Description: "memory_limit, like 256M, empty for PHP's default", AllowedPattern: "^(" + size + ")?$"},
+			"uploadMaxFilesize": {Type: "String", Description: "upload_max_filesize and post_max_size, like 64M, empty for PHP's default", AllowedPattern: "^(" + size + ")?$"},
+			"opcache":           {Type: "String", Description: "opcache.enable, On or Off, empty for PHP's default", AllowedPattern: "^(On|Off)?$"},
+		},
+		MainSteps: []documentStep{{
+			Action: "aws:runShellScript",
+			Name:   "tunePHP",
+			Inputs: map[string][]string{"runCommand": {script.String()}},
+		}},
+	})
+	return string(data), err
+}
+
+// ensureTuneDocument creates the document, or updates it to this version of
+// the tool's, and waits until it can run.
+func ensureTuneDocument(client *ssm.Client) bool {
+	content, err := tuneDocument()
+	if err != nil {
+		fmt.Println("Got an error rendering the SSM document:")
+		fmt.Println(err)
+		return false
+	}
+
+	_, err = client.CreateDocument(context.TODO(), &ssm.CreateDocumentInput{
+		Name:           aws.String(tuneDocumentName),
+		Content:        aws.String(content),
+		DocumentType:   types.DocumentTypeCommand,
+		DocumentFormat: types.DocumentFormatJson,
+	})
+	if isErrorCode(err, "DocumentAlreadyExists") {
+		_, err = client.UpdateDocument(context.TODO(), &ssm.UpdateDocumentInput{
+			Name:            aws.String(tuneDocumentName),
+			Content:         aws.String(content),
+			DocumentFormat:  types.DocumentFormatJson,
+			DocumentVersion: aws.String("$LATEST"),
+		})
+		if isErrorCode(err, "DuplicateDocumentContent") {
+			err = nil
+		}
+	}
+	if err != nil {
+		fmt.Println("Got an error creating the SSM document:")
+		fmt.Println(err)
+		return false
+	}
+
+	for {
+		result, err := client.DescribeDocument(context.TODO(), &ssm.DescribeDocumentInput{
+			Name: aws.String(tuneDocumentName),
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving information about the SSM document:")
+			fmt.Println(err)
+			return false
+		}
+		switch result.Document.Status {
+		case types.DocumentStatusActive:
+			return true
+		case types.DocumentStatusFailed:
+			fmt.Printf("Got an error: SSM document %s failed: %s\n", tuneDocumentName, aws.ToString(result.Document.StatusInformation))
+			return false
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// tune changes PHP settings on the running instance through the
+// WordPress-TunePHP SSM document, without restarting anything: PHP and
+// Apache reload gracefully. Settings not given stay as they are; without
+// any it shows the current ones.
+func tune(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	memoryLimit := fs.String("memory-limit", "", "PHP memory_limit, like 256M")
+	uploadMax := fs.String("upload-max-filesize", "", "PHP upload_max_filesize and post_max_size, like 64M")
+	opcache := fs.String("opcache", "", "Turn OPcache on or off")
+	reset := fs.Bool("reset", false, "Drop the settings tune made, back to PHP's defaults")
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unlock := lockStack(env.name, "tune")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+
+	settings := phpSettings{}
+	if state.PHP != nil && !*reset {
+		settings = *state.PHP
+	}
+	flagsSet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+	if flagsSet["memory-limit"] {
+		settings.MemoryLimit = *memoryLimit
+	}
+	if flagsSet["upload-max-filesize"] {
+		settings.UploadMaxFilesize = *uploadMax
+	}
+	if flagsSet["opcache"] {
+		switch strings.ToLower(*opcache) {
+		case "on":
+			settings.OPcache = "On"
+		case "off":
+			settings.OPcache = "Off"
+		default:
+			settings.OPcache = *opcache
+		}
+	}
+	if !*reset && !flagsSet["memory-limit"] && !flagsSet["upload-max-filesize"] && !flagsSet["opcache"] {
+		fmt.Printf("Stack %s runs with %s\n", state.Name, settings)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if state.InstanceProfile == "" {
+		fmt.Println("tune runs over SSM, which needs a stack created with -instance-profile")
+		return
+	}
+
+	client := ssm.NewFromConfig(env.aws)
+	if !ensureTuneDocument(client) {
+		return
+	}
+	output, err := runCommand(client, state.InstanceId, &ssm.SendCommandInput{
+		DocumentName:    aws.String(tuneDocumentName),
+		DocumentVersion: aws.String("$LATEST"),
+		Parameters: map[string][]string{
+			"memoryLimit":       {settings.MemoryLimit},
+			"uploadMaxFilesize": {settings.UploadMaxFilesize},
+			"opcache":           {settings.OPcache},
+		},
+	})
+	fmt.Print(output)
+	if err != nil {
+		fmt.Println("Got an error applying the PHP settings:")
+		fmt.Println(err)
+		return
+	}
+
+	state.PHP = &settings
+	if settings == (phpSettings{}) {
+		state.PHP = nil
+	}
+	saveStackState(state)
+	emit(eventPHPTuned, "settings", settings.String())
+
+	if waitHealthy(env.http, state.URL, healthCheckAuth(env, state.HealthCheck)) {
+		emit(eventHealthOK, "url", state.URL)
+		fmt.Printf("Stack %s runs with %s\n", state.Name, settings)
+	} else {
+		emit(eventHealthFailed, "url", state.URL)
+	}
+}
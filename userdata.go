@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+//go:embed bootstrap/*.sh
+var bootstrapScripts embed.FS
+
+var builtinBootstrapTemplates = template.Must(template.ParseFS(bootstrapScripts, "bootstrap/*.sh"))
+
+// bootstrapTemplates are the scripts instances are bootstrapped with, those
+// of the release the stack is pinned to once useBootstrap selected them.
+var bootstrapTemplates = builtinBootstrapTemplates
+
+var pluginSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// userDataParams are the values bootstrap scripts are rendered with.
+type userDataParams struct {
+	Stack       string
+	Plugins     []string
+	BehindProxy bool
+	SiteURL     string
+
+	// ProgressParameter is the SSM parameter the instance reports its
+	// bootstrap progress to, if any.
+	ProgressParameter string
+
+	// OS is set when the image is a stock one of that distro, which
+	// WordPress gets installed on first. Install holds those steps. Baked
+	// images of the distro already have the packages and files.
+	OS      string
+	Install string
+	Baked   bool
+
+	// Htpasswd puts the site behind basic authentication when set.
+	Htpasswd string
+
+	// Noindex keeps search engines away from non-production stacks.
+	Noindex bool
+
+	// ReadOnlyCode mounts everything but the uploads read-only.
+	ReadOnlyCode bool
+
+	// Port is where Apache listens instead of 80, when set. SitePath
+	// serves WordPress under a path instead of at the root.
+	Port     int32
+	SitePath string
+
+	// PHP are the settings of aws-wp tune, if any.
+	PHP *phpSettings
+
+	// WPConfig are the wp_config constants to set in wp-config.php.
+	WPConfig []wpConfigLine
+
+	// secrets are values the user data must never contain. Instances get
+	// hashes or fetch secrets themselves instead.
+	secrets []string
+}
+
+// maxUserDataSize is the EC2 limit on user data before base64 encoding.
+const maxUserDataSize = 16 * 1024
+
+// userDataParams are the bootstrap settings for an instance of the spec.
+func (spec launchSpec) userDataParams(stack string) userDataParams {
+	params := userDataParams{
+		Stack:       stack,
+		Plugins:     spec.Plugins,
+		BehindProxy: spec.BehindProxy,
+		SiteURL:     spec.SiteURL,
+		OS:          spec.OS,
+		Baked:       spec.Baked,
+		Htpasswd:    spec.Htpasswd,
+		Noindex:     spec.noindex(),
+
+		ReadOnlyCode: spec.ReadOnlyCode,
+		SitePath:     spec.SitePath,
+		PHP:          spec.PHP,
+		WPConfig:     wpConfigLines(spec.WPConfig),
+	}
+	if spec.port() != defaultPort {
+		params.Port = spec.port()
+	}
+	if spec.ReportProgress {
+		params.ProgressParameter = progressParameterName(stack)
+	}
+	if parts := strings.SplitN(spec.HealthCheck.Auth, ":", 2); len(parts) == 2 && parts[1] != "" {
+		params.secrets = append(params.secrets, parts[1])
+	}
+	return params
+}
+
+// renderUserData returns the bootstrap script for the instance, or an empty
+// string when there is nothing to do on boot.
+func renderUserData(params userDataParams) (string, error) {
+	if len(params.Plugins) == 0 && !params.BehindProxy && params.SiteURL == "" && params.ProgressParameter == "" && params.OS == "" && params.Htpasswd == "" && !params.Noindex && !params.ReadOnlyCode && params.Port == 0 && params.SitePath == "" && params.PHP == nil && len(params.WPConfig) == 0 {
+		return "", nil
+	}
+
+	if err := validatePlugins(params.Plugins); err != nil {
+		return "", err
+	}
+
+	if params.OS != "" {
+		steps := []string{"install-wordpress.sh"}
+		if !params.Baked {
+			steps = append(installSteps(params.OS), steps...)
+		}
+		install, err := renderSteps(steps, params)
+		if err != nil {
+			return "", err
+		}
+		params.Install = install
+	}
+
+	var script bytes.Buffer
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "customize.sh", params); err != nil {
+		return "", err
+	}
+	for _, secret := range params.secrets {
+		if strings.Contains(script.String(), secret) {
+			return "", fmt.Errorf("the user data would contain a secret in plain text")
+		}
+	}
+	return script.String(), nil
+}
+
+// installSteps are the scripts putting the distro's packages and the
+// WordPress files on a stock image. Releases before download-wordpress.sh
+// download the files in install-wordpress.sh.
+func installSteps(osName string) []string {
+	steps := []string{"install-" + distros[osName].installer + ".sh"}
+	if bootstrapTemplates.Lookup("download-wordpress.sh") != nil {
+		steps = append(steps, "download-wordpress.sh")
+	}
+	return steps
+}
+
+func renderSteps(names []string, data interface{}) (string, error) {
+	var out bytes.Buffer
+	for _, name := range names {
+		if err := bootstrapTemplates.ExecuteTemplate(&out, name, data); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(out.String(), "\n"), nil
+}
+
+// encodeUserData base64-encodes the script for RunInstances. Scripts over
+// the size limit are gzipped first, which cloud-init unpacks on its own.
+func encodeUserData(script string) (string, error) {
+	if script == "" {
+		return "", nil
+	}
+	data := []byte(script)
+	if len(data) > maxUserDataSize {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		if compressed.Len() > maxUserDataSize {
+			return "", fmt.Errorf("the user data is %d bytes, %d gzipped, over the %d byte limit", len(data), compressed.Len(), maxUserDataSize)
+		}
+		data = compressed.Bytes()
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// redactUserData replaces the sensitive values in the script for display.
+// The htpasswd hash is not a secret in itself but can be attacked offline.
+func redactUserData(script string, params userDataParams) string {
+	sensitive := params.secrets
+	if params.Htpasswd != "" {
+		if i := strings.Index(params.Htpasswd, ":"); i >= 0 {
+			sensitive = append(sensitive, params.Htpasswd[i+1:])
+		}
+	}
+	for _, value := range sensitive {
+		script = strings.ReplaceAll(script, value, "<redacted>")
+	}
+	return script
+}
+
+func validatePlugins(plugins []string) error {
+	for _, plugin := range plugins {
+		if !pluginSlugPattern.MatchString(plugin) {
+			return fmt.Errorf("invalid plugin slug %q", plugin)
+		}
+	}
+	return nil
+}
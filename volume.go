@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// volume manages the instance's volumes in place: "volume grow" enlarges
+// the root volume without replacing the instance.
+func volume(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: aws-wp volume grow [flags]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "grow":
+		growVolume(args[1:])
+	default:
+		fmt.Printf("Unknown volume command %q, expected grow\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// growVolume resizes the root volume with ModifyVolume and, once the new
+// size is usable, grows the partition and filesystem over SSM. EBS volumes
+// cannot shrink, and a volume can only be modified once every six hours.
+func growVolume(args []string) {
+	defer duration(time.Now())
+	fs := flag.NewFlagSet("volume grow", flag.ExitOnError)
+	options := addGlobalFlags(fs)
+	size := fs.Int("size", 0, "New size of the root volume in GiB")
+	snapshot := addSnapshotFlag(fs, true)
+	fs.Parse(args)
+
+	env, err := options.load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *size <= 0 {
+		fmt.Println("Pass the new size with -size")
+		return
+	}
+
+	unlock := lockStack(env.name, "volume grow")
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	state := loadStack(env)
+	if state == nil {
+		return
+	}
+	client := ec2.NewFromConfig(env.aws)
+
+	instance := describeInstance(client, state.InstanceId)
+	if instance == nil {
+		return
+	}
+	volumeId := ""
+	for _, mapping := range instance.BlockDeviceMappings {
+		if aws.ToString(mapping.DeviceName) == aws.ToString(instance.RootDeviceName) && mapping.Ebs != nil {
+			volumeId = aws.ToString(mapping.Ebs.VolumeId)
+		}
+	}
+	if volumeId == "" {
+		fmt.Printf("Instance %s has no EBS root volume\n", state.InstanceId)
+		return
+	}
+
+	volumes, err := client.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{
+		VolumeIds: []string{volumeId},
+	})
+	if err != nil || len(volumes.Volumes) == 0 {
+		fmt.Println("Got an error retrieving information about the volume:")
+		fmt.Println(volumeId, err)
+		return
+	}
+	current := aws.ToInt32(volumes.Volumes[0].Size)
+	if int32(*size) <= current {
+		fmt.Printf("Volume %s is already %d GiB; EBS volumes can only grow\n", volumeId, current)
+		return
+	}
+
+	// The grown volume cannot shrink again, the snapshot is the way back.
+	if *snapshot && !snapshotBefore(client, state, newOperationId(), "volume grow") {
+		return
+	}
+
+	_, err = client.ModifyVolume(context.TODO(), &ec2.ModifyVolumeInput{
+		VolumeId: aws.String(volumeId),
+		Size:     aws.Int32(int32(*size)),
+	})
+	if err != nil {
+		fmt.Println("Got an error modifying the volume:")
+		fmt.Println(err)
+		return
+	}
+	if !waitVolumeModified(client, volumeId) {
+		return
+	}
+	emit(eventVolumeModified, "volume_id", volumeId, "size", fmt.Sprint(*size))
+
+	// Launches from this state, like replace, get the new size too.
+	state.VolumeSize = int32(*size)
+	saveStackState(state)
+
+	var script strings.Builder
+	if err := bootstrapTemplates.ExecuteTemplate(&script, "grow-root.sh", nil); err != nil {
+		fmt.Println("Got an error rendering the resize script:")
+		fmt.Println(err)
+		return
+	}
+	output, err := runShellScript(ssm.NewFromConfig(env.aws), state.InstanceId, script.String())
+	fmt.Print(output)
+	if err != nil {
+		fmt.Println("Got an error growing the filesystem:")
+		fmt.Println(err)
+		fmt.Printf("The volume is %d GiB; grow the partition and filesystem on the instance to use the space\n", *size)
+		return
+	}
+
+	fmt.Printf("Root volume %s grown from %d to %d GiB\n", volumeId, current, *size)
+}
+
+// waitVolumeModified waits until the new size can be used. That is the case
+// from the optimizing state on; optimizing itself can take hours and needs
+// no waiting.
+func waitVolumeModified(client *ec2.Client, volumeId string) bool {
+	for {
+		result, err := client.DescribeVolumesModifications(context.TODO(), &ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []string{volumeId},
+		})
+		if err != nil {
+			fmt.Println("Got an error retrieving the volume modification:")
+			fmt.Println(err)
+			return false
+		}
+		if len(result.VolumesModifications) > 0 {
+			modification := result.VolumesModifications[0]
+			switch modification.ModificationState {
+			case types.VolumeModificationStateOptimizing, types.VolumeModificationStateCompleted:
+				return true
+			case types.VolumeModificationStateFailed:
+				fmt.Printf("Got an error: modifying volume %s failed: %s\n", volumeId, aws.ToString(modification.StatusMessage))
+				return false
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
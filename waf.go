@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+)
+
+// minLoginRateLimit is the lowest limit AWS WAF accepts, in requests per
+// client IP and five minutes.
+const minLoginRateLimit = 100
+
+// loginPaths are the endpoints password guessing goes for. xmlrpc.php takes
+// many guesses per request with system.multicall.
+var loginPaths = []string{"/wp-login.php", "/xmlrpc.php"}
+
+func webACLName(stack string) string {
+	return "aws-wp-" + stack
+}
+
+// enableLoginRateLimit puts a web ACL on the load balancer that blocks
+// client IPs sending more than limit requests in five minutes to one of
+// the login paths. The rest of the site is not limited, and the blocked
+// requests never reach the instance, which on the smallest types struggles
+// with the PHP behind every attempt. The ACL is recorded on the load
+// balancer as soon as it exists so destroy can remove it.
+func enableLoginRateLimit(client *wafv2.Client, state *stackState, limit int64) bool {
+	lb := state.LoadBalancer
+	name := webACLName(state.Name)
+
+	var rules []types.Rule
+	for _, path := range loginPaths {
+		rule := strings.TrimSuffix(strings.TrimPrefix(path, "/"), ".php")
+		rules = append(rules, types.Rule{
+			Name:     aws.String(rule + "-rate-limit"),
+			Priority: int32(len(rules)),
+			Action:   &types.RuleAction{Block: &types.BlockAction{}},
+			Statement: &types.Statement{
+				RateBasedStatement: &types.RateBasedStatement{
+					Limit:            limit,
+					AggregateKeyType: types.RateBasedStatementAggregateKeyTypeIp,
+					ScopeDownStatement: &types.Statement{
+						ByteMatchStatement: &types.ByteMatchStatement{
+							FieldToMatch:         &types.FieldToMatch{UriPath: &types.UriPath{}},
+							PositionalConstraint: types.PositionalConstraintExactly,
+							SearchString:         []byte(path),
+							// Encoded paths reach the same script.
+							TextTransformations: []types.TextTransformation{{Priority: 0, Type: types.TextTransformationTypeUrlDecode}},
+						},
+					},
+				},
+			},
+			VisibilityConfig: webACLVisibility(name + "-" + rule),
+		})
+	}
+
+	acl, err := client.CreateWebACL(context.TODO(), &wafv2.CreateWebACLInput{
+		Name:             aws.String(name),
+		Scope:            types.ScopeRegional,
+		Description:      aws.String("Login rate limits of aws-wp stack " + state.Name),
+		DefaultAction:    &types.DefaultAction{Allow: &types.AllowAction{}},
+		Rules:            rules,
+		VisibilityConfig: webACLVisibility(name),
+		Tags:             []types.Tag{{Key: aws.String(stackTag), Value: aws.String(state.Name)}},
+	})
+	if err != nil {
+		fmt.Println("Got an error creating the web ACL:")
+		fmt.Println(err)
+		return false
+	}
+	lb.WebACLArn = aws.ToString(acl.Summary.ARN)
+	lb.WebACLId = aws.ToString(acl.Summary.Id)
+	lb.LoginRateLimit = limit
+	saveStackState(state)
+
+	// A new web ACL cannot be associated for a moment.
+	for attempt := 0; ; attempt++ {
+		_, err = client.AssociateWebACL(context.TODO(), &wafv2.AssociateWebACLInput{
+			WebACLArn:   aws.String(lb.WebACLArn),
+			ResourceArn: aws.String(lb.Arn),
+		})
+		if err == nil {
+			break
+		}
+		if !isErrorCode(err, "WAFUnavailableEntityException") || attempt == 10 {
+			fmt.Println("Got an error attaching the web ACL to the load balancer:")
+			fmt.Println(err)
+			return false
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	emit(eventLoginRateLimitEnabled, "web_acl_arn", lb.WebACLArn, "limit", strconv.FormatInt(limit, 10))
+	return true
+}
+
+// webACLVisibility publishes the blocked and allowed counts to CloudWatch
+// under AWS/WAFV2, which WAF requires a name for either way.
+func webACLVisibility(metric string) *types.VisibilityConfig {
+	return &types.VisibilityConfig{
+		MetricName:               aws.String(strings.ReplaceAll(metric, "-", "")),
+		CloudWatchMetricsEnabled: true,
+		SampledRequestsEnabled:   true,
+	}
+}
+
+// deleteWebACL detaches the web ACL from the load balancer and deletes it,
+// which WAF refuses for a little while after the detach.
+func deleteWebACL(client *wafv2.Client, stack string, lb *loadBalancer) bool {
+	_, err := client.DisassociateWebACL(context.TODO(), &wafv2.DisassociateWebACLInput{
+		ResourceArn: aws.String(lb.Arn),
+	})
+	if err != nil && !isErrorCode(err, "WAFNonexistentItemException") {
+		fmt.Println("Got an error detaching the web ACL from the load balancer:")
+		fmt.Println(err)
+		return false
+	}
+
+	for attempt := 0; ; attempt++ {
+		acl, err := client.GetWebACL(context.TODO(), &wafv2.GetWebACLInput{
+			Id:    aws.String(lb.WebACLId),
+			Name:  aws.String(webACLName(stack)),
+			Scope: types.ScopeRegional,
+		})
+		if err == nil {
+			_, err = client.DeleteWebACL(context.TODO(), &wafv2.DeleteWebACLInput{
+				Id:        aws.String(lb.WebACLId),
+				Name:      acl.WebACL.Name,
+				Scope:     types.ScopeRegional,
+				LockToken: acl.LockToken,
+			})
+		}
+		if err == nil || isErrorCode(err, "WAFNonexistentItemException") {
+			break
+		}
+		if !isErrorCode(err, "WAFAssociatedItemException") || attempt == 10 {
+			fmt.Println("Got an error deleting the web ACL:")
+			fmt.Println(err)
+			return false
+		}
+		time.Sleep(10 * time.Second)
+	}
+
+	emit(eventLoginRateLimitDeleted, "web_acl_arn", lb.WebACLArn)
+	lb.WebACLArn = ""
+	lb.WebACLId = ""
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var wpConstantPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// wpConstant is the value of a wp_config constant of the config file: a
+// YAML scalar, kept as the PHP literal in PHP, or a secret in Secrets
+// Manager, or one key of its JSON, which the instance fetches at boot.
+type wpConstant struct {
+	PHP    string `yaml:"-" json:"php,omitempty"`
+	Secret string `yaml:"secret" json:"secret,omitempty"`
+	Key    string `yaml:"key" json:"key,omitempty"`
+}
+
+func (c *wpConstant) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		type plain wpConstant
+		if err := node.Decode((*plain)(c)); err != nil {
+			return err
+		}
+		if c.Secret == "" {
+			return fmt.Errorf("line %d: a wp_config constant from Secrets Manager needs a secret", node.Line)
+		}
+		return nil
+	}
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: a wp_config constant is a value or a secret", node.Line)
+	}
+
+	switch node.ShortTag() {
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return err
+		}
+		c.PHP = strconv.FormatBool(b)
+	case "!!int":
+		var i int64
+		if err := node.Decode(&i); err != nil {
+			return err
+		}
+		c.PHP = strconv.FormatInt(i, 10)
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return err
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("line %d: a wp_config constant cannot be %s", node.Line, node.Value)
+		}
+		c.PHP = strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(c.PHP, ".e") {
+			c.PHP += ".0"
+		}
+	case "!!null":
+		c.PHP = "null"
+	default:
+		c.PHP = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(node.Value) + "'"
+	}
+	return nil
+}
+
+func validateWPConfig(constants map[string]wpConstant) error {
+	for name := range constants {
+		if !wpConstantPattern.MatchString(name) {
+			return fmt.Errorf("wp_config: invalid constant name %q", name)
+		}
+	}
+	return nil
+}
+
+// wpConfigLine is a constant as customize.sh sets it, with the value or
+// secret shell-quoted.
+type wpConfigLine struct {
+	Name   string
+	Value  string
+	Secret string
+	Key    string
+}
+
+// wpConfigLines are the constants in name order, so that the user data only
+// changes with them.
+func wpConfigLines(constants map[string]wpConstant) []wpConfigLine {
+	var lines []wpConfigLine
+	for name, c := range constants {
+		line := wpConfigLine{Name: name}
+		if c.Secret != "" {
+			line.Secret = shellQuote(c.Secret)
+			if c.Key != "" {
+				line.Key = shellQuote(c.Key)
+			}
+		} else if c.PHP != "" {
+			line.Value = shellQuote(c.PHP)
+		} else {
+			// A YAML null never reaches UnmarshalYAML.
+			line.Value = shellQuote("null")
+		}
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Name < lines[j].Name })
+	return lines
+}